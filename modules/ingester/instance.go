@@ -384,7 +384,7 @@ func (i *instance) FindTraceByID(ctx context.Context, id []byte) (*tempopb.Trace
 	defer i.blocksMtx.Unlock()
 
 	// headBlock
-	foundBytes, err := i.headBlock.Find(id, model.ObjectCombiner)
+	foundBytes, err := i.headBlock.Find(ctx, id, model.ObjectCombiner)
 	if err != nil {
 		return nil, fmt.Errorf("headBlock.Find failed: %w", err)
 	}
@@ -395,7 +395,7 @@ func (i *instance) FindTraceByID(ctx context.Context, id []byte) (*tempopb.Trace
 
 	// completingBlock
 	for _, c := range i.completingBlocks {
-		foundBytes, err = c.Find(id, model.ObjectCombiner)
+		foundBytes, err = c.Find(ctx, id, model.ObjectCombiner)
 		if err != nil {
 			return nil, fmt.Errorf("completingBlock.Find failed: %w", err)
 		}
@@ -48,6 +48,27 @@ func (o objectCombiner) Combine(dataEncoding string, objs ...[]byte) ([]byte, bo
 	return combinedTrace, wasCombined
 }
 
+type traceCombiner struct{}
+
+// TraceCombiner combines trace protos. It can be used with wal.AppendBlock.FindTrace and GetTraceIterator.
+var TraceCombiner = traceCombiner{}
+
+// Unmarshal converts obj encoded using dataEncoding into a *tempopb.Trace
+func (traceCombiner) Unmarshal(obj []byte, dataEncoding string) (*tempopb.Trace, error) {
+	return Unmarshal(obj, dataEncoding)
+}
+
+// Combine combines traceB into traceA. It is destructive.
+func (traceCombiner) Combine(traceA, traceB *tempopb.Trace) *tempopb.Trace {
+	combined, _, _, _ := CombineTraceProtos(traceA, traceB)
+	return combined
+}
+
+// Marshal converts trace into a byte slice encoded using dataEncoding
+func (traceCombiner) Marshal(trace *tempopb.Trace, dataEncoding string) ([]byte, error) {
+	return marshal(trace, dataEncoding)
+}
+
 // CombineTraceBytes combines objA and objB encoded using dataEncodingA and dataEncodingB and returns a trace encoded with dataEncodingA
 func CombineTraceBytes(objA []byte, objB []byte, dataEncodingA string, dataEncodingB string) (_ []byte, wasCombined bool, _ error) {
 	// if the byte arrays are the same, we can return quickly
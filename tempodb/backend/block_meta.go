@@ -49,15 +49,20 @@ func NewBlockMeta(tenantID string, blockID uuid.UUID, version string, encoding E
 }
 
 func (b *BlockMeta) ObjectAdded(id []byte) {
+	b.ObjectsAdded(id, id, 1)
+}
+
+// ObjectsAdded records count objects whose ids range from minID to maxID, for callers that add a batch of objects
+func (b *BlockMeta) ObjectsAdded(minID []byte, maxID []byte, count int) {
 	b.EndTime = time.Now()
 
-	if len(b.MinID) == 0 || bytes.Compare(id, b.MinID) == -1 {
-		b.MinID = id
+	if len(b.MinID) == 0 || bytes.Compare(minID, b.MinID) == -1 {
+		b.MinID = minID
 	}
 
-	if len(b.MaxID) == 0 || bytes.Compare(id, b.MaxID) == 1 {
-		b.MaxID = id
+	if len(b.MaxID) == 0 || bytes.Compare(maxID, b.MaxID) == 1 {
+		b.MaxID = maxID
 	}
 
-	b.TotalObjects++
+	b.TotalObjects += count
 }
@@ -41,6 +41,11 @@ func TestBlockMeta(t *testing.T) {
 	assert.True(t, b.EndTime.After(b.StartTime))
 	assert.Equal(t, 1, bytes.Compare(b.MaxID, b.MinID))
 	assert.Equal(t, 2, b.TotalObjects)
+
+	b.ObjectsAdded([]byte{0x00}, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 3)
+	assert.Equal(t, []byte{0x00}, b.MinID)
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, b.MaxID)
+	assert.Equal(t, 5, b.TotalObjects)
 }
 
 func TestBlockMetaParsing(t *testing.T) {
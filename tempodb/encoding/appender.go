@@ -2,6 +2,7 @@ package encoding
 
 import (
 	"hash"
+	"io"
 
 	"github.com/cespare/xxhash"
 	"github.com/grafana/tempo/tempodb/encoding/common"
@@ -17,6 +18,42 @@ type Appender interface {
 	DataLength() uint64
 }
 
+// RecordImporter is implemented by appenders that can track records for data the caller has
+// written to the underlying writer directly.
+type RecordImporter interface {
+	// ImportRecords adds the passed records. Record starts are relative to the beginning of the
+	// imported data and are shifted by the current offset. dataLength is the number of bytes imported.
+	ImportRecords(records []common.Record, dataLength uint64)
+}
+
+// ReaderAppender is implemented by appenders that can append an object read from a reader
+type ReaderAppender interface {
+	// AppendReader appends the id and the next size bytes of r
+	AppendReader(id common.ID, r io.Reader, size int) error
+}
+
+// PageAppender is implemented by appenders that can append several objects to a single page
+type PageAppender interface {
+	// AppendPage appends the ids and objects to one page. Each object is recorded with the start and length
+	//  of the page.
+	AppendPage(ids []common.ID, objs [][]byte) error
+}
+
+// WriteReader writes the id and the next size bytes of r to dataWriter. If dataWriter is not a
+// common.ReaderDataWriter the object is read into a buffer and written with Write.
+func WriteReader(dataWriter common.DataWriter, id common.ID, r io.Reader, size int) (int, error) {
+	if readerWriter, ok := dataWriter.(common.ReaderDataWriter); ok {
+		return readerWriter.WriteReader(id, r, size)
+	}
+
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return 0, err
+	}
+	return dataWriter.Write(id, b)
+}
+
 type appender struct {
 	dataWriter    common.DataWriter
 	records       map[uint64][]common.Record
@@ -42,27 +79,72 @@ func (a *appender) Append(id common.ID, b []byte) error {
 		return err
 	}
 
+	return a.cutPage(id)
+}
+
+// AppendReader implements ReaderAppender
+func (a *appender) AppendReader(id common.ID, r io.Reader, size int) error {
+	_, err := WriteReader(a.dataWriter, id, r, size)
+	if err != nil {
+		return err
+	}
+
+	return a.cutPage(id)
+}
+
+// AppendPage implements PageAppender
+func (a *appender) AppendPage(ids []common.ID, objs [][]byte) error {
+	for i, id := range ids {
+		_, err := a.dataWriter.Write(id, objs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.cutPage(ids...)
+}
+
+// cutPage cuts the page holding the objects written for ids and records them
+func (a *appender) cutPage(ids ...common.ID) error {
 	bytesWritten, err := a.dataWriter.CutPage()
 	if err != nil {
 		return err
 	}
 
-	a.hash.Reset()
-	_, _ = a.hash.Write(id)
-	hash := a.hash.Sum64()
-
-	records := a.records[hash]
-	records = append(records, common.Record{
-		ID:     id,
-		Start:  a.currentOffset,
-		Length: uint32(bytesWritten),
-	})
-	a.records[hash] = records
+	for _, id := range ids {
+		a.hash.Reset()
+		_, _ = a.hash.Write(id)
+		hash := a.hash.Sum64()
+
+		records := a.records[hash]
+		records = append(records, common.Record{
+			ID:     id,
+			Start:  a.currentOffset,
+			Length: uint32(bytesWritten),
+		})
+		a.records[hash] = records
+	}
 	a.currentOffset += uint64(bytesWritten)
 
 	return nil
 }
 
+// ImportRecords implements RecordImporter
+func (a *appender) ImportRecords(records []common.Record, dataLength uint64) {
+	for _, r := range records {
+		a.hash.Reset()
+		_, _ = a.hash.Write(r.ID)
+		hash := a.hash.Sum64()
+
+		a.records[hash] = append(a.records[hash], common.Record{
+			ID:     r.ID,
+			Start:  a.currentOffset + r.Start,
+			Length: r.Length,
+		})
+	}
+	a.currentOffset += dataLength
+}
+
 func (a *appender) Records() []common.Record {
 	sliceRecords := make([]common.Record, 0, len(a.records))
 	for _, r := range a.records {
@@ -73,11 +155,9 @@ func (a *appender) Records() []common.Record {
 	return sliceRecords
 }
 
+// RecordsForID does not use the appender's hash so it is safe to call concurrently with other reads
 func (a *appender) RecordsForID(id common.ID) []common.Record {
-	a.hash.Reset()
-	_, _ = a.hash.Write(id)
-	hash := a.hash.Sum64()
-	return a.records[hash]
+	return a.records[xxhash.Sum64(id)]
 }
 
 func (a *appender) Length() int {
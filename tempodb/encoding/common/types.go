@@ -67,6 +67,14 @@ type DataWriter interface {
 	Complete() error
 }
 
+// ReaderDataWriter is implemented by DataWriters that can write an object read from a reader to the current page
+// without the caller buffering it first
+type ReaderDataWriter interface {
+	// WriteReader writes the passed ID and the next size bytes of r to the current page. Nothing is written
+	//  to the page if fewer than size bytes can be read.
+	WriteReader(id ID, r io.Reader, size int) (int, error)
+}
+
 // DataWriterGeneric writes objects instead of byte slices
 type DataWriterGeneric interface {
 
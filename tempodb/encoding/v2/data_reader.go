@@ -34,11 +34,16 @@ func NewDataReader(r backend.ContextReader, encoding backend.Encoding) (common.D
 		return nil, err
 	}
 
+	return NewDataReaderWithPool(r, pool), nil
+}
+
+// NewDataReaderWithPool constructs a v2 DataReader that decompresses pages using the passed pool
+func NewDataReaderWithPool(r backend.ContextReader, pool ReaderPool) common.DataReader {
 	return &dataReader{
-		encoding:      encoding,
+		encoding:      pool.Encoding(),
 		contextReader: r,
 		pool:          pool,
-	}, nil
+	}
 }
 
 // Read implements common.DataReader
@@ -179,3 +179,36 @@ func createTestData(t require.TestingT, totalObjects int, objsPerPage int, enc b
 
 	return ids, objs, buffer.Bytes(), recs
 }
+
+func TestDataWriterWriteReader(t *testing.T) {
+	id := []byte{0x01, 0x02}
+	obj := make([]byte, 1000)
+	_, err := rand.Read(obj)
+	require.NoError(t, err)
+
+	expected := &bytes.Buffer{}
+	w, err := NewDataWriter(expected, backend.EncSnappy)
+	require.NoError(t, err)
+	_, err = w.Write(id, obj)
+	require.NoError(t, err)
+	expectedLength, err := w.CutPage()
+	require.NoError(t, err)
+
+	actual := &bytes.Buffer{}
+	w, err = NewDataWriter(actual, backend.EncSnappy)
+	require.NoError(t, err)
+	readerWriter, ok := w.(common.ReaderDataWriter)
+	require.True(t, ok)
+
+	// a short read leaves the page untouched
+	_, err = readerWriter.WriteReader(id, bytes.NewReader(obj[:10]), len(obj))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = readerWriter.WriteReader(id, bytes.NewReader(obj), len(obj))
+	require.NoError(t, err)
+	actualLength, err := w.CutPage()
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedLength, actualLength)
+	assert.Equal(t, expected.Bytes(), actual.Bytes())
+}
@@ -26,6 +26,11 @@ func NewDataWriter(writer io.Writer, encoding backend.Encoding) (common.DataWrit
 		return nil, err
 	}
 
+	return NewDataWriterWithPool(writer, pool)
+}
+
+// NewDataWriterWithPool creates a paged page writer that compresses pages using the passed pool
+func NewDataWriterWithPool(writer io.Writer, pool WriterPool) (common.DataWriter, error) {
 	compressedBuffer := &bytes.Buffer{}
 	compressionWriter, err := pool.GetWriter(compressedBuffer)
 	if err != nil {
@@ -47,6 +52,27 @@ func (p *dataWriter) Write(id common.ID, obj []byte) (int, error) {
 	return p.objectRW.MarshalObjectToWriter(id, obj, p.objectBuffer)
 }
 
+// WriteReader implements common.ReaderDataWriter. The object is copied from r straight into the page buffer.
+func (p *dataWriter) WriteReader(id common.ID, r io.Reader, size int) (int, error) {
+	objectStart := p.objectBuffer.Len()
+	totalLength, err := marshalObjectHeaderToWriter(id, size, p.objectBuffer)
+	if err != nil {
+		p.objectBuffer.Truncate(objectStart)
+		return 0, err
+	}
+
+	_, err = io.CopyN(p.objectBuffer, r, int64(size))
+	if err != nil {
+		p.objectBuffer.Truncate(objectStart)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	return totalLength, nil
+}
+
 // CutPage implements DataWriter
 func (p *dataWriter) CutPage() (int, error) {
 	// compress the raw object buffer
@@ -57,7 +83,10 @@ func (p *dataWriter) CutPage() (int, error) {
 	}
 
 	// force flush everything
-	p.compressionWriter.Close()
+	err = p.compressionWriter.Close()
+	if err != nil {
+		return 0, err
+	}
 
 	// now marshal the buffer as a page to the output
 	bytesWritten, err := marshalPageToWriter(p.compressedBuffer.Bytes(), p.outputWriter, constDataHeader)
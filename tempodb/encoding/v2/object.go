@@ -23,8 +23,22 @@ func NewObjectReaderWriter() common.ObjectReaderWriter {
 */
 
 func (object) MarshalObjectToWriter(id common.ID, b []byte, w io.Writer) (int, error) {
+	totalLength, err := marshalObjectHeaderToWriter(id, len(b), w)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return totalLength, err
+}
+
+// marshalObjectHeaderToWriter writes everything but the object bytes of an object of objectLength bytes
+func marshalObjectHeaderToWriter(id common.ID, objectLength int, w io.Writer) (int, error) {
 	idLength := len(id)
-	totalLength := len(b) + idLength + uint32Size*2
+	totalLength := objectLength + idLength + uint32Size*2
 
 	err := binary.Write(w, binary.LittleEndian, uint32(totalLength))
 	if err != nil {
@@ -39,12 +53,8 @@ func (object) MarshalObjectToWriter(id common.ID, b []byte, w io.Writer) (int, e
 	if err != nil {
 		return 0, err
 	}
-	_, err = w.Write(b)
-	if err != nil {
-		return 0, err
-	}
 
-	return totalLength, err
+	return totalLength, nil
 }
 
 func (object) UnmarshalObjectFromReader(r io.Reader) (common.ID, []byte, error) {
@@ -99,10 +109,16 @@ func (object) UnmarshalAndAdvanceBuffer(buffer []byte) ([]byte, common.ID, []byt
 	idLength = binary.LittleEndian.Uint32(buffer)
 	buffer = buffer[uint32Size:]
 
+	if totalLength < uint32Size*2 {
+		return nil, nil, nil, fmt.Errorf("totalLength %d is too short", totalLength)
+	}
 	restLength := totalLength - uint32Size*2
 	if uint32(len(buffer)) < restLength {
 		return nil, nil, nil, fmt.Errorf("unable to read id/object from buffer")
 	}
+	if idLength > restLength {
+		return nil, nil, nil, fmt.Errorf("id length %d outside bounds of object %d. corrupt buffer?", idLength, restLength)
+	}
 
 	bytesID := buffer[:idLength]
 	bytesObject := buffer[idLength:restLength]
@@ -68,3 +68,15 @@ func TestMarshalUnmarshalFromBuffer(t *testing.T) {
 		assert.True(t, proto.Equal(reqs[i], outReq))
 	}
 }
+
+func TestUnmarshalAndAdvanceBufferCorrupt(t *testing.T) {
+	o := object{}
+
+	// total length shorter than the length fields
+	_, _, _, err := o.UnmarshalAndAdvanceBuffer([]byte{0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	assert.Error(t, err)
+
+	// id length longer than the object
+	_, _, _, err = o.UnmarshalAndAdvanceBuffer([]byte{0x0a, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05})
+	assert.Error(t, err)
+}
@@ -3,298 +3,2627 @@ package wal
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/cespare/xxhash"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/google/uuid"
 	"github.com/grafana/tempo/tempodb/backend"
 	"github.com/grafana/tempo/tempodb/encoding"
 	"github.com/grafana/tempo/tempodb/encoding/common"
+	v2 "github.com/grafana/tempo/tempodb/encoding/v2"
 )
 
+// legacyVersion is the version of wal files named blockID:tenantID, written before the version, encoding and data
+// encoding were added to the name. Their contract is:
+//   - parseFilename reads blockID:tenantID as legacyVersion with backend.EncNone and no data encoding, which is what
+//     the v0 writer produced, and fullFilename writes a legacyVersion meta back as blockID:tenantID so a parsed name
+//     resolves to the same path. The encoding and data encoding of the meta are not part of the name.
+//   - Tenant ids can not contain colons, blockID:team:prod does not parse.
+//   - The v0 encoding is no longer available so these files can be parsed, and are reported by ReplayWALDir, but not
+//     replayed. New blocks can not be created with this version.
+const legacyVersion = "v0"
+
+// maxDataEncodingLength is the maximum length in bytes of a data encoding. Data encodings are stored as is in wal file
+// names and block metas.
 const maxDataEncodingLength = 32
 
-// AppendBlock is a block that is actively used to append new objects to.  It stores all data in the appendFile
-// in the order it was received and an in memory sorted index.
-type AppendBlock struct {
-	meta     *backend.BlockMeta
-	encoding encoding.VersionedEncoding
+var (
+	// ErrReadAllLimitExceeded is returned by ReadAll when the block holds more objects than allowed
+	ErrReadAllLimitExceeded = errors.New("block contains more objects than the ReadAll limit")
+	// ErrBlockFull is returned by Write when the block holds the number of records configured with WithMaxRecords
+	ErrBlockFull = errors.New("block has reached the maximum number of records")
+	// ErrNoIndex is returned by reads that need the index from a block created WithoutIndex
+	ErrNoIndex = errors.New("block was created without an index")
+	// ErrBlockExpired is returned by Write when the block is older than configured with WithMaxAge
+	ErrBlockExpired = errors.New("block has exceeded its maximum age")
+	// ErrObjectTooLarge is returned by Write for objects larger than configured with WithMaxObjectSize
+	ErrObjectTooLarge = errors.New("object exceeds the maximum object size")
+	// ErrMultiObjectPage is returned during replay of blocks expecting SingleObjectPages for a page holding
+	// more than one object
+	ErrMultiObjectPage = errors.New("wal page holds more than one object")
+	// ErrBlockNotWritable is returned by writes to a block that is not Writable
+	ErrBlockNotWritable = errors.New("block is not writable")
+	// ErrBlockClosed is returned by writes to the block once Close has been called
+	ErrBlockClosed = errors.New("block has been closed")
+	// ErrBlockCleared is returned by the block's methods once Clear has been called. It wraps os.ErrClosed.
+	ErrBlockCleared = fmt.Errorf("block has been cleared: %w", os.ErrClosed)
+)
+
+// ErrWALSizeMismatch is returned by GetIterator when the block's file is shorter than the data appended to it
+type ErrWALSizeMismatch struct {
+	FileSize   int64
+	DataLength uint64
+}
+
+func (e *ErrWALSizeMismatch) Error() string {
+	return fmt.Sprintf("wal file size %d is smaller than appended data length %d", e.FileSize, e.DataLength)
+}
+
+// ErrPageOffset is returned by ReadAt when no page of Length bytes begins at Offset in the block's file
+type ErrPageOffset struct {
+	Offset uint64
+	Length uint64
+}
+
+func (e *ErrPageOffset) Error() string {
+	return fmt.Sprintf("no wal page of length %d at offset %d", e.Length, e.Offset)
+}
+
+// ErrClear is returned by Clear when a file of the block could not be removed. Exists reports whether the file
+// was still on disk afterwards so the caller can tell an orphaned file from an error that left nothing behind.
+type ErrClear struct {
+	Filename string
+	Exists   bool
+	Err      error
+}
+
+func (e *ErrClear) Error() string {
+	return fmt.Sprintf("failed to remove %s (exists: %t): %v", e.Filename, e.Exists, e.Err)
+}
+
+func (e *ErrClear) Unwrap() error {
+	return e.Err
+}
+
+// ErrWriteBatch is returned by WriteBatch when an object of the batch could not be written. Index is the position of
+// that object in the batch, the objects before it were written.
+type ErrWriteBatch struct {
+	Index int
+	Err   error
+}
+
+func (e *ErrWriteBatch) Error() string {
+	return fmt.Sprintf("failed to write object %d of batch: %v", e.Index, e.Err)
+}
+
+func (e *ErrWriteBatch) Unwrap() error {
+	return e.Err
+}
+
+// ErrSkippedPages is the replay warning of blocks replayed WithBestEffortReplay when pages could not be read and were
+// skipped. Offsets are where each skipped range of the file began, Bytes is the total length of the ranges and Err is
+// the error of the first page skipped.
+type ErrSkippedPages struct {
+	Offsets []uint64
+	Bytes   uint64
+	Err     error
+}
+
+func (e *ErrSkippedPages) Error() string {
+	return fmt.Sprintf("skipped %d unreadable wal pages at offsets %v: %v", len(e.Offsets), e.Offsets, e.Err)
+}
+
+func (e *ErrSkippedPages) Unwrap() error {
+	return e.Err
+}
+
+// ErrFilenameSegments is returned when parsing a wal file name that does not have the number of colon separated
+// segments of any layout. Files that are not wal files usually fail with it or ErrFilenameUUID.
+type ErrFilenameSegments struct {
+	Filename string
+}
+
+func (e *ErrFilenameSegments) Error() string {
+	return fmt.Sprintf("unable to parse %s. unexpected number of segments", e.Filename)
+}
+
+// ErrFilenameUUID is returned when parsing a wal file name whose first segment is not a block id
+type ErrFilenameUUID struct {
+	Filename string
+	Segment  string
+	Err      error
+}
+
+func (e *ErrFilenameUUID) Error() string {
+	return fmt.Sprintf("unable to parse %s. error parsing uuid segment %q: %v", e.Filename, e.Segment, e.Err)
+}
+
+func (e *ErrFilenameUUID) Unwrap() error {
+	return e.Err
+}
+
+// ErrFilenameEncoding is returned when parsing a wal file name whose encoding segment is neither a backend.Encoding
+// nor a registered Codec
+type ErrFilenameEncoding struct {
+	Filename string
+	Segment  string
+	Err      error
+}
+
+func (e *ErrFilenameEncoding) Error() string {
+	return fmt.Sprintf("unable to parse %s. error parsing encoding segment %q: %v", e.Filename, e.Segment, e.Err)
+}
+
+func (e *ErrFilenameEncoding) Unwrap() error {
+	return e.Err
+}
+
+// ErrFilenameMissingFields is returned when parsing a wal file name with an empty tenant or version
+type ErrFilenameMissingFields struct {
+	Filename string
+}
+
+func (e *ErrFilenameMissingFields) Error() string {
+	return fmt.Sprintf("unable to parse %s. missing fields", e.Filename)
+}
+
+const (
+	clearRemoveAttempts = 3
+	clearRemoveBackoff  = 10 * time.Millisecond
+)
+
+// removeFile is replaced in tests to simulate filesystems that refuse to remove open files
+var removeFile = os.Remove
+
+// openReadFile is replaced in tests to count the opens of the block's read file
+var openReadFile = os.OpenFile
+
+// AppendBlock is a block that is actively used to append new objects to.  It stores all data in the appendFile
+// in the order it was received and an in memory sorted index.
+type AppendBlock struct {
+	// mtx guards the block's state, including the file handles, so it is safe for concurrent callers. Iterators
+	// returned by the block read the file without holding it.
+	mtx sync.RWMutex
+
+	meta     *backend.BlockMeta
+	encoding encoding.VersionedEncoding
+
+	appendFile *os.File
+	appender   encoding.Appender
+
+	filepath string
+	readFile *os.File
+	// readFileMtx serializes opening readFile by reads holding the read lock
+	readFileMtx sync.Mutex
+	// readFileSlot is the slot acquired from the open read file limit for readFile
+	readFileSlot chan struct{}
+	// swappedReadFiles are the read files replaced by SwapIn. They are kept open for the readers still using them and
+	// closed with readFile, whose slot they share.
+	swappedReadFiles []*os.File
+
+	// mapped is readFile mapped into memory for Find once the block is sealed, if enabled with WithMmap. mmapMtx
+	// guards creating it under the read lock. It is unmapped with readFile.
+	mmap       bool
+	mmapMtx    sync.Mutex
+	mapped     []byte
+	mmapFailed bool
+
+	// batchedPageSize is the number of bytes of objects WriteBatch writes to a page, 0 writes a page per object
+	batchedPageSize int
+	// pageObjects is the number of objects replay expects in a page
+	pageObjects PageObjects
+	// verifyObjectCount makes Complete check meta.TotalObjects against the objects in the file
+	verifyObjectCount bool
+
+	// diskLowWatermark is the space writes must leave on the wal disk, see checkDiskSpace. 0 disables the check.
+	diskLowWatermark     uint64
+	diskCheckInterval    int
+	diskSpace            DiskSpaceFunc
+	writesSinceDiskCheck int
+	diskAvailable        uint64
+	diskSpaceKnown       bool
+
+	// index is a sorted snapshot of the appender's records built by ReindexForSearch. It is
+	// dropped on the next Write.
+	index common.Records
+
+	readAllMaxObjects int
+	logger            log.Logger
+	appendFlags       int
+	fileMode          os.FileMode
+	encodingResolver  EncodingResolver
+	pageFooters       bool
+	pageChecksums     bool
+	maxRecordsPerID   int
+
+	// bestEffortReplay skips pages that fail to replay instead of stopping at the first
+	bestEffortReplay bool
+	// tenantDirs places the block's file in a folder named after its tenant in the block's path
+	tenantDirs bool
+
+	metrics MetricsSink
+	// objectSizes is metrics if it also implements ObjectSizeSink
+	objectSizes ObjectSizeSink
+
+	replayProgress   ReplayProgressFunc
+	replayBufferSize int
+
+	// version is the encoding version of new blocks. replayed blocks use the version in their file name
+	version string
+
+	// mirrorPath is the folder of the optional mirror file. Every page written to appendFile is also
+	// written to mirrorFile.
+	mirrorPath   string
+	mirrorFile   *os.File
+	appendWriter io.Writer
+
+	writeOverhead int
+	readTimings   ReadTimingSink
+
+	// records is the number of records appended by Write and Import
+	records    int
+	maxRecords int
+
+	maxObjectSize int
+
+	flushes flushTracker
+
+	// indexless blocks do not track records on Write. The index is rebuilt by replaying the file in GetIterator.
+	indexless bool
+
+	compactionLevel uint8
+
+	// tempDir is where temporary files are created. Defaults to filepath.
+	tempDir string
+
+	// codec is the name of the registered Codec used to compress pages instead of meta.Encoding
+	codec string
+
+	// checkpointEvery is the number of records between automatic index checkpoints. checkpointedLength is
+	// the length of the data file covered by the last checkpoint.
+	checkpointEvery    int
+	checkpointFile     *os.File
+	checkpointedLength uint64
+
+	// maxAge is compared to the block's start time in meta using clock
+	maxAge time.Duration
+	// clock is the source of the times in meta and of the appended times
+	clock Clock
+
+	replayResult ReplayResult
+
+	// cleared is set by Clear, the block's files are gone and it can not be used afterwards
+	cleared bool
+	// closed is set by Close, the block's files are kept but it can not be appended to afterwards
+	closed bool
+
+	// appendedStart and appendedEnd are the times of the first and last write to the block
+	appendedStart time.Time
+	appendedEnd   time.Time
+}
+
+func newAppendBlock(id uuid.UUID, tenantID string, filepath string, e backend.Encoding, dataEncoding string, opts ...AppendBlockOption) (*AppendBlock, error) {
+	if !validFilenameField(dataEncoding) {
+		return nil, fmt.Errorf("dataEncoding %s is invalid", dataEncoding)
+	}
+
+	h := &AppendBlock{
+		filepath:          filepath,
+		readAllMaxObjects: defaultReadAllMaxObjects,
+		logger:            log.NewNopLogger(),
+		clock:             realClock{},
+		version:           defaultVersion,
+		fileMode:          defaultFileMode,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	v, err := encoding.FromVersion(h.version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wal version: %w", err)
+	}
+	h.encoding = v
+
+	if h.encodingResolver != nil {
+		e = h.encodingResolver.EncodingForTenant(tenantID)
+	}
+	if h.codec != "" {
+		_, err = getCodec(h.codec)
+		if err != nil {
+			return nil, err
+		}
+		e = backend.EncNone
+	}
+	if !supportedEncoding(e) {
+		return nil, fmt.Errorf("unsupported wal encoding %s. supported: %s", e, backend.SupportedEncodingString())
+	}
+	h.meta = backend.NewBlockMeta(tenantID, id, v.Version(), e, dataEncoding)
+	h.meta.StartTime = h.clock.Now()
+	h.meta.EndTime = h.meta.StartTime
+	h.meta.CompactionLevel = h.compactionLevel
+
+	if h.batchedPageSize > 0 && h.pageObjects == SingleObjectPages {
+		return nil, errors.New("batched pages can not be written to blocks expecting single object pages")
+	}
+
+	if h.tenantDirs {
+		err = h.makeTenantDirs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = h.openAppendFile()
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.newAppender()
+	if err != nil {
+		return nil, err
+	}
+
+	if h.meta.CompactionLevel > 0 {
+		err = h.writeCompactionLevel()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// openAppendFile creates or truncates the append file, and the mirror file if configured
+func (a *AppendBlock) openAppendFile() error {
+	f, err := os.OpenFile(a.fullFilename(), os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC|a.appendFlags, a.fileMode)
+	if err != nil {
+		return err
+	}
+	a.appendFile = f
+	a.appendWriter = f
+
+	if a.mirrorPath != "" {
+		a.mirrorFile, err = os.OpenFile(a.mirrorFilename(), os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC|a.appendFlags, a.fileMode)
+		if err != nil {
+			_ = f.Close()
+			a.appendFile = nil
+			return err
+		}
+		a.appendWriter = io.MultiWriter(f, a.mirrorFile)
+	}
+
+	return nil
+}
+
+// newAppender sets an empty appender writing to the append file
+func (a *AppendBlock) newAppender() error {
+	dataWriter, err := a.newDataWriter(a.appendWriter)
+	if err != nil {
+		return err
+	}
+
+	if a.indexless {
+		a.appender = newIndexlessAppender(dataWriter)
+	} else {
+		a.appender = encoding.NewAppender(dataWriter)
+	}
+	return nil
+}
+
+// newAppendBlockFromFile returns an AppendBlock that can not be appended to, but can
+// be completed. It can return a warning or a fatal error
+func newAppendBlockFromFile(filename string, path string, opts ...AppendBlockOption) (*AppendBlock, error, error) {
+	b, err := blockFromFilename(filename, path, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = b.loadCompactionLevel()
+	if err != nil {
+		level.Warn(b.logger).Log("msg", "failed to load wal block compaction level", "file", filename, "err", err)
+	}
+
+	start := time.Now()
+	warning, err := b.replayFile(filename)
+	if b.metrics != nil {
+		b.metrics.Replayed(filename, time.Since(start), b.replayResult, warning, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, warning, nil
+}
+
+// replayFile replays the block's file to build its appender
+func (a *AppendBlock) replayFile(filename string) (error, error) {
+	f, err := a.file()
+	if err != nil {
+		return nil, err
+	}
+
+	records, length, warning, err := a.replayWithCheckpoint(f, filename)
+	if err != nil {
+		a.closeReadFile()
+		return nil, err
+	}
+
+	// prefer the mirror if the primary did not replay cleanly
+	if warning != nil && a.mirrorPath != "" {
+		mirror, mirrorWarning, err := a.replayMirror(filename)
+		if err != nil {
+			level.Warn(a.logger).Log("msg", "failed to replay wal mirror", "file", filename, "err", err)
+		} else if mirrorWarning == nil || len(mirror) > len(records) {
+			level.Info(a.logger).Log("msg", "using wal mirror", "file", filename, "warning", warning)
+			records, length, warning = mirror, recordsLength(mirror), mirrorWarning
+		}
+	}
+
+	info, err := a.readFile.Stat()
+	if err != nil {
+		a.closeReadFile()
+		return nil, err
+	}
+	a.replayResult = ReplayResult{
+		Recovered: len(records),
+		Empty:     len(records) == 0,
+		EmptyFile: info.Size() == 0,
+	}
+	var skipped *ErrSkippedPages
+	if errors.As(warning, &skipped) {
+		a.replayResult.TruncatedAtOffset = skipped.Offsets[0]
+		a.replayResult.SkippedBytes = skipped.Bytes
+	} else if warning != nil {
+		a.replayResult.TruncatedAtOffset = length
+		a.replayResult.SkippedBytes = uint64(info.Size()) - a.replayResult.TruncatedAtOffset
+	}
+
+	common.SortRecords(records)
+
+	a.appender = encoding.NewRecordAppender(records)
+	a.meta.TotalObjects = a.appender.Length()
+
+	return warning, nil
+}
+
+// supportedEncoding returns true for the encodings wal pages can be written with. Every backend.SupportedEncoding
+// is validated by the write and replay tests.
+func supportedEncoding(e backend.Encoding) bool {
+	for _, supported := range backend.SupportedEncoding {
+		if e == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// recordsLength returns the number of bytes covered by records, which must be in file order
+func recordsLength(records []common.Record) uint64 {
+	if len(records) == 0 {
+		return 0
+	}
+	last := records[len(records)-1]
+	return last.Start + uint64(last.Length)
+}
+
+// blockFromFilename returns an AppendBlock with the meta described by filename and no appender
+func blockFromFilename(filename string, path string, opts ...AppendBlockOption) (*AppendBlock, error) {
+	blockID, tenantID, version, e, dataEncoding, err := parseFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := encoding.FromVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &AppendBlock{
+		meta:              backend.NewBlockMeta(tenantID, blockID, version, e, dataEncoding),
+		filepath:          path,
+		encoding:          v,
+		readAllMaxObjects: defaultReadAllMaxObjects,
+		logger:            log.NewNopLogger(),
+		codec:             codecFromFilename(filename),
+		clock:             realClock{},
+		fileMode:          defaultFileMode,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b, nil
+}
+
+// replayWithCheckpoint loads the block's index checkpoint if there is one and replays the rest of f. It also returns
+// the length of f covered by the records. The checkpointed records are in id order so that is the length covered by
+// the checkpoint, or the end of the last replayed record if any were replayed after it.
+func (a *AppendBlock) replayWithCheckpoint(f *os.File, filename string) ([]common.Record, uint64, error, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	checkpointed, start, err := a.loadCheckpoint(info.Size())
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	records, warning, err := a.replayFrom(f, filename, start)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	length := start
+	if replayed := recordsLength(records); replayed > length {
+		length = replayed
+	}
+	return append(checkpointed, records...), length, warning, nil
+}
+
+// replay walks the pages in f and returns the records found. It returns a warning for errors that
+// only affect part of the file and a fatal error if the file can not be read at all
+func (a *AppendBlock) replay(f *os.File, filename string) ([]common.Record, error, error) {
+	return a.replayFrom(f, filename, 0)
+}
+
+// replayFrom is replay starting at offset start which must be the beginning of a page
+func (a *AppendBlock) replayFrom(f *os.File, filename string, start uint64) ([]common.Record, error, error) {
+	var records []common.Record
+	warning, err := a.walkPages(f, filename, start, func(id common.ID, start uint64, length uint32) {
+		// make a copy so we don't hold onto the iterator buffer
+		recordID := append([]byte(nil), id...)
+		records = append(records, common.Record{
+			ID:     recordID,
+			Start:  start,
+			Length: length,
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return records, warning, nil
+}
+
+// walkPages reads the pages in f starting at offset start, which must be the beginning of a page, and calls fn with
+// the id of each object and the offset and length of its page. id is only valid during the call. It stops at the first
+// page that fails to read and returns that error as a warning, unless the block is replayed WithBestEffortReplay in
+// which case it skips to the next page that can be read and returns an *ErrSkippedPages warning.
+func (a *AppendBlock) walkPages(f *os.File, filename string, start uint64, fn func(id common.ID, start uint64, length uint32)) (error, error) {
+	dataReader, err := a.newDataReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dataReader.Close()
+
+	if start > 0 {
+		err = a.seekPage(f, dataReader, start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the buffer is reused for every page and only grows so large pages are not allocated over and over
+	buffer := make([]byte, 0, a.replayBufferSize)
+	var page []byte
+	var pageLen uint32
+	var ids []common.ID
+	var skipped *ErrSkippedPages
+	pages := 0
+	objectReader := a.encoding.NewObjectReaderWriter()
+	currentOffset := start
+	progress := a.newReplayProgress(f, start)
+	defer func() { progress.done(currentOffset) }()
+	for {
+		page, pageLen, err = dataReader.NextPage(buffer)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if cap(page) > cap(buffer) {
+				buffer = page
+			}
+			ids, err = a.pageIDs(objectReader, page, ids[:0])
+		}
+		if err != nil {
+			a.logReplayWarning(filename, currentOffset, pages, err)
+			if !a.bestEffortReplay {
+				return err, nil
+			}
+
+			next, resyncErr := a.nextReadablePage(f, dataReader, objectReader, currentOffset+1)
+			if resyncErr != nil {
+				return nil, resyncErr
+			}
+			if skipped == nil {
+				skipped = &ErrSkippedPages{Err: err}
+			}
+			skipped.Offsets = append(skipped.Offsets, currentOffset)
+			skipped.Bytes += next - currentOffset
+			currentOffset = next
+
+			err = a.seekPage(f, dataReader, next)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, id := range ids {
+			fn(id, currentOffset, pageLen)
+		}
+		pages++
+		currentOffset += uint64(pageLen)
+		progress.processed(currentOffset)
+	}
+
+	if skipped != nil {
+		return skipped, nil
+	}
+	return nil, nil
+}
+
+// seekPage positions f and dataReader, which reads f, at offset which must be the beginning of a page
+func (a *AppendBlock) seekPage(f *os.File, dataReader common.DataReader, offset uint64) error {
+	_, err := f.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if footerReader, ok := dataReader.(*footerDataReader); ok {
+		footerReader.offset = offset
+	}
+
+	return nil
+}
+
+// nextReadablePage returns the first offset at or after from at which a page that can be replayed begins, or the
+// size of f if there is none. Offsets are tried byte by byte so it is only used by best effort replay. Offsets whose
+// page length would run past the end of the file are skipped without reading the page.
+func (a *AppendBlock) nextReadablePage(f *os.File, dataReader common.DataReader, objectReader common.ObjectReaderWriter, from uint64) (uint64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := uint64(info.Size())
+	footerLength := uint64(a.footerLength())
+
+	lengthBytes := make([]byte, pageLengthSize)
+	var buffer []byte
+	var ids []common.ID
+	for offset := from; offset+pageLengthSize <= size; offset++ {
+		_, err = f.ReadAt(lengthBytes, int64(offset))
+		if err != nil {
+			return 0, err
+		}
+		pageLength := uint64(binary.LittleEndian.Uint32(lengthBytes))
+		if pageLength <= pageLengthSize || offset+pageLength+footerLength > size {
+			continue
+		}
+
+		err = a.seekPage(f, dataReader, offset)
+		if err != nil {
+			return 0, err
+		}
+		page, _, err := dataReader.NextPage(buffer)
+		if err != nil {
+			continue
+		}
+		buffer = page
+		_, err = a.pageIDs(objectReader, page, ids[:0])
+		if err == nil {
+			return offset, nil
+		}
+	}
+
+	return size, nil
+}
+
+// ValidateWALFile reads every page of the wal file like replay does, without keeping the records, so it is cheap to
+// check the file before replaying it. Index checkpoints are not used. Pass the options the file was written with,
+// such as WithPageFooters. It returns a warning if part of the file can not be read and a fatal error if none of it can.
+func ValidateWALFile(filename string, path string, opts ...AppendBlockOption) (error, error) {
+	b, err := blockFromFilename(filename, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(b.fullFilename())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return b.walkPages(f, filename, 0, func(common.ID, uint64, uint32) {})
+}
+
+// replayMirror replays the mirror file. If it replays cleanly the block switches to reading from the mirror
+// and the primary becomes the mirror.
+func (a *AppendBlock) replayMirror(filename string) ([]common.Record, error, error) {
+	f, err := os.OpenFile(a.mirrorFilename(), os.O_RDONLY, a.fileMode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, warning, err := a.replay(f, filename)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	if a.readFile != nil {
+		_ = a.readFile.Close()
+	}
+	a.readFile = f
+	a.filepath, a.mirrorPath = a.mirrorPath, a.filepath
+
+	return records, warning, nil
+}
+
+// ReplayResult describes how much of a wal file was recovered when the block was replayed
+type ReplayResult struct {
+	// Recovered is the number of objects replayed
+	Recovered int
+	// TruncatedAtOffset is the offset of the first page that failed to replay. Only set if replay returned a warning.
+	TruncatedAtOffset uint64
+	// SkippedBytes is the number of bytes after TruncatedAtOffset that were dropped
+	SkippedBytes uint64
+	// Empty is true if no objects were replayed. Callers can delete such blocks instead of loading them.
+	Empty bool
+	// EmptyFile is true if the file was empty, usually left by a process killed after creating the block but before
+	// the first Write. Empty is also true.
+	EmptyFile bool
+}
+
+// ReplayResult returns the result of replaying the block's file. It is empty for blocks that were not replayed.
+func (a *AppendBlock) ReplayResult() ReplayResult {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	return a.replayResult
+}
+
+func (a *AppendBlock) logReplayWarning(filename string, offset uint64, record int, err error) {
+	level.Warn(a.logger).Log("msg", "error replaying wal page", "file", filename, "offset", offset, "record", record, "err", err)
+}
+
+func (a *AppendBlock) Write(id common.ID, b []byte) error {
+	_, _, err := a.WriteAt(id, b)
+	return err
+}
+
+// WriteAt is Write but also returns the offset in the append file of the page holding the object and its length, the
+// start and length of the record replay builds for it. With page footers the length includes the footer.
+func (a *AppendBlock) WriteAt(id common.ID, b []byte) (uint64, uint64, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return 0, 0, ErrBlockCleared
+	}
+
+	err := a.checkWrite(len(b))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	dataLength := a.appender.DataLength()
+	err = a.appender.Append(id, b)
+	if err != nil {
+		a.releaseDiskSpace(len(b))
+		return 0, 0, err
+	}
+	a.wrote(id, len(b), dataLength)
+	return dataLength, a.appender.DataLength() - dataLength, nil
+}
+
+// WriteReader appends the next size bytes of r under id like Write. When the block's appender supports it the object
+// is copied from r into the page without buffering it first, otherwise it is read into a buffer. Nothing is appended
+// if fewer than size bytes can be read.
+func (a *AppendBlock) WriteReader(id common.ID, r io.Reader, size int) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	err := a.checkWrite(size)
+	if err != nil {
+		return err
+	}
+
+	dataLength := a.appender.DataLength()
+	if readerAppender, ok := a.appender.(encoding.ReaderAppender); ok {
+		err = readerAppender.AppendReader(id, r, size)
+	} else {
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		if err == nil {
+			err = a.appender.Append(id, b)
+		}
+	}
+	if err != nil {
+		a.releaseDiskSpace(size)
+		return err
+	}
+	a.wrote(id, size, dataLength)
+	return nil
+}
+
+// wrote updates the block after the object for id of size bytes has been appended. dataLength is the appender's
+// DataLength before.
+func (a *AppendBlock) wrote(id common.ID, size int, dataLength uint64) {
+	if a.objectSizes != nil {
+		a.objectSizes.ObjectAppended(a.meta.TenantID, size)
+	}
+	if a.metrics != nil {
+		a.metrics.Appended(int(a.appender.DataLength() - dataLength))
+	}
+	a.meta.ObjectAdded(id)
+	a.appended()
+	a.index = nil
+	a.records++
+	a.flushes.wrote(1)
+	a.maybeCheckpoint(a.records - 1)
+}
+
+// WriteBatch appends objs[i] under ids[i] in order, as if Write was called for each of them, but takes the lock and
+// updates the meta once for the whole batch. If an object fails to be written the objects before it are kept and
+// an *ErrWriteBatch with its index is returned.
+func (a *AppendBlock) WriteBatch(ids []common.ID, objs [][]byte) error {
+	if len(ids) != len(objs) {
+		return fmt.Errorf("ids and objs length mismatch %d != %d", len(ids), len(objs))
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	previousRecords := a.records
+	dataLength := a.appender.DataLength()
+	var minID, maxID common.ID
+	var err error
+	written := 0
+	for written < len(ids) {
+		var n int
+		n, err = a.appendPage(ids[written:], objs[written:])
+		for _, id := range ids[written : written+n] {
+			if minID == nil || bytes.Compare(id, minID) == -1 {
+				minID = id
+			}
+			if maxID == nil || bytes.Compare(id, maxID) == 1 {
+				maxID = id
+			}
+		}
+		written += n
+		if err != nil {
+			break
+		}
+	}
+
+	if written > 0 {
+		if a.objectSizes != nil {
+			for _, obj := range objs[:written] {
+				a.objectSizes.ObjectAppended(a.meta.TenantID, len(obj))
+			}
+		}
+		if a.metrics != nil {
+			a.metrics.Appended(int(a.appender.DataLength() - dataLength))
+		}
+		a.meta.ObjectsAdded(minID, maxID, written)
+		a.appended()
+		a.index = nil
+		a.flushes.wrote(written)
+		a.maybeCheckpoint(previousRecords)
+	}
+
+	if err != nil {
+		return &ErrWriteBatch{Index: written, Err: err}
+	}
+	return nil
+}
+
+// appendPage appends the first of ids and objs to a page of its own or, WithBatchedPages, as many of them as fit in a
+// page. It returns the number of objects appended and the error for the object after them, if any.
+func (a *AppendBlock) appendPage(ids []common.ID, objs [][]byte) (int, error) {
+	pageAppender, ok := a.appender.(encoding.PageAppender)
+	if a.batchedPageSize <= 0 || !ok {
+		err := a.checkWrite(len(objs[0]))
+		if err != nil {
+			return 0, err
+		}
+		err = a.appender.Append(ids[0], objs[0])
+		if err != nil {
+			a.releaseDiskSpace(len(objs[0]))
+			return 0, err
+		}
+		a.records++
+		return 1, nil
+	}
+
+	var err error
+	n, size := 0, 0
+	for ; n < len(ids); n++ {
+		if n > 0 && (size+len(objs[n]) > a.batchedPageSize || containsID(ids[:n], ids[n])) {
+			break
+		}
+
+		err = a.checkWrite(len(objs[n]))
+		if err != nil {
+			break
+		}
+		// checkWrite counts the objects already in the page against WithMaxRecords
+		a.records++
+		size += len(objs[n])
+	}
+	if n == 0 {
+		return 0, err
+	}
+
+	appendErr := pageAppender.AppendPage(ids[:n], objs[:n])
+	if appendErr != nil {
+		a.records -= n
+		a.releaseDiskSpace(size)
+		return 0, appendErr
+	}
+	return n, err
+}
+
+func containsID(ids []common.ID, id common.ID) bool {
+	for _, i := range ids {
+		if bytes.Equal(i, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// appended records the time of a write from the block's clock. The end time of meta is set to the same time so the
+// two agree.
+func (a *AppendBlock) appended() {
+	now := a.clock.Now()
+	a.meta.EndTime = now
+	if a.appendedStart.IsZero() {
+		a.appendedStart = now
+	}
+	a.appendedEnd = now
+}
+
+// AppendedStart returns the wall clock time of the first write to the block, regardless of the times of the objects
+// written. It is not stored in the file so it is zero for replayed blocks and blocks that have not been written to.
+func (a *AppendBlock) AppendedStart() time.Time {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	return a.appendedStart
+}
+
+// AppendedEnd returns the wall clock time of the last write to the block. It is zero when AppendedStart is.
+func (a *AppendBlock) AppendedEnd() time.Time {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	return a.appendedEnd
+}
+
+// Writable returns true if the block can be appended to. Blocks created by newAppendBlock or resumed with
+// ResumeAppendBlock are writable until they are sealed by GetIterator, closed or cleared. Replayed blocks can only be
+// read and completed, writes to them return ErrBlockNotWritable.
+func (a *AppendBlock) Writable() bool {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	return !a.cleared && !a.closed && a.appendFile != nil
+}
+
+// checkWrite returns the error Write returns for an object of size bytes, if any, before anything is appended
+func (a *AppendBlock) checkWrite(size int) error {
+	if a.closed {
+		return ErrBlockClosed
+	}
+	if a.appendFile == nil {
+		return ErrBlockNotWritable
+	}
+
+	if a.maxRecords > 0 && a.records >= a.maxRecords {
+		return ErrBlockFull
+	}
+
+	if a.maxAge > 0 && a.clock.Now().Sub(a.meta.StartTime) > a.maxAge {
+		return ErrBlockExpired
+	}
+
+	if a.maxObjectSize > 0 && size > a.maxObjectSize {
+		return ErrObjectTooLarge
+	}
+
+	if a.diskLowWatermark > 0 {
+		return a.checkDiskSpace(size)
+	}
+
+	return nil
+}
+
+// Import appends pre-framed data, such as a range of another block's data file, along with the records
+// indexing it. Record starts are relative to the beginning of data and record lengths are kept as is so
+// the rebuilt index exactly matches the source.
+func (a *AppendBlock) Import(records []common.Record, data []byte) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	importer, ok := a.appender.(encoding.RecordImporter)
+	if !ok || a.appendFile == nil {
+		return common.ErrUnsupported
+	}
+
+	if a.maxRecords > 0 && a.records+len(records) > a.maxRecords {
+		return ErrBlockFull
+	}
+
+	imported := make([]common.Record, 0, len(records))
+	for _, r := range records {
+		if r.Start+uint64(r.Length) > uint64(len(data)) {
+			return fmt.Errorf("record %v with start %d and length %d out of bounds of data %d", r.ID, r.Start, r.Length, len(data))
+		}
+
+		// make a copy so we don't hold onto the caller's buffer
+		r.ID = append([]byte(nil), r.ID...)
+		imported = append(imported, r)
+	}
+
+	_, err := a.appendWriter.Write(data)
+	if err != nil {
+		return err
+	}
+
+	importer.ImportRecords(imported, uint64(len(data)))
+	for _, r := range imported {
+		a.meta.ObjectAdded(r.ID)
+	}
+	if len(imported) > 0 {
+		a.appended()
+	}
+	a.index = nil
+	a.records += len(imported)
+	a.flushes.wrote(len(imported))
+
+	return nil
+}
+
+// Combine appends the objects of other, combined by id with combiner, to the block. Ids found in both blocks end up
+// with a record for each, which are combined by every read of the block like ids written more than once. The start
+// time of the block becomes the earlier of the two and its compaction level becomes at least one more than other's, so
+// a block consolidating others has the highest of their levels plus one. other is sealed like GetIterator does but not
+// cleared, that is left to the caller once the block is durable. Both blocks must have the same data encoding.
+func (a *AppendBlock) Combine(other *AppendBlock, combiner common.ObjectCombiner) error {
+	if other == a {
+		return errors.New("a block can not be combined with itself")
+	}
+	if a.DataEncoding() != other.DataEncoding() {
+		return fmt.Errorf("can not combine block %v with data encoding %q into block %v with data encoding %q",
+			other.BlockID(), other.DataEncoding(), a.BlockID(), a.DataEncoding())
+	}
+
+	iter, err := other.GetIterator(context.Background(), combiner)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for {
+		id, obj, err := iter.Next(context.Background())
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to iterate block %v: %w", other.BlockID(), err)
+		}
+		if id == nil {
+			break
+		}
+
+		err = a.Write(id, obj)
+		if err != nil {
+			return fmt.Errorf("failed to combine object %x of block %v: %w", id, other.BlockID(), err)
+		}
+	}
+
+	otherMeta := other.Meta()
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if otherMeta.StartTime.Before(a.meta.StartTime) {
+		a.meta.StartTime = otherMeta.StartTime
+	}
+	if otherMeta.CompactionLevel+1 > a.meta.CompactionLevel {
+		a.meta.CompactionLevel = otherMeta.CompactionLevel + 1
+		return a.writeCompactionLevel()
+	}
+	return nil
+}
+
+// EstimateWriteSize returns the number of bytes Write will add to the append file for an object of this
+// size with a 128 bit id. This includes the object and page framing. It is exact for uncompressed blocks.
+// Compression is content dependent so for other encodings it is the uncompressed size.
+func (a *AppendBlock) EstimateWriteSize(b []byte) int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.writeOverhead == 0 {
+		overhead, err := a.emptyPageLength()
+		if err != nil {
+			return len(b)
+		}
+		a.writeOverhead = overhead
+	}
+
+	return a.writeOverhead + len(b)
+}
+
+// emptyPageLength returns the length of an uncompressed page holding an empty object with a 128 bit id
+func (a *AppendBlock) emptyPageLength() (int, error) {
+	dataWriter, err := a.encoding.NewDataWriter(ioutil.Discard, backend.EncNone)
+	if err != nil {
+		return 0, err
+	}
+	defer dataWriter.Complete()
+
+	_, err = dataWriter.Write(make([]byte, 16), nil)
+	if err != nil {
+		return 0, err
+	}
+	length, err := dataWriter.CutPage()
+	if err != nil {
+		return 0, err
+	}
+
+	return length + a.footerLength(), nil
+}
+
+func (a *AppendBlock) BlockID() uuid.UUID {
+	return a.meta.BlockID
+}
+
+func (a *AppendBlock) DataLength() uint64 {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	return a.appender.DataLength()
+}
+
+// RecordCount returns the length of the block's appender. While the block is appended to an id written more than
+// once is counted once.
+func (a *AppendBlock) RecordCount() int {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	return a.appender.Length()
+}
+
+// DataEncoding returns the encoding of the objects in the block
+func (a *AppendBlock) DataEncoding() string {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	return a.meta.DataEncoding
+}
+
+// Full returns true once the block's data length reaches maxBytes or the number of ids in the block reaches
+// maxObjects. Callers use it to decide when to cut a new block. A limit of 0 is ignored.
+func (a *AppendBlock) Full(maxBytes uint64, maxObjects int) bool {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if maxBytes > 0 && a.appender.DataLength() >= maxBytes {
+		return true
+	}
+	return maxObjects > 0 && a.appender.Length() >= maxObjects
+}
+
+// Meta returns a copy of the block's meta
+func (a *AppendBlock) Meta() *backend.BlockMeta {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	meta := *a.meta
+	return &meta
+}
+
+// BlockStats is a consistent snapshot of an AppendBlock returned by Stats
+type BlockStats struct {
+	BlockID      uuid.UUID
+	Objects      int
+	DataLength   uint64
+	Encoding     backend.Encoding
+	DataEncoding string
+	// AppendedStart and AppendedEnd are the wall clock times of the first and last write to the block
+	AppendedStart time.Time
+	AppendedEnd   time.Time
+}
+
+// Stats returns a snapshot of the block taken under its lock so the fields are consistent with each other
+// while the block is written to. Objects and DataLength are those of RecordCount and DataLength.
+func (a *AppendBlock) Stats() BlockStats {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	return BlockStats{
+		BlockID:       a.meta.BlockID,
+		Objects:       a.appender.Length(),
+		DataLength:    a.appender.DataLength(),
+		Encoding:      a.meta.Encoding,
+		DataEncoding:  a.meta.DataEncoding,
+		AppendedStart: a.appendedStart,
+		AppendedEnd:   a.appendedEnd,
+	}
+}
+
+// WriteMetaSidecar writes the block meta as a meta.json in dir so that external tooling that expects
+// the backend block layout can inspect the block. The id bounds and object count are recomputed from the
+// records so they are also correct for replayed blocks. dir is expected to be dedicated to the block.
+func (a *AppendBlock) WriteMetaSidecar(dir string) error {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	meta := *a.meta
+
+	records := a.appender.Records()
+	meta.TotalObjects = len(records)
+	meta.MinID = []byte{}
+	meta.MaxID = []byte{}
+	for _, r := range records {
+		if len(meta.MinID) == 0 || bytes.Compare(r.ID, meta.MinID) == -1 {
+			meta.MinID = r.ID
+		}
+		if len(meta.MaxID) == 0 || bytes.Compare(r.ID, meta.MaxID) == 1 {
+			meta.MaxID = r.ID
+		}
+	}
+
+	bMeta, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, backend.MetaName), bMeta, a.fileMode)
+}
+
+// ReindexForSearch sorts the current records of the block into an in memory index that is used
+// by Find and GetIterator until the next Write. This allows a live block that is still being
+// appended to be searched the same way as a replayed block. It is O(n log n) in the number of records.
+func (a *AppendBlock) ReindexForSearch() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	if a.missingIndex() {
+		return ErrNoIndex
+	}
+
+	records := a.appender.Records()
+
+	index := make(common.Records, len(records))
+	copy(index, records)
+	common.SortRecords(index)
+
+	a.index = index
+	return nil
+}
+
+// IteratorDecorator wraps the iterator over a block's records, for instance to filter or sample objects. The records are
+// in id order and objects with the same id are not combined yet, the returned iterator must keep them in id order.
+type IteratorDecorator func(encoding.Iterator) encoding.Iterator
+
+// GetIterator returns an iterator over every object in the block and prevents further appends. Next returns ctx's
+// error once it is done, regardless of the context passed to Next. Use GetSnapshotIterator to read the block and keep
+// appending to it. decorators are applied in order to the records before objects with the same id are combined.
+func (a *AppendBlock) GetIterator(ctx context.Context, combiner common.ObjectCombiner, decorators ...IteratorDecorator) (encoding.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	iterator, combiner, err := a.sealedRecordIterator(combiner, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, decorate := range decorators {
+		iterator = decorate(iterator)
+	}
+
+	iterator, err = encoding.NewDedupingIterator(iterator, combiner, a.meta.DataEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contextIterator{Iterator: iterator, ctx: ctx}, nil
+}
+
+// GetIteratorWithReadAhead is GetIterator but reads up to pageBufferSize pages ahead of the caller in a background
+// goroutine. This helps blocks with many small objects on slow disks. The goroutine exits on Close, when ctx is
+// done or when the block has been read.
+func (a *AppendBlock) GetIteratorWithReadAhead(ctx context.Context, combiner common.ObjectCombiner, pageBufferSize int) (encoding.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	iterator, combiner, err := a.sealedRecordIterator(combiner, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// wal pages hold a single object so buffering objects reads ahead by pages
+	iterator = encoding.NewPrefetchIterator(ctx, &copyingIterator{Iterator: iterator}, pageBufferSize)
+	iterator, err = encoding.NewDedupingIterator(iterator, combiner, a.meta.DataEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contextIterator{Iterator: iterator, ctx: ctx}, nil
+}
+
+// GetAppendOrderIterator is GetIterator but returns objects in the order they were appended instead of id order,
+// for replayed blocks as well. Only consecutive objects with the same id are combined.
+func (a *AppendBlock) GetAppendOrderIterator(combiner common.ObjectCombiner) (encoding.Iterator, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	iterator, combiner, err := a.sealedRecordIterator(combiner, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return encoding.NewDedupingIterator(iterator, combiner, a.meta.DataEncoding)
+}
+
+// GetRawIterator is GetIterator without combining the objects of an id, every object appended is returned in id order
+// so duplicates can be counted. Like GetIterator it prevents further appends to the block.
+func (a *AppendBlock) GetRawIterator(ctx context.Context) (encoding.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	iterator, _, err := a.sealedRecordIterator(nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contextIterator{Iterator: iterator, ctx: ctx}, nil
+}
+
+// GetSnapshotIterator is GetIterator but the block can still be appended to. It iterates the objects appended before
+// it was called, later writes are not returned. Blocks created WithoutIndex return ErrNoIndex.
+func (a *AppendBlock) GetSnapshotIterator(ctx context.Context, combiner common.ObjectCombiner) (encoding.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	if a.missingIndex() {
+		return nil, ErrNoIndex
+	}
+	if a.appender.Length() == 0 {
+		return emptyIterator{}, nil
+	}
+
+	// the index and the appender's records are not modified by later writes
+	records := []common.Record(a.index)
+	if records == nil {
+		records = a.appender.Records()
+	}
+
+	iterator, combiner, err := a.recordIterator(records, combiner)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err = encoding.NewDedupingIterator(iterator, combiner, a.meta.DataEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contextIterator{Iterator: iterator, ctx: ctx}, nil
+}
+
+// copyingIterator copies ids and objects so they can be held after the next call to Next
+type copyingIterator struct {
+	encoding.Iterator
+}
+
+func (i *copyingIterator) Next(ctx context.Context) (common.ID, []byte, error) {
+	id, obj, err := i.Iterator.Next(ctx)
+	if id != nil {
+		id = append(common.ID(nil), id...)
+		obj = append([]byte(nil), obj...)
+	}
+	return id, obj, err
+}
+
+// contextIterator stops iterating once ctx is done
+type contextIterator struct {
+	encoding.Iterator
+	ctx context.Context
+}
+
+func (i *contextIterator) Next(ctx context.Context) (common.ID, []byte, error) {
+	if err := i.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return i.Iterator.Next(ctx)
+}
+
+// sealedRecordIterator prevents further appends to the block and returns an iterator over every record in id order,
+// or append order if appendOrder is set, without combining them, along with the combiner to use. The combiner may
+// be nil.
+func (a *AppendBlock) sealedRecordIterator(combiner common.ObjectCombiner, appendOrder bool) (encoding.Iterator, common.ObjectCombiner, error) {
+	err := a.seal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// skip opening the file for empty blocks
+	if a.appender.Length() == 0 {
+		return emptyIterator{}, combiner, nil
+	}
+
+	err = a.rebuildIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := []common.Record(a.index)
+	if records == nil {
+		records = a.appender.Records()
+	}
+	if appendOrder {
+		// record starts are file offsets
+		records = append([]common.Record(nil), records...)
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].Start < records[j].Start
+		})
+	}
+	readFile, err := a.file()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// replayed blocks do not track their data length
+	if dataLength := a.appender.DataLength(); dataLength > 0 {
+		info, err := readFile.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint64(info.Size()) < dataLength {
+			level.Warn(a.logger).Log("msg", "wal file is shorter than its data", "block", a.meta.BlockID, "size", info.Size(), "dataLength", dataLength)
+			return nil, nil, &ErrWALSizeMismatch{FileSize: info.Size(), DataLength: dataLength}
+		}
+	}
+
+	return a.recordIterator(records, combiner)
+}
+
+// recordIterator returns an iterator over records, which must be sorted, without combining them along with the
+// combiner to use
+func (a *AppendBlock) recordIterator(records []common.Record, combiner common.ObjectCombiner) (encoding.Iterator, common.ObjectCombiner, error) {
+	readFile, err := a.file()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataReader, err := a.newDataReader(readFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataReader, objectRW, combiner := a.instrumentRead(dataReader, a.encoding.NewObjectReaderWriter(), combiner)
+	return newRecordObjectIterator(records, dataReader, objectRW), combiner, nil
+}
+
+// GetIteratorForIDs returns an iterator over the combined objects for the passed ids in id order. Only the pages
+// holding these ids are read. Unlike GetIterator this does not prevent further appends to the block.
+func (a *AppendBlock) GetIteratorForIDs(ids []common.ID, combiner common.ObjectCombiner) (encoding.Iterator, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	if a.missingIndex() {
+		return nil, ErrNoIndex
+	}
+
+	sortedIDs := append([]common.ID(nil), ids...)
+	sort.Slice(sortedIDs, func(i, j int) bool {
+		return bytes.Compare(sortedIDs[i], sortedIDs[j]) == -1
+	})
+
+	var records []common.Record
+	for i, id := range sortedIDs {
+		if i > 0 && bytes.Equal(sortedIDs[i-1], id) {
+			continue
+		}
+
+		idRecords := append([]common.Record(nil), a.recordsForID(id)...)
+		sort.Slice(idRecords, func(i, j int) bool {
+			return idRecords[i].Start < idRecords[j].Start
+		})
+		records = append(records, idRecords...)
+	}
+
+	readFile, err := a.file()
+	if err != nil {
+		return nil, err
+	}
+
+	dataReader, err := a.newDataReader(readFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dataReader, objectRW, combiner := a.instrumentRead(dataReader, a.encoding.NewObjectReaderWriter(), combiner)
+	iterator := newRecordObjectIterator(records, dataReader, objectRW)
+	return encoding.NewDedupingIterator(iterator, combiner, a.meta.DataEncoding)
+}
+
+func (a *AppendBlock) Find(ctx context.Context, id common.ID, combiner common.ObjectCombiner) ([]byte, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	records, err := a.findRecords(id)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	index := common.Records(records)
+
+	var dataReader common.DataReader
+	if mapped := a.mappedFile(); mapped != nil {
+		dataReader, err = a.newContextDataReader(backend.NewContextReaderWithAllReader(bytes.NewReader(mapped)))
+	} else {
+		var file *os.File
+		file, err = a.file()
+		if err != nil {
+			return nil, err
+		}
+		dataReader, err = a.newDataReader(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dataReader.Close()
+	dataReader, objectRW, combiner := a.instrumentRead(dataReader, a.encoding.NewObjectReaderWriter(), combiner)
+	finder := encoding.NewPagedFinder(index, dataReader, combiner, objectRW, a.meta.DataEncoding)
+
+	return finder.Find(ctx, id)
+}
+
+// Contains returns true if an object for id has been appended to the block. Only the index is consulted so
+// negative lookups never open the file. Returns false for blocks created WithoutIndex until the index is rebuilt.
+func (a *AppendBlock) Contains(id common.ID) bool {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.missingIndex() {
+		return false
+	}
+
+	for _, r := range a.recordsForID(id) {
+		if bytes.Equal(r.ID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindAll returns every object stored for id in the order they were appended without combining them. It is
+// intended for debugging combiners and ignores the limit configured with WithMaxRecordsPerID.
+func (a *AppendBlock) FindAll(id common.ID) ([][]byte, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	if a.missingIndex() {
+		return nil, ErrNoIndex
+	}
+
+	var records []common.Record
+	for _, r := range a.recordsForID(id) {
+		if bytes.Equal(r.ID, id) {
+			records = append(records, r)
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Start < records[j].Start
+	})
+
+	file, err := a.file()
+	if err != nil {
+		return nil, err
+	}
+
+	dataReader, err := a.newDataReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer dataReader.Close()
+	dataReader, objectRW, _ := a.instrumentRead(dataReader, a.encoding.NewObjectReaderWriter(), nil)
+
+	objs := make([][]byte, 0, len(records))
+	var pages [][]byte
+	var buffer []byte
+	for _, r := range records {
+		var obj []byte
+		obj, pages, buffer, err = readRecordObject(context.Background(), dataReader, objectRW, r, pages, buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
+
+// findRecords returns the records Find combines for the id. It applies the limit configured with WithMaxRecordsPerID.
+func (a *AppendBlock) findRecords(id common.ID) ([]common.Record, error) {
+	if a.missingIndex() {
+		return nil, ErrNoIndex
+	}
+
+	records := a.recordsForID(id)
+	if a.maxRecordsPerID > 0 && len(records) > a.maxRecordsPerID {
+		// keep the most recently appended records
+		records = append([]common.Record(nil), records...)
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].Start < records[j].Start
+		})
+		level.Warn(a.logger).Log("msg", "records for id exceeded limit. combining most recent records only", "block", a.meta.BlockID,
+			"id", hex.EncodeToString(id), "records", len(records), "limit", a.maxRecordsPerID)
+		records = records[len(records)-a.maxRecordsPerID:]
+	}
+
+	return records, nil
+}
+
+// missingIndex returns true if the block was created WithoutIndex and its index has not been rebuilt
+func (a *AppendBlock) missingIndex() bool {
+	_, ok := a.appender.(*indexlessAppender)
+	return ok
+}
+
+// rebuildIndex replays the append file of a block created WithoutIndex to rebuild its records. The block can
+// not be appended to afterwards.
+func (a *AppendBlock) rebuildIndex() error {
+	if !a.missingIndex() {
+		return nil
+	}
+
+	file, err := a.file()
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Base(a.fullFilename())
+	records, warning, err := a.replay(file, filename)
+	if err != nil {
+		return err
+	}
+	if warning != nil {
+		return fmt.Errorf("error rebuilding index for %s: %w", filename, warning)
+	}
+
+	common.SortRecords(records)
+	a.appender = encoding.NewRecordAppender(records)
+	return nil
+}
+
+// recordsForID returns the records for the id from the index built by ReindexForSearch if present or the appender
+func (a *AppendBlock) recordsForID(id common.ID) []common.Record {
+	if a.index == nil {
+		return a.appender.RecordsForID(id)
+	}
+
+	_, i, _ := a.index.Find(context.Background(), id)
+	if i < 0 {
+		return nil
+	}
+
+	var records []common.Record
+	for ; i < len(a.index) && bytes.Equal(a.index[i].ID, id); i++ {
+		records = append(records, a.index[i])
+	}
+	return records
+}
+
+// ReadObjectRange finds the object for the given id, combining it if necessary, and returns the
+// length bytes starting at off. The returned slice is a copy so the full object is not retained.
+// Returns nil if the id is not present in the block.
+func (a *AppendBlock) ReadObjectRange(id common.ID, off, length int, combiner common.ObjectCombiner) ([]byte, error) {
+	if off < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range off=%d length=%d", off, length)
+	}
+
+	obj, err := a.Find(context.Background(), id, combiner)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, nil
+	}
+
+	if off+length > len(obj) {
+		return nil, fmt.Errorf("range off=%d length=%d out of bounds for object of length %d", off, length, len(obj))
+	}
+
+	return append([]byte(nil), obj[off:off+length]...), nil
+}
+
+// ReadAt returns the object in the page at offset of length bytes, as returned by WriteAt, without consulting the
+// block's index so it also works for blocks created WithoutIndex. An *ErrPageOffset is returned if no page of that
+// length begins at offset. Pages holding several objects, written by WriteBatch WithBatchedPages, can not be read.
+func (a *AppendBlock) ReadAt(offset uint64, length uint64) ([]byte, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	file, err := a.file()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if length < pageLengthSize || length > math.MaxUint32 || offset+length > uint64(info.Size()) {
+		return nil, &ErrPageOffset{Offset: offset, Length: length}
+	}
+
+	// the page begins with its length, excluding the footer
+	pageLength := make([]byte, pageLengthSize)
+	_, err = file.ReadAt(pageLength, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(binary.LittleEndian.Uint32(pageLength))+uint64(a.footerLength()) != length {
+		return nil, &ErrPageOffset{Offset: offset, Length: length}
+	}
+
+	dataReader, err := a.newDataReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer dataReader.Close()
+
+	pages, _, err := dataReader.Read(context.Background(), []common.Record{{Start: offset, Length: uint32(length)}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) != 1 {
+		return nil, &ErrPageOffset{Offset: offset, Length: length}
+	}
+
+	rest, _, obj, err := a.encoding.NewObjectReaderWriter().UnmarshalAndAdvanceBuffer(pages[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, ErrMultiObjectPage
+	}
+
+	return append([]byte(nil), obj...), nil
+}
+
+// ReadAll iterates the block and returns every combined object keyed by the hex encoded id. It is
+// intended for tests and small blocks and returns ErrReadAllLimitExceeded if the block holds more
+// objects than configured with WithReadAllMaxObjects. Like GetIterator, the block can not be appended
+// to afterwards.
+func (a *AppendBlock) ReadAll(combiner common.ObjectCombiner) (map[string][]byte, error) {
+	iter, err := a.GetIterator(context.Background(), combiner)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	objs := map[string][]byte{}
+	for {
+		id, obj, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if id == nil {
+			break
+		}
+
+		if len(objs) >= a.readAllMaxObjects {
+			return nil, ErrReadAllLimitExceeded
+		}
+		objs[hex.EncodeToString(id)] = obj
+	}
+
+	return objs, nil
+}
+
+// Fingerprint returns a digest of the block's ids and objects to tell whether two blocks hold the same data. Objects
+// are folded into the hash in id order, and objects with the same id in byte order, so the digest does not depend on
+// the order they were appended or on the block's encoding and is identical for a live block and the same block after
+// replay. Objects with the same id are not combined. Returns ErrNoIndex for blocks without an index.
+func (a *AppendBlock) Fingerprint() ([]byte, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	if a.missingIndex() {
+		return nil, ErrNoIndex
+	}
+
+	h := xxhash.New()
+	records := append([]common.Record(nil), a.appender.Records()...)
+	common.SortRecords(records)
+	if len(records) == 0 {
+		return h.Sum(nil), nil
+	}
+
+	file, err := a.file()
+	if err != nil {
+		return nil, err
+	}
+
+	dataReader, err := a.newDataReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer dataReader.Close()
+
+	objectRW := a.encoding.NewObjectReaderWriter()
+	var pages [][]byte
+	var buffer []byte
+	var objs [][]byte
+	length := make([]byte, 4)
+	for i := 0; i < len(records); {
+		id := records[i].ID
 
-	appendFile *os.File
-	appender   encoding.Appender
+		objs = objs[:0]
+		for ; i < len(records) && bytes.Equal(records[i].ID, id); i++ {
+			var obj []byte
+			obj, pages, buffer, err = readRecordObject(context.Background(), dataReader, objectRW, records[i], pages, buffer)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, obj)
+		}
+		sort.Slice(objs, func(i, j int) bool {
+			return bytes.Compare(objs[i], objs[j]) < 0
+		})
 
-	filepath string
-	readFile *os.File
-	once     sync.Once
+		// lengths keep the boundaries between ids and objects part of the digest
+		for _, obj := range objs {
+			binary.LittleEndian.PutUint32(length, uint32(len(id)))
+			_, _ = h.Write(length)
+			_, _ = h.Write(id)
+			binary.LittleEndian.PutUint32(length, uint32(len(obj)))
+			_, _ = h.Write(length)
+			_, _ = h.Write(obj)
+		}
+	}
+
+	return h.Sum(nil), nil
 }
 
-func newAppendBlock(id uuid.UUID, tenantID string, filepath string, e backend.Encoding, dataEncoding string) (*AppendBlock, error) {
-	if strings.ContainsRune(dataEncoding, ':') ||
-		len([]rune(dataEncoding)) > maxDataEncodingLength {
-		return nil, fmt.Errorf("dataEncoding %s is invalid", dataEncoding)
+// LargeRecords returns the records whose length exceeds minBytes in id order. Only the index is consulted,
+// objects are not read or decoded. A record's length is the length of the page holding the object.
+func (a *AppendBlock) LargeRecords(minBytes uint32) []common.Record {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	var large []common.Record
+	for _, r := range a.appender.Records() {
+		if r.Length > minBytes {
+			large = append(large, r)
+		}
 	}
 
-	v, err := encoding.FromVersion("v2") // let's pin wal files instead of tracking latest for safety
-	if err != nil {
-		return nil, err
+	return large
+}
+
+// MissingFrom returns the ids in other that are not present in this block in id order. It walks the sorted
+// records of both blocks and does not read any objects. Used to find what needs to be copied to repair a block
+// from its source.
+func (a *AppendBlock) MissingFrom(other *AppendBlock) ([]common.ID, error) {
+	// take the records one block at a time to avoid holding both locks
+	a.mtx.RLock()
+	local, cleared := a.appender.Records(), a.cleared
+	a.mtx.RUnlock()
+
+	other.mtx.RLock()
+	source, otherCleared := other.appender.Records(), other.cleared
+	other.mtx.RUnlock()
+
+	if cleared || otherCleared {
+		return nil, ErrBlockCleared
 	}
 
-	h := &AppendBlock{
-		encoding: v,
-		meta:     backend.NewBlockMeta(tenantID, id, v.Version(), e, dataEncoding),
-		filepath: filepath,
+	var missing []common.ID
+	i := 0
+	for j, r := range source {
+		if j > 0 && bytes.Equal(source[j-1].ID, r.ID) {
+			continue
+		}
+
+		for i < len(local) && bytes.Compare(local[i].ID, r.ID) < 0 {
+			i++
+		}
+		if i < len(local) && bytes.Equal(local[i].ID, r.ID) {
+			continue
+		}
+
+		missing = append(missing, r.ID)
 	}
 
-	name := h.fullFilename()
+	return missing, nil
+}
+
+// QuickHealth is a cheap check that the block's file is present and consistent with the data appended to
+// it. It does not read the file. Use it for readiness style probes instead of a full verification.
+func (a *AppendBlock) QuickHealth() (bool, string) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
 
-	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	info, err := os.Stat(a.fullFilename())
 	if err != nil {
-		return nil, err
+		return false, fmt.Sprintf("unable to stat file: %v", err)
 	}
-	h.appendFile = f
 
-	dataWriter, err := h.encoding.NewDataWriter(f, e)
-	if err != nil {
-		return nil, err
+	if a.appender.Length() > 0 && info.Size() == 0 {
+		return false, "file is empty but block has records"
 	}
 
-	h.appender = encoding.NewAppender(dataWriter)
+	if uint64(info.Size()) < a.appender.DataLength() {
+		return false, fmt.Sprintf("file size %d is smaller than data length %d", info.Size(), a.appender.DataLength())
+	}
 
-	return h, nil
+	return true, ""
 }
 
-// newAppendBlockFromFile returns an AppendBlock that can not be appended to, but can
-// be completed. It can return a warning or a fatal error
-func newAppendBlockFromFile(filename string, path string) (*AppendBlock, error, error) {
-	var warning error
-	blockID, tenantID, version, e, dataEncoding, err := parseFilename(filename)
+// Close completes the appender, syncs the block's files and closes them, leaving the files on disk to be replayed later.
+// Use it instead of Clear on shutdown to keep the wal. Afterwards the block can still be read, which reopens its file,
+// but writes return ErrBlockClosed. Calling Close again does nothing.
+func (a *AppendBlock) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+	if a.closed {
+		return nil
+	}
+
+	err := a.appender.Complete()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	v, err := encoding.FromVersion(version)
+	err = a.syncAppendFiles()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	b := &AppendBlock{
-		meta:     backend.NewBlockMeta(tenantID, blockID, version, e, dataEncoding),
-		filepath: path,
-		encoding: v,
+	if a.appendFile != nil {
+		err = a.appendFile.Close()
+		if err != nil {
+			return err
+		}
+		a.appendFile = nil
+	}
+	if a.mirrorFile != nil {
+		err = a.mirrorFile.Close()
+		if err != nil {
+			return err
+		}
+		a.mirrorFile = nil
 	}
+	a.closeCheckpointFile()
+	a.closeReadFile()
+	a.closed = true
 
-	// replay file to extract records
-	f, err := b.file()
-	if err != nil {
-		return nil, nil, err
+	return nil
+}
+
+// seal syncs and closes the append and mirror files so the block can not be appended to. The files are closed even if
+// syncing them fails.
+func (a *AppendBlock) seal() error {
+	err := a.syncAppendFiles()
+
+	if a.appendFile != nil {
+		if closeErr := a.appendFile.Close(); err == nil {
+			err = closeErr
+		}
+		a.appendFile = nil
+	}
+	if a.mirrorFile != nil {
+		if closeErr := a.mirrorFile.Close(); err == nil {
+			err = closeErr
+		}
+		a.mirrorFile = nil
+	}
+	a.closeCheckpointFile()
+
+	return err
+}
+
+// syncAppendFiles syncs the append file, and the mirror file if configured, before they are closed so every write is
+// durable once the block can no longer be flushed, and reports the writes as flushed to WaitFlushed
+func (a *AppendBlock) syncAppendFiles() error {
+	a.flushes.mtx.Lock()
+	seq := a.flushes.written
+	a.flushes.mtx.Unlock()
+
+	var err error
+	if a.appendFile != nil {
+		err = a.appendFile.Sync()
+		if err == nil && a.mirrorFile != nil {
+			err = a.mirrorFile.Sync()
+		}
+	}
+
+	a.flushes.done(seq, err)
+	return err
+}
+
+// Clear closes the block's files and removes them from disk. Removes are retried a few times before Clear gives
+// up and returns an *ErrClear for the first file that could not be removed, the other files are still removed.
+// Afterwards the block's methods return ErrBlockCleared and calling Clear again does nothing.
+func (a *AppendBlock) Clear() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return nil
+	}
+	a.cleared = true
+
+	a.closeReadFile()
+	a.closeCheckpointFile()
+
+	if a.appendFile != nil {
+		_ = a.appendFile.Close()
+		a.appendFile = nil
+	}
+
+	if a.mirrorFile != nil {
+		_ = a.mirrorFile.Close()
+		a.mirrorFile = nil
 	}
 
-	dataReader, err := b.encoding.NewDataReader(backend.NewContextReaderWithAllReader(f), b.meta.Encoding)
+	// release anyone waiting on a flush that will never happen
+	a.flushes.done(0, ErrBlockCleared)
+
+	// don't fail on this error, it's important to remove the file above all else
+	err := a.appender.Complete()
 	if err != nil {
-		return nil, nil, err
+		level.Warn(a.logger).Log("msg", "failed to complete appender while clearing block", "block", a.meta.BlockID, "err", err)
 	}
-	defer dataReader.Close()
+	// the block's objects are gone, drop the index with them
+	a.appender = encoding.NewRecordAppender(nil)
+	a.index = nil
 
-	var buffer []byte
-	var records []common.Record
-	objectReader := b.encoding.NewObjectReaderWriter()
-	currentOffset := uint64(0)
-	for {
-		buffer, pageLen, err := dataReader.NextPage(buffer)
-		if err == io.EOF {
-			break
+	// every file is removed even if an earlier remove failed, starting with the wal file so a failure elsewhere can
+	// not leave it orphaned. The first error is returned.
+	names := []string{a.fullFilename(), a.checkpointFilename(), a.compactionLevelFilename()}
+	if a.mirrorPath != "" {
+		names = append(names, a.mirrorFilename())
+	}
+
+	var firstErr error
+	for _, name := range names {
+		err = a.remove(name)
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
-		if err != nil {
-			warning = err
-			break
+	}
+	return firstErr
+}
+
+// remove removes one of the block's files with removeWithRetry and logs failures
+func (a *AppendBlock) remove(name string) error {
+	err := removeWithRetry(name)
+	if clearErr, ok := err.(*ErrClear); ok {
+		level.Error(a.logger).Log("msg", "failed to remove wal file", "block", a.meta.BlockID, "file", name, "exists", clearErr.Exists, "err", clearErr.Err)
+	}
+	return err
+}
+
+// removeWithRetry removes name, retrying with a short backoff because some filesystems refuse to remove a file
+// that is briefly held open elsewhere. A file that does not exist is not an error.
+func removeWithRetry(name string) error {
+	var err error
+	backoff := clearRemoveBackoff
+	for attempt := 0; attempt < clearRemoveAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
 		}
 
-		reader := bytes.NewReader(buffer)
-		id, _, err := objectReader.UnmarshalObjectFromReader(reader)
-		if err != nil {
-			warning = err
-			break
+		err = removeFile(name)
+		if err == nil || os.IsNotExist(err) {
+			return nil
 		}
-		// wal should only ever have one object per page, test that here
-		_, _, err = objectReader.UnmarshalObjectFromReader(reader)
-		if err != io.EOF {
-			warning = err
-			break
+	}
+
+	_, statErr := os.Stat(name)
+	return &ErrClear{
+		Filename: name,
+		Exists:   !os.IsNotExist(statErr),
+		Err:      err,
+	}
+}
+
+// Reset empties the block so it can be reused for new objects without creating a new file. The append file is
+// truncated and kept open, or reopened if the block was sealed by GetIterator, closed or replayed. The block keeps its
+// id.
+func (a *AppendBlock) Reset() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	// the next read reopens the file
+	a.closeReadFile()
+
+	a.closeCheckpointFile()
+	err := os.Remove(a.checkpointFilename())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	a.checkpointedLength = 0
+
+	_ = a.appender.Complete()
+
+	if a.appendFile != nil {
+		err = a.appendFile.Truncate(0)
+		if err == nil && a.mirrorFile != nil {
+			err = a.mirrorFile.Truncate(0)
+		}
+	} else {
+		if a.mirrorFile != nil {
+			_ = a.mirrorFile.Close()
+			a.mirrorFile = nil
 		}
+		err = a.openAppendFile()
+	}
+	if err != nil {
+		return err
+	}
 
-		// make a copy so we don't hold onto the iterator buffer
-		recordID := append([]byte(nil), id...)
-		records = append(records, common.Record{
-			ID:     recordID,
-			Start:  currentOffset,
-			Length: pageLen,
-		})
-		currentOffset += uint64(pageLen)
+	err = a.newAppender()
+	if err != nil {
+		return err
 	}
 
-	common.SortRecords(records)
+	meta := backend.NewBlockMeta(a.meta.TenantID, a.meta.BlockID, a.meta.Version, a.meta.Encoding, a.meta.DataEncoding)
+	meta.CompactionLevel = a.meta.CompactionLevel
+	meta.StartTime = a.clock.Now()
+	meta.EndTime = meta.StartTime
+	a.meta = meta
+	a.index = nil
+	a.records = 0
+	a.replayResult = ReplayResult{}
+	a.appendedStart = time.Time{}
+	a.appendedEnd = time.Time{}
+	a.closed = false
 
-	b.appender = encoding.NewRecordAppender(records)
-	b.meta.TotalObjects = b.appender.Length()
+	return nil
+}
 
-	return b, warning, nil
+// emptyIterator is returned by GetIterator for blocks with no records
+type emptyIterator struct{}
+
+func (emptyIterator) Next(context.Context) (common.ID, []byte, error) {
+	return nil, nil, io.EOF
 }
 
-func (a *AppendBlock) Write(id common.ID, b []byte) error {
-	err := a.appender.Append(id, b)
+func (emptyIterator) Close() {}
+
+func (a *AppendBlock) fullFilename() string {
+	if a.meta.Version == legacyVersion {
+		return filepath.Join(a.blockDir(a.filepath), fmt.Sprintf("%v:%v", a.meta.BlockID, a.meta.TenantID))
+	}
+
+	encodingString := a.meta.Encoding.String()
+	if a.codec != "" {
+		encodingString = customEncodingPrefix + a.codec
+	}
+
+	var filename string
+	if a.meta.DataEncoding == "" {
+		filename = fmt.Sprintf("%v:%v:%v:%v", a.meta.BlockID, a.meta.TenantID, a.meta.Version, encodingString)
+	} else {
+		filename = fmt.Sprintf("%v:%v:%v:%v:%v", a.meta.BlockID, a.meta.TenantID, a.meta.Version, encodingString, a.meta.DataEncoding)
+	}
+
+	return filepath.Join(a.blockDir(a.filepath), filename)
+}
+
+// blockDir returns the folder in path that holds the block's file, which is path itself unless the block uses
+// WithTenantDirs
+func (a *AppendBlock) blockDir(path string) string {
+	if !a.tenantDirs {
+		return path
+	}
+	return filepath.Join(path, a.meta.TenantID)
+}
+
+// makeTenantDirs creates the tenant folders a block using WithTenantDirs is written to
+func (a *AppendBlock) makeTenantDirs() error {
+	tenantID := a.meta.TenantID
+	if tenantID == "" || tenantID == "." || tenantID == ".." || filepath.Base(tenantID) != tenantID || reservedDir(tenantID) {
+		return fmt.Errorf("tenant %s can not be used as a folder name", tenantID)
+	}
+
+	err := os.MkdirAll(a.blockDir(a.filepath), os.ModePerm)
 	if err != nil {
 		return err
 	}
-	a.meta.ObjectAdded(id)
+	if a.mirrorPath != "" {
+		return os.MkdirAll(a.blockDir(a.mirrorPath), os.ModePerm)
+	}
 	return nil
 }
 
-func (a *AppendBlock) BlockID() uuid.UUID {
-	return a.meta.BlockID
-}
+// createTemp creates a new temporary file in the directory configured with WithTempDir or the block's path
+// if none is configured. The caller is responsible for removing the file.
+func (a *AppendBlock) createTemp(pattern string) (*os.File, error) {
+	dir := a.tempDir
+	if dir == "" {
+		dir = a.filepath
+	}
 
-func (a *AppendBlock) DataLength() uint64 {
-	return a.appender.DataLength()
+	return ioutil.TempFile(dir, pattern)
 }
 
-func (a *AppendBlock) Meta() *backend.BlockMeta {
-	return a.meta
+// mirrorFilename returns the name of the mirror file. It is only meaningful if mirrorPath is set
+func (a *AppendBlock) mirrorFilename() string {
+	return filepath.Join(a.blockDir(a.mirrorPath), filepath.Base(a.fullFilename()))
 }
 
-func (a *AppendBlock) GetIterator(combiner common.ObjectCombiner) (encoding.Iterator, error) {
-	if a.appendFile != nil {
-		err := a.appendFile.Close()
+func (a *AppendBlock) newDataWriter(w io.Writer) (common.DataWriter, error) {
+	// with checksums every page byte also goes through crc
+	pageWriter := w
+	var crc hash.Hash32
+	if a.pageChecksums {
+		crc = crc32.NewIEEE()
+		pageWriter = io.MultiWriter(w, crc)
+	}
+
+	var dataWriter common.DataWriter
+	var err error
+	if a.codec != "" {
+		var codec Codec
+		codec, err = getCodec(a.codec)
 		if err != nil {
 			return nil, err
 		}
-		a.appendFile = nil
+		dataWriter, err = v2.NewDataWriterWithPool(pageWriter, &codecPool{codec: codec})
+	} else {
+		dataWriter, err = a.encoding.NewDataWriter(pageWriter, a.meta.Encoding)
 	}
-
-	records := a.appender.Records()
-	readFile, err := a.file()
 	if err != nil {
 		return nil, err
 	}
 
-	dataReader, err := a.encoding.NewDataReader(backend.NewContextReaderWithAllReader(readFile), a.meta.Encoding)
-	if err != nil {
-		return nil, err
+	if a.pageFooters {
+		dataWriter = newFooterDataWriter(dataWriter, w, crc)
 	}
+	return dataWriter, nil
+}
 
-	iterator := encoding.NewRecordIterator(records, dataReader, a.encoding.NewObjectReaderWriter())
-	iterator, err = encoding.NewDedupingIterator(iterator, combiner, a.meta.DataEncoding)
+func (a *AppendBlock) newDataReader(f *os.File) (common.DataReader, error) {
+	return a.newContextDataReader(backend.NewContextReaderWithAllReader(f))
+}
+
+func (a *AppendBlock) newContextDataReader(r backend.ContextReader) (common.DataReader, error) {
+	var dataReader common.DataReader
+	var err error
+	if a.codec != "" {
+		var codec Codec
+		codec, err = getCodec(a.codec)
+		if err != nil {
+			return nil, err
+		}
+		dataReader = v2.NewDataReaderWithPool(r, &codecPool{codec: codec})
+	} else {
+		dataReader, err = a.encoding.NewDataReader(r, a.meta.Encoding)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return iterator, nil
+	if a.pageFooters {
+		dataReader = newFooterDataReader(dataReader, r, a.pageChecksums)
+	}
+	return dataReader, nil
 }
 
-func (a *AppendBlock) Find(id common.ID, combiner common.ObjectCombiner) ([]byte, error) {
-	records := a.appender.RecordsForID(id)
+// mappedFile returns the block's file mapped into memory if the block was created WithMmap and can not be appended
+// to. Returns nil if the file can not be mapped, then it is read instead.
+func (a *AppendBlock) mappedFile() []byte {
+	a.mmapMtx.Lock()
+	defer a.mmapMtx.Unlock()
+
+	if a.mapped != nil || !a.mmap || a.mmapFailed || a.appendFile != nil {
+		return a.mapped
+	}
+
 	file, err := a.file()
 	if err != nil {
-		return nil, err
-	}
-	if len(records) == 0 {
-		return nil, nil
+		return nil
 	}
 
-	dataReader, err := a.encoding.NewDataReader(backend.NewContextReaderWithAllReader(file), a.meta.Encoding)
+	a.mapped, err = mmapFile(file)
 	if err != nil {
-		return nil, err
+		level.Debug(a.logger).Log("msg", "failed to mmap wal file. reading it instead", "file", file.Name(), "err", err)
+		a.mapped = nil
+		a.mmapFailed = true
 	}
-	defer dataReader.Close()
-	finder := encoding.NewPagedFinder(common.Records(records), dataReader, combiner, a.encoding.NewObjectReaderWriter(), a.meta.DataEncoding)
+	return a.mapped
+}
 
-	return finder.Find(context.Background(), id)
+// unmapFile unmaps the block's file. It requires the write lock so no Find is using the mapping.
+func (a *AppendBlock) unmapFile() {
+	if a.mapped != nil {
+		_ = munmapFile(a.mapped)
+		a.mapped = nil
+	}
+	a.mmapFailed = false
 }
 
-func (a *AppendBlock) Clear() error {
+// closeReadFile closes the file opened by file() and releases its slot
+func (a *AppendBlock) closeReadFile() {
+	a.unmapFile()
 	if a.readFile != nil {
 		_ = a.readFile.Close()
 		a.readFile = nil
 	}
-
-	if a.appendFile != nil {
-		_ = a.appendFile.Close()
-		a.appendFile = nil
+	for _, f := range a.swappedReadFiles {
+		_ = f.Close()
 	}
+	a.swappedReadFiles = nil
 
-	// ignore error, it's important to remove the file above all else
-	_ = a.appender.Complete()
-
-	name := a.fullFilename()
-	return os.Remove(name)
+	releaseReadFileSlot(a.readFileSlot)
+	a.readFileSlot = nil
 }
 
-func (a *AppendBlock) fullFilename() string {
-	if a.meta.Version == "v0" {
-		return filepath.Join(a.filepath, fmt.Sprintf("%v:%v", a.meta.BlockID, a.meta.TenantID))
+// Open opens the file the block's reads are served from ahead of a burst of Finds so the first one does not pay for
+// it. By default the file is opened by the first read and kept open until the block is closed or cleared.
+func (a *AppendBlock) Open() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
 	}
 
-	var filename string
-	if a.meta.DataEncoding == "" {
-		filename = fmt.Sprintf("%v:%v:%v:%v", a.meta.BlockID, a.meta.TenantID, a.meta.Version, a.meta.Encoding)
-	} else {
-		filename = fmt.Sprintf("%v:%v:%v:%v:%v", a.meta.BlockID, a.meta.TenantID, a.meta.Version, a.meta.Encoding, a.meta.DataEncoding)
+	_, err := a.file()
+	return err
+}
+
+// CloseRead closes the file the block's reads are served from, and releases its slot of SetMaxOpenReadFiles, without
+// clearing the block. The next read or Open reopens it. Iterators returned before reading the block fail afterwards.
+func (a *AppendBlock) CloseRead() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
 	}
 
-	return filepath.Join(a.filepath, filename)
+	a.closeReadFile()
+	return nil
 }
 
+// file returns the file the block's reads are served from, opening it on first use. A failed open is not cached so
+// the next read retries it, for instance after running out of file descriptors.
 func (a *AppendBlock) file() (*os.File, error) {
-	var err error
-	a.once.Do(func() {
-		if a.readFile == nil {
-			name := a.fullFilename()
+	a.readFileMtx.Lock()
+	defer a.readFileMtx.Unlock()
 
-			a.readFile, err = os.OpenFile(name, os.O_RDONLY, 0644)
-		}
-	})
+	if a.readFile != nil {
+		return a.readFile, nil
+	}
+
+	slot := acquireReadFileSlot()
+	f, err := openReadFile(a.fullFilename(), os.O_RDONLY, a.fileMode)
+	if err != nil {
+		releaseReadFileSlot(slot)
+		return nil, err
+	}
+	a.readFile = f
+	a.readFileSlot = slot
+
+	return f, nil
+}
+
+// IsWALFile returns true if name is a wal append file name. Directory scanners can use it to skip
+// unrelated files before attempting to replay them.
+func IsWALFile(name string) bool {
+	_, _, _, _, _, err := parseFilename(name)
+	return err == nil
+}
 
-	return a.readFile, err
+// validFilenameField returns whether s can be stored in a wal file name field such as the data encoding. Fields are
+// separated by colons and their length is limited to maxDataEncodingLength bytes.
+func validFilenameField(s string) bool {
+	return !strings.ContainsRune(s, ':') && len(s) <= maxDataEncodingLength
 }
 
+// parseFilename parses a wal file name of the form blockID:tenantID[:version:encoding[:dataEncoding]]. Tenant ids can
+// contain colons so the fields after the tenant are parsed from the right. If the name can be read both with and
+// without a data encoding the reading with a known version is used.
 func parseFilename(name string) (uuid.UUID, string, string, backend.Encoding, string, error) {
 	splits := strings.Split(name, ":")
 
-	if len(splits) != 2 && len(splits) != 4 && len(splits) != 5 {
-		return uuid.UUID{}, "", "", backend.EncNone, "", fmt.Errorf("unable to parse %s. unexpected number of segments", name)
+	if len(splits) < 2 {
+		return uuid.UUID{}, "", "", backend.EncNone, "", &ErrFilenameSegments{Filename: name}
 	}
 
-	blockIDString := splits[0]
-	tenantID := splits[1]
+	blockID, err := uuid.Parse(splits[0])
+	if err != nil {
+		return uuid.UUID{}, "", "", backend.EncNone, "", &ErrFilenameUUID{Filename: name, Segment: splits[0], Err: err}
+	}
 
-	version := "v0"
-	encodingString := backend.EncNone.String()
-	dataEncoding := ""
-	if len(splits) >= 4 {
-		version = splits[2]
-		encodingString = splits[3]
+	if len(splits) == 2 {
+		if len(splits[1]) == 0 {
+			return uuid.UUID{}, "", "", backend.EncNone, "", &ErrFilenameMissingFields{Filename: name}
+		}
+		return blockID, splits[1], legacyVersion, backend.EncNone, "", nil
 	}
 
-	if len(splits) >= 5 {
-		dataEncoding = splits[4]
+	var parsed *parsedFilename
+	for _, hasDataEncoding := range []bool{false, true} {
+		p, pErr := parseFilenameFields(name, splits[1:], hasDataEncoding)
+		if pErr != nil {
+			if err == nil {
+				err = pErr
+			}
+			continue
+		}
+		if parsed == nil || (!parsed.knownVersion && p.knownVersion) {
+			parsed = p
+		}
+	}
+	if parsed == nil {
+		return uuid.UUID{}, "", "", backend.EncNone, "", err
 	}
 
-	blockID, err := uuid.Parse(blockIDString)
-	if err != nil {
-		return uuid.UUID{}, "", "", backend.EncNone, "", fmt.Errorf("unable to parse %s. error parsing uuid: %w", name, err)
+	return blockID, parsed.tenantID, parsed.version, parsed.encoding, parsed.dataEncoding, nil
+}
+
+type parsedFilename struct {
+	tenantID     string
+	version      string
+	encoding     backend.Encoding
+	dataEncoding string
+	knownVersion bool
+}
+
+// parseFilenameFields parses the fields of the wal file name after the block id
+func parseFilenameFields(name string, fields []string, hasDataEncoding bool) (*parsedFilename, error) {
+	p := &parsedFilename{}
+	if hasDataEncoding {
+		if len(fields) < 4 {
+			return nil, &ErrFilenameSegments{Filename: name}
+		}
+		p.dataEncoding = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) < 3 {
+		return nil, &ErrFilenameSegments{Filename: name}
 	}
 
-	encoding, err := backend.ParseEncoding(encodingString)
+	encodingString := fields[len(fields)-1]
+	p.version = fields[len(fields)-2]
+	p.tenantID = strings.Join(fields[:len(fields)-2], ":")
+
+	var err error
+	p.encoding, err = backend.ParseEncoding(encodingString)
+	if err != nil && strings.HasPrefix(encodingString, customEncodingPrefix) && len(encodingString) > len(customEncodingPrefix) {
+		// pages are compressed with a registered Codec
+		p.encoding, err = backend.EncNone, nil
+	}
 	if err != nil {
-		return uuid.UUID{}, "", "", backend.EncNone, "", fmt.Errorf("unable to parse %s. error parsing encoding: %w", name, err)
+		return nil, &ErrFilenameEncoding{Filename: name, Segment: encodingString, Err: err}
 	}
 
-	if len(tenantID) == 0 || len(version) == 0 {
-		return uuid.UUID{}, "", "", backend.EncNone, "", fmt.Errorf("unable to parse %s. missing fields", name)
+	if len(p.tenantID) == 0 || len(p.version) == 0 {
+		return nil, &ErrFilenameMissingFields{Filename: name}
 	}
 
-	return blockID, tenantID, version, encoding, dataEncoding, nil
+	_, err = encoding.FromVersion(p.version)
+	p.knownVersion = err == nil
+
+	return p, nil
 }
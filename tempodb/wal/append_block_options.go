@@ -0,0 +1,342 @@
+package wal
+
+import (
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+const (
+	defaultReadAllMaxObjects = 10000
+
+	// defaultVersion pins the encoding of new wal files instead of tracking latest for safety
+	defaultVersion = "v2"
+
+	defaultFileMode os.FileMode = 0644
+)
+
+// EncodingResolver centralizes the choice of wal encoding per tenant
+type EncodingResolver interface {
+	EncodingForTenant(tenantID string) backend.Encoding
+}
+
+// FixedEncoding is an EncodingResolver that uses the same encoding for every tenant
+type FixedEncoding backend.Encoding
+
+// EncodingForTenant implements EncodingResolver
+func (e FixedEncoding) EncodingForTenant(string) backend.Encoding {
+	return backend.Encoding(e)
+}
+
+// Clock is the source of the times an AppendBlock records, such as the appended times and the times in its meta
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the default Clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// AppendBlockOption configures optional behavior of an AppendBlock
+type AppendBlockOption func(*AppendBlock)
+
+// WithReadAllMaxObjects sets the maximum number of objects ReadAll will return before failing
+func WithReadAllMaxObjects(max int) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.readAllMaxObjects = max
+	}
+}
+
+// WithLogger sets the logger used to report recoverable errors such as page errors during replay
+func WithLogger(logger log.Logger) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.logger = logger
+	}
+}
+
+// WithDataSync opens the append file with O_DSYNC so every write returns only after the data has reached
+// stable storage. Unlike a full fsync, file metadata that is not needed to read the data back (such as the
+// modification time) is not flushed on each write which makes this cheaper, but every Write still waits
+// on the disk. O_DSYNC is used on Linux and macOS, other platforms fall back to O_SYNC.
+func WithDataSync() AppendBlockOption {
+	return WithDurability(DurabilityDataSync)
+}
+
+// Durability selects when writes to the append file reach stable storage
+type Durability int
+
+const (
+	// DurabilityFlush leaves syncing to Flush. Writes only wait on the page cache so it has the highest throughput,
+	// writes since the last Flush can be lost on a crash. It is the default.
+	DurabilityFlush Durability = iota
+	// DurabilityDataSync opens the append file with O_DSYNC, see WithDataSync
+	DurabilityDataSync
+	// DurabilitySync opens the append file with O_SYNC so every write returns only after the data and all file
+	// metadata have reached stable storage. Each write then costs a full fsync, often an order of magnitude slower
+	// than DurabilityFlush on disks without a battery backed write cache.
+	DurabilitySync
+)
+
+// WithDurability selects when writes to the block reach stable storage. It replaces WithDataSync if both are passed.
+func WithDurability(d Durability) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.appendFlags &^= dsyncFlag | os.O_SYNC
+		switch d {
+		case DurabilityDataSync:
+			a.appendFlags |= dsyncFlag
+		case DurabilitySync:
+			a.appendFlags |= os.O_SYNC
+		}
+	}
+}
+
+// WithEncodingResolver makes newAppendBlock consult the resolver for the block's encoding instead of
+// using the encoding passed by the caller
+func WithEncodingResolver(r EncodingResolver) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.encodingResolver = r
+	}
+}
+
+// WithPageFooters writes a small footer after every page so that a page torn by a crash at the end of the
+// file is reported during replay as ErrTruncatedTail. Blocks written with page footers must also be
+// replayed with this option.
+func WithPageFooters() AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.pageFooters = true
+	}
+}
+
+// WithPageChecksums stores a crc32 of every page in its page footer and verifies it during replay. Replay stops
+// at the first page that does not match with an ErrPageChecksum warning so corrupted data is not accepted as a
+// valid object. This enables page footers and, like them, blocks written with it must be replayed with it.
+func WithPageChecksums() AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.pageFooters = true
+		a.pageChecksums = true
+	}
+}
+
+// WithBestEffortReplay makes replay skip a page that can not be read and continue at the next page that can, instead of
+// stopping and dropping the rest of the file. The warning is then an *ErrSkippedPages with the offsets skipped. Without
+// page footers the next page is found by trying every following offset, which is slow for large files and may accept
+// corrupt data that happens to parse, so it is best combined with WithPageChecksums.
+func WithBestEffortReplay() AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.bestEffortReplay = true
+	}
+}
+
+// WithTenantDirs writes the block's file to <path>/<tenantID>/<filename> instead of directly in path so the files of
+// a tenant can be listed without parsing every file name. The mirror, if any, uses the same layout. Checkpoints stay
+// in path. ReplayWALDir replays both layouts and sets the option for blocks it finds in a tenant folder.
+func WithTenantDirs() AppendBlockOption {
+	return withTenantDirs(true)
+}
+
+func withTenantDirs(enabled bool) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.tenantDirs = enabled
+	}
+}
+
+// WithMaxRecordsPerID bounds the number of records Find will read and combine for a single id. When an id has
+// more records only the most recently appended ones are combined and a warning is logged. 0 is unlimited.
+func WithMaxRecordsPerID(max int) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.maxRecordsPerID = max
+	}
+}
+
+// WithMirror writes every page to a second file with the same name in path, which can be on a different
+// volume. On replay the mirror is used if the primary file does not replay cleanly.
+func WithMirror(path string) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.mirrorPath = path
+	}
+}
+
+// WithReadTimings reports the time Find and the block iterators spend reading pages, decoding objects and
+// combining them to sink. This separates I/O cost from CPU cost when diagnosing slow reads.
+func WithReadTimings(sink ReadTimingSink) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.readTimings = sink
+	}
+}
+
+// WithMaxRecords caps the number of records that can be appended to the block. Once reached Write returns
+// ErrBlockFull so the caller cuts a new block. This bounds the in memory index. 0 is unlimited.
+func WithMaxRecords(max int) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.maxRecords = max
+	}
+}
+
+// WithoutIndex skips tracking records on Write for blocks that are written once and then iterated, such as
+// blocks that are only uploaded. The index is rebuilt by replaying the file when GetIterator is called.
+// Until then Find, GetIteratorForIDs and ReindexForSearch return ErrNoIndex.
+func WithoutIndex() AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.indexless = true
+	}
+}
+
+// WithCompactionLevel sets the compaction level recorded in the block's meta. Combine raises it to one more than the
+// level of the blocks combined into the block. The level is not part of the file name, it is stored next to the
+// block's checkpoint and restored on replay.
+func WithCompactionLevel(level uint8) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.compactionLevel = level
+	}
+}
+
+// WithTempDir sets the directory used for temporary files created by the block, for instance to keep them on
+// a faster volume than the wal. Defaults to the wal path.
+func WithTempDir(dir string) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.tempDir = dir
+	}
+}
+
+// WithCodec compresses the block's pages with the Codec registered under name instead of the block's encoding.
+// The block's meta encoding is none and the codec is recorded in the file name for replay.
+func WithCodec(name string) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.codec = name
+	}
+}
+
+// WithIndexCheckpoints appends the records written to the block to an index checkpoint file after every n
+// records. Replay loads the checkpoint and only replays the data written after it which bounds replay time
+// for large blocks. Checkpoint can also be called directly.
+func WithIndexCheckpoints(n int) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.checkpointEvery = n
+	}
+}
+
+// WithMaxAge makes Write return ErrBlockExpired once the block is older than maxAge so the caller cuts and
+// completes it. Age is measured from the block's creation. 0 is unlimited.
+func WithMaxAge(maxAge time.Duration) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.maxAge = maxAge
+	}
+}
+
+// WithVersion sets the encoding version of new blocks. Replayed blocks always use the version in their file name
+// so older files can still be read after changing it. Defaults to v2.
+func WithVersion(version string) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.version = version
+	}
+}
+
+// WithMaxObjectSize makes Write return ErrObjectTooLarge for objects larger than max bytes. Nothing is appended for
+// a rejected object. 0 is unlimited.
+func WithMaxObjectSize(max int) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.maxObjectSize = max
+	}
+}
+
+// WithClock makes the block take the times it records, and compares WithMaxAge to, from clock instead of the system
+// clock so tests can control time.
+func WithClock(clock Clock) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.clock = clock
+	}
+}
+
+// WithMetrics reports appends, flushes and replays of the block to sink, and the size of every object written if sink
+// is also an ObjectSizeSink
+func WithMetrics(sink MetricsSink) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.metrics = sink
+		a.objectSizes, _ = sink.(ObjectSizeSink)
+	}
+}
+
+// WithFileMode sets the permissions of the files created by the block, before the process umask is applied. Files that
+// already exist keep their permissions. Defaults to 0644.
+func WithFileMode(mode os.FileMode) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.fileMode = mode
+	}
+}
+
+// WithReplayProgress calls fn periodically while the block's file is replayed so callers can report the progress of
+// long replays
+func WithReplayProgress(fn ReplayProgressFunc) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.replayProgress = fn
+	}
+}
+
+// WithReplayBufferSize sets the initial size of the buffer pages are read into during replay. The buffer grows to the
+// largest page replayed, setting it to the expected page size avoids growing it in steps for blocks of large objects.
+func WithReplayBufferSize(size int) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.replayBufferSize = size
+	}
+}
+
+// WithMmap makes Find read pages from the block's file mapped into memory instead of reading the file, which avoids a
+// syscall per page for blocks serving many lookups. Only blocks that can not be appended to, such as replayed blocks
+// or blocks sealed by GetIterator, are mapped. Platforms without mmap and files that fail to map fall back to
+// reading the file.
+func WithMmap() AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.mmap = true
+	}
+}
+
+// WithBatchedPages makes WriteBatch write consecutive objects that fit in size bytes to a single page instead of a page
+// each, which saves the per page overhead for small objects. Objects with the same id are not written to the same page.
+// A page is only replayed if it is complete so a crash loses the whole page rather than a single object. Write is
+// not affected. Blocks written with it are replayed like any other, unless SingleObjectPages are expected.
+func WithBatchedPages(size int) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.batchedPageSize = size
+	}
+}
+
+// WithDiskLowWatermark makes writes fail with ErrWALDiskLow once they would leave less than minFree bytes available on
+// the filesystem of the block's path, and with ErrWALDiskFull if the object does not fit at all, so callers can reject
+// writes before the disk is full. The available space is checked every checkInterval writes.
+func WithDiskLowWatermark(minFree uint64, checkInterval int) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.diskLowWatermark = minFree
+		a.diskCheckInterval = checkInterval
+	}
+}
+
+// WithDiskSpace replaces the statfs of the block's path WithDiskLowWatermark uses to find the available disk space
+func WithDiskSpace(fn DiskSpaceFunc) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.diskSpace = fn
+	}
+}
+
+// WithPageObjects sets the number of objects replay expects in a page, MultiObjectPages by default. It can not be
+// SingleObjectPages for blocks written WithBatchedPages.
+func WithPageObjects(pageObjects PageObjects) AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.pageObjects = pageObjects
+	}
+}
+
+// WithVerifiedObjectCount makes Complete read every object appended to the block and compare their number to the
+// TotalObjects of its meta before anything is written to the backend. If they differ, for instance because the count
+// drifted from the index, Complete fails with an *ErrObjectCountMismatch instead of shipping the block. The block is
+// read twice.
+func WithVerifiedObjectCount() AppendBlockOption {
+	return func(a *AppendBlock) {
+		a.verifyObjectCount = true
+	}
+}
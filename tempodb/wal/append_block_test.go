@@ -1,11 +1,32 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/google/uuid"
+	"github.com/grafana/tempo/pkg/model"
 	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFullFilename(t *testing.T) {
@@ -148,6 +169,42 @@ func TestParseFilename(t *testing.T) {
 			expectedEncoding:     backend.EncSnappy,
 			expectedDataEncoding: "dataencoding",
 		},
+		{
+			name:             "tenant with colon",
+			filename:         "123e4567-e89b-12d3-a456-426614174000:team:prod:v2:snappy",
+			expectUUID:       uuid.MustParse("123e4567-e89b-12d3-a456-426614174000"),
+			expectTenant:     "team:prod",
+			expectedVersion:  "v2",
+			expectedEncoding: backend.EncSnappy,
+		},
+		{
+			name:                 "tenant with colons and dataencoding",
+			filename:             "123e4567-e89b-12d3-a456-426614174000:a:b:c:v2:gzip:dataencoding",
+			expectUUID:           uuid.MustParse("123e4567-e89b-12d3-a456-426614174000"),
+			expectTenant:         "a:b:c",
+			expectedVersion:      "v2",
+			expectedEncoding:     backend.EncGZIP,
+			expectedDataEncoding: "dataencoding",
+		},
+		{
+			// also reads as tenant foo:v2, version none and encoding none
+			name:                 "dataencoding that is an encoding",
+			filename:             "123e4567-e89b-12d3-a456-426614174000:foo:v2:none:none",
+			expectUUID:           uuid.MustParse("123e4567-e89b-12d3-a456-426614174000"),
+			expectTenant:         "foo",
+			expectedVersion:      "v2",
+			expectedEncoding:     backend.EncNone,
+			expectedDataEncoding: "none",
+		},
+		{
+			// also reads as tenant foo, version snappy, encoding none and data encoding v2
+			name:             "tenant with colon and 5 segments",
+			filename:         "123e4567-e89b-12d3-a456-426614174000:foo:snappy:v2:none",
+			expectUUID:       uuid.MustParse("123e4567-e89b-12d3-a456-426614174000"),
+			expectTenant:     "foo:snappy",
+			expectedVersion:  "v2",
+			expectedEncoding: backend.EncNone,
+		},
 		{
 			name:        "path fails",
 			filename:    "/blerg/123e4567-e89b-12d3-a456-426614174000:foo",
@@ -200,6 +257,9 @@ func TestParseFilename(t *testing.T) {
 		},
 	}
 
+	_, _, _, _, _, err := parseFilename("123e4567-e89b-12d3-a456-426614174000:test:v1:asdf")
+	assert.Contains(t, err.Error(), `encoding segment "asdf"`)
+
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			actualUUID, actualTenant, actualVersion, actualEncoding, actualDataEncoding, err := parseFilename(tc.filename)
@@ -218,3 +278,2700 @@ func TestParseFilename(t *testing.T) {
 		})
 	}
 }
+
+func TestParseFilenameErrors(t *testing.T) {
+	var segments *ErrFilenameSegments
+	var badUUID *ErrFilenameUUID
+	var badEncoding *ErrFilenameEncoding
+	var missingFields *ErrFilenameMissingFields
+
+	for _, name := range []string{"", "123e4567-e89b-12d3-a456-426614174000", "123e4567-e89b-12d3-a456-426614174000:foo:v2"} {
+		_, _, _, _, _, err := parseFilename(name)
+		require.True(t, errors.As(err, &segments), name)
+		assert.Equal(t, name, segments.Filename)
+	}
+
+	_, _, _, _, _, err := parseFilename("123e4:foo")
+	require.True(t, errors.As(err, &badUUID))
+	assert.Equal(t, "123e4", badUUID.Segment)
+	assert.Error(t, errors.Unwrap(err))
+
+	_, _, _, _, _, err = parseFilename("123e4567-e89b-12d3-a456-426614174000:test:v1:asdf")
+	require.True(t, errors.As(err, &badEncoding))
+	assert.Equal(t, "asdf", badEncoding.Segment)
+	assert.Error(t, errors.Unwrap(err))
+
+	for _, name := range []string{"123e4567-e89b-12d3-a456-426614174000:", "123e4567-e89b-12d3-a456-426614174000:test::none"} {
+		_, _, _, _, _, err = parseFilename(name)
+		require.True(t, errors.As(err, &missingFields), name)
+		assert.Equal(t, name, missingFields.Filename)
+	}
+
+	// replay reports files that are not wal files with the error parsing their name
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "notawalfile"), []byte{0x01}, 0644))
+
+	_, errs, err := ReplayWALDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, errs, 1)
+	assert.True(t, errors.As(errs[0], &segments))
+}
+
+func TestLegacyFilename(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	for _, name := range []string{
+		"123e4567-e89b-12d3-a456-426614174000:foo",
+		"123e4567-e89b-12d3-a456-426614174000:team-prod_1",
+	} {
+		blockID, tenantID, version, e, dataEncoding, err := parseFilename(name)
+		require.NoError(t, err)
+		assert.Equal(t, legacyVersion, version)
+		assert.Equal(t, backend.EncNone, e)
+		assert.Equal(t, "", dataEncoding)
+
+		b := &AppendBlock{
+			meta:     backend.NewBlockMeta(tenantID, blockID, version, e, dataEncoding),
+			filepath: tempDir,
+		}
+		assert.Equal(t, filepath.Join(tempDir, name), b.fullFilename())
+
+		// the encodings are not part of the name
+		b.meta = backend.NewBlockMeta(tenantID, blockID, version, backend.EncSnappy, "v1")
+		assert.Equal(t, filepath.Join(tempDir, name), b.fullFilename())
+	}
+
+	// tenant ids with colons can not be told apart from newer file names
+	b := &AppendBlock{
+		meta: backend.NewBlockMeta("team:prod", uuid.MustParse("123e4567-e89b-12d3-a456-426614174000"), legacyVersion, backend.EncNone, ""),
+	}
+	assert.False(t, IsWALFile(b.fullFilename()))
+
+	// legacy files are reported and left in place
+	name := "123e4567-e89b-12d3-a456-426614174000:foo"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tempDir, name), []byte{0x01}, 0644))
+	blocks, errs, err := ReplayWALDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, blocks)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), name)
+	assert.FileExists(t, filepath.Join(tempDir, name))
+}
+
+func TestTenantWithColons(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), "team:prod", tempDir, backend.EncSnappy, "v1")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 3)
+
+	blocks, errs, err := ReplayWALDir(tempDir)
+	require.NoError(t, err)
+	require.Empty(t, errs)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "team:prod", blocks[0].Meta().TenantID)
+	assert.Equal(t, "v1", blocks[0].Meta().DataEncoding)
+	for i, id := range ids {
+		obj, err := blocks[0].Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+}
+
+func TestDataEncodingLength(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	tests := []struct {
+		dataEncoding string
+		valid        bool
+	}{
+		{strings.Repeat("a", maxDataEncodingLength), true},
+		{strings.Repeat("a", maxDataEncodingLength+1), false},
+		// 16 two byte runes fill the limit
+		{strings.Repeat("é", maxDataEncodingLength/2), true},
+		// 17 runes but 34 bytes
+		{strings.Repeat("é", maxDataEncodingLength/2+1), false},
+		// a 3 byte rune crossing the limit
+		{strings.Repeat("a", maxDataEncodingLength-3) + "€", true},
+		{strings.Repeat("a", maxDataEncodingLength-2) + "€", false},
+		{"v1:json", false},
+		{"é:", false},
+	}
+
+	for _, tc := range tests {
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, tc.dataEncoding)
+		if !tc.valid {
+			assert.Error(t, err, tc.dataEncoding)
+			continue
+		}
+		require.NoError(t, err, tc.dataEncoding)
+
+		_, _, _, _, dataEncoding, err := parseFilename(filepath.Base(block.fullFilename()))
+		require.NoError(t, err)
+		assert.Equal(t, tc.dataEncoding, dataEncoding)
+	}
+
+	assert.Error(t, RegisterCodec(strings.Repeat("é", maxDataEncodingLength/2+1), xorCodec{}))
+}
+
+func TestReindexForSearch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	// write ids in descending order so the write order is the reverse of the sorted order
+	ids := make([][]byte, 0, 10)
+	for i := 10; i > 0; i-- {
+		id := make([]byte, 16)
+		id[15] = byte(i)
+		ids = append(ids, id)
+
+		err = block.Write(id, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+
+	err = block.ReindexForSearch()
+	require.NoError(t, err)
+	require.Len(t, block.index, len(ids))
+	for i := 1; i < len(block.index); i++ {
+		assert.Equal(t, -1, bytes.Compare(block.index[i-1].ID, block.index[i].ID))
+	}
+
+	for _, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{id[15]}, obj)
+	}
+
+	missing := make([]byte, 16)
+	obj, err := block.Find(context.Background(), missing, &mockCombiner{})
+	require.NoError(t, err)
+	assert.Nil(t, obj)
+
+	// a write drops the index
+	err = block.Write(missing, []byte{0xff})
+	require.NoError(t, err)
+	assert.Nil(t, block.index)
+}
+
+func TestReadObjectRange(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	obj := make([]byte, 4096)
+	rand.Read(obj)
+
+	err = block.Write(id, obj)
+	require.NoError(t, err)
+
+	actual, err := block.ReadObjectRange(id, 1000, 24, &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, obj[1000:1024], actual)
+
+	actual, err = block.ReadObjectRange(id, 0, len(obj), &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, obj, actual)
+
+	_, err = block.ReadObjectRange(id, 4000, 100, &mockCombiner{})
+	assert.Error(t, err)
+	_, err = block.ReadObjectRange(id, -1, 10, &mockCombiner{})
+	assert.Error(t, err)
+
+	actual, err = block.ReadObjectRange(make([]byte, 16), 0, 10, &mockCombiner{})
+	require.NoError(t, err)
+	assert.Nil(t, actual)
+}
+
+func TestReadAll(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	objects := 10
+	expected := map[string][]byte{}
+	ids := make([][]byte, 0, objects)
+	for i := 0; i < objects; i++ {
+		id := make([]byte, 16)
+		rand.Read(id)
+		obj := make([]byte, 100)
+		rand.Read(obj)
+
+		ids = append(ids, id)
+		expected[hex.EncodeToString(id)] = obj
+	}
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	for _, id := range ids {
+		err = block.Write(id, expected[hex.EncodeToString(id)])
+		require.NoError(t, err)
+	}
+
+	actual, err := block.ReadAll(&mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	// cap is enforced
+	capped, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithReadAllMaxObjects(objects-1))
+	require.NoError(t, err)
+	for _, id := range ids {
+		err = capped.Write(id, expected[hex.EncodeToString(id)])
+		require.NoError(t, err)
+	}
+
+	actual, err = capped.ReadAll(&mockCombiner{})
+	assert.Equal(t, ErrReadAllLimitExceeded, err)
+	assert.Nil(t, actual)
+}
+
+func TestImport(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	source, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncGZIP, "")
+	require.NoError(t, err)
+
+	ids := make([][]byte, 0, 10)
+	for i := 0; i < 10; i++ {
+		id := make([]byte, 16)
+		rand.Read(id)
+		ids = append(ids, id)
+
+		err = source.Write(id, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+
+	data, err := ioutil.ReadFile(source.fullFilename())
+	require.NoError(t, err)
+	records := source.appender.Records()
+
+	dest, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncGZIP, "")
+	require.NoError(t, err)
+
+	// out of bounds records are rejected without writing anything
+	err = dest.Import([]common.Record{{ID: ids[0], Start: uint64(len(data)), Length: 1}}, data)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(0), dest.DataLength())
+
+	err = dest.Import(records, data)
+	require.NoError(t, err)
+	assert.Equal(t, records, dest.appender.Records())
+	assert.Equal(t, source.DataLength(), dest.DataLength())
+	assert.Equal(t, len(ids), dest.Meta().TotalObjects)
+
+	for i, id := range ids {
+		obj, err := dest.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, obj)
+	}
+
+	// the imported file replays to the same index
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(dest.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Equal(t, records, replayed.appender.Records())
+}
+
+func TestReplayResult(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	writeTestObjects(t, block, 5)
+	filename := filepath.Base(block.fullFilename())
+	dataLength := block.DataLength()
+
+	replayed, warning, err := newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Equal(t, ReplayResult{Recovered: 5}, replayed.ReplayResult())
+
+	appendGarbage(t, block.fullFilename())
+
+	replayed, warning, err = newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	require.Error(t, warning)
+	assert.Equal(t, ReplayResult{
+		Recovered:         5,
+		TruncatedAtOffset: dataLength,
+		SkippedBytes:      11,
+	}, replayed.ReplayResult())
+
+	// a block created but never written to
+	empty, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	replayed, warning, err = newAppendBlockFromFile(filepath.Base(empty.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Equal(t, ReplayResult{Empty: true, EmptyFile: true}, replayed.ReplayResult())
+
+	// a file holding no complete object
+	appendGarbage(t, empty.fullFilename())
+	replayed, warning, err = newAppendBlockFromFile(filepath.Base(empty.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.Error(t, warning)
+	assert.Equal(t, ReplayResult{SkippedBytes: 11, Empty: true}, replayed.ReplayResult())
+}
+
+func TestBestEffortReplay(t *testing.T) {
+	for _, opts := range [][]AppendBlockOption{nil, {WithPageChecksums()}} {
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		defer os.RemoveAll(tempDir)
+		require.NoError(t, err, "unexpected error creating temp dir")
+
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", opts...)
+		require.NoError(t, err)
+		ids, objs := makeTestBatch(10)
+		for i, id := range ids {
+			require.NoError(t, block.Write(id, objs[i]))
+		}
+		filename := filepath.Base(block.fullFilename())
+		records := block.appender.Records()
+
+		// corrupt the object length of the 5th page and the last page
+		var corrupt []common.Record
+		for _, r := range records {
+			if bytes.Equal(r.ID, ids[4]) || bytes.Equal(r.ID, ids[9]) {
+				corrupt = append(corrupt, r)
+			}
+		}
+		sort.Slice(corrupt, func(i, j int) bool { return corrupt[i].Start < corrupt[j].Start })
+		f, err := os.OpenFile(block.fullFilename(), os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		for _, r := range corrupt {
+			_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(r.Start)+6)
+			require.NoError(t, err)
+		}
+		require.NoError(t, f.Close())
+
+		// stop at the first error by default
+		replayed, warning, err := newAppendBlockFromFile(filename, tempDir, opts...)
+		require.NoError(t, err)
+		require.Error(t, warning)
+		assert.Len(t, replayed.appender.Records(), 4)
+		replayed.closeReadFile()
+
+		replayed, warning, err = newAppendBlockFromFile(filename, tempDir, append(opts, WithBestEffortReplay())...)
+		require.NoError(t, err)
+		var skipped *ErrSkippedPages
+		require.True(t, errors.As(warning, &skipped))
+		assert.Equal(t, []uint64{corrupt[0].Start, corrupt[1].Start}, skipped.Offsets)
+		assert.Equal(t, uint64(corrupt[0].Length+corrupt[1].Length), skipped.Bytes)
+		if len(opts) > 0 {
+			assert.True(t, errors.Is(warning, ErrPageChecksum))
+		}
+		assert.Equal(t, ReplayResult{
+			Recovered:         8,
+			TruncatedAtOffset: corrupt[0].Start,
+			SkippedBytes:      skipped.Bytes,
+		}, replayed.ReplayResult())
+
+		for i, id := range ids {
+			obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+			require.NoError(t, err)
+			if i == 4 || i == 9 {
+				assert.Nil(t, obj)
+				continue
+			}
+			assert.Equal(t, objs[i], obj)
+		}
+		replayed.closeReadFile()
+	}
+}
+
+func TestReplayLogsWarnings(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	var filenames []string
+	for i := 0; i < 2; i++ {
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+		require.NoError(t, err)
+		writeTestObjects(t, block, 5)
+		appendGarbage(t, block.fullFilename())
+		filenames = append(filenames, filepath.Base(block.fullFilename()))
+	}
+
+	buf := &bytes.Buffer{}
+	logger := log.NewLogfmtLogger(buf)
+	for _, filename := range filenames {
+		_, warning, err := newAppendBlockFromFile(filename, tempDir, WithLogger(logger))
+		require.NoError(t, err)
+		require.Error(t, warning)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	for i, line := range lines {
+		assert.Contains(t, line, "level=warn")
+		assert.Contains(t, line, "file="+filenames[i])
+		assert.Contains(t, line, "record=5")
+		assert.Contains(t, line, "offset=")
+		assert.Contains(t, line, "err=")
+	}
+}
+
+// writeTestObjects writes count random objects to the block and returns the ids and objects written
+func writeTestObjects(t testing.TB, block *AppendBlock, count int) ([][]byte, [][]byte) {
+	ids := make([][]byte, 0, count)
+	objs := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		id := make([]byte, 16)
+		rand.Read(id)
+		obj := make([]byte, 100)
+		rand.Read(obj)
+
+		err := block.Write(id, obj)
+		require.NoError(t, err)
+
+		ids = append(ids, id)
+		objs = append(objs, obj)
+	}
+
+	return ids, objs
+}
+
+// appendGarbage writes garbage to the end of the file to simulate a torn write
+func appendGarbage(t testing.TB, name string) {
+	appendFile, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	require.NoError(t, err)
+	_, err = appendFile.Write([]byte{0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01})
+	require.NoError(t, err)
+	err = appendFile.Close()
+	require.NoError(t, err)
+}
+
+func TestFingerprint(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 20)
+
+	live, err := block.Fingerprint()
+	require.NoError(t, err)
+
+	again, err := block.Fingerprint()
+	require.NoError(t, err)
+	assert.Equal(t, live, again)
+
+	// stable across replay
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	replayedFingerprint, err := replayed.Fingerprint()
+	require.NoError(t, err)
+	assert.Equal(t, live, replayedFingerprint)
+
+	// a single changed object changes the fingerprint
+	changed, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	for i := range ids {
+		obj := objs[i]
+		if i == 10 {
+			obj = append([]byte(nil), obj...)
+			obj[0]++
+		}
+		err = changed.Write(ids[i], obj)
+		require.NoError(t, err)
+	}
+	changedFingerprint, err := changed.Fingerprint()
+	require.NoError(t, err)
+	assert.NotEqual(t, live, changedFingerprint)
+
+	// independent of the append order and the encoding, including objects with the same id
+	forward, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	backward, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncZstd, "", WithPageChecksums())
+	require.NoError(t, err)
+	for i := range ids {
+		require.NoError(t, forward.Write(ids[i], objs[i]))
+		require.NoError(t, forward.Write(ids[i], objs[len(ids)-1-i]))
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		require.NoError(t, backward.Write(ids[i], objs[len(ids)-1-i]))
+		require.NoError(t, backward.Write(ids[i], objs[i]))
+	}
+	forwardFingerprint, err := forward.Fingerprint()
+	require.NoError(t, err)
+	backwardFingerprint, err := backward.Fingerprint()
+	require.NoError(t, err)
+	assert.Equal(t, forwardFingerprint, backwardFingerprint)
+	assert.NotEqual(t, live, forwardFingerprint)
+
+	indexless, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithoutIndex())
+	require.NoError(t, err)
+	_, err = indexless.Fingerprint()
+	assert.Equal(t, ErrNoIndex, err)
+}
+
+func TestDataSync(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithDataSync())
+	require.NoError(t, err)
+	assert.Equal(t, dsyncFlag, block.appendFlags)
+	ids, objs := writeTestObjects(t, block, 10)
+
+	// simulate a crash by abandoning the block without closing or completing it
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	require.Equal(t, len(ids), replayed.appender.Length())
+
+	for i, id := range ids {
+		obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	for durability, flags := range map[Durability]int{
+		DurabilityFlush:    0,
+		DurabilityDataSync: dsyncFlag,
+		DurabilitySync:     os.O_SYNC,
+	} {
+		// the last durability passed wins
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithDataSync(), WithDurability(durability))
+		require.NoError(t, err)
+		assert.Equal(t, flags, block.appendFlags)
+		ids, objs := writeTestObjects(t, block, 10)
+
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		require.Equal(t, len(ids), replayed.appender.Length())
+		for i, id := range ids {
+			obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+			require.NoError(t, err)
+			assert.Equal(t, objs[i], obj)
+		}
+		replayed.closeReadFile()
+	}
+}
+
+type tenantEncodings map[string]backend.Encoding
+
+func (t tenantEncodings) EncodingForTenant(tenantID string) backend.Encoding {
+	return t[tenantID]
+}
+
+func TestEncodingResolver(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	resolver := tenantEncodings{
+		"high-volume": backend.EncZstd,
+		"low-volume":  backend.EncNone,
+	}
+
+	for tenantID, expected := range resolver {
+		block, err := newAppendBlock(uuid.New(), tenantID, tempDir, backend.EncGZIP, "", WithEncodingResolver(resolver))
+		require.NoError(t, err)
+		assert.Equal(t, expected, block.Meta().Encoding)
+		ids, objs := writeTestObjects(t, block, 5)
+
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		assert.Equal(t, expected, replayed.Meta().Encoding)
+		for i, id := range ids {
+			obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+			require.NoError(t, err)
+			assert.Equal(t, objs[i], obj)
+		}
+	}
+
+	// the default is the fixed encoding passed by the caller
+	block, err := newAppendBlock(uuid.New(), "high-volume", tempDir, backend.EncGZIP, "")
+	require.NoError(t, err)
+	assert.Equal(t, backend.EncGZIP, block.Meta().Encoding)
+
+	block, err = newAppendBlock(uuid.New(), "high-volume", tempDir, backend.EncGZIP, "", WithEncodingResolver(FixedEncoding(backend.EncSnappy)))
+	require.NoError(t, err)
+	assert.Equal(t, backend.EncSnappy, block.Meta().Encoding)
+}
+
+// appendCombiner combines objects by concatenating them in order
+type appendCombiner struct{}
+
+func (appendCombiner) Combine(_ string, objs ...[]byte) ([]byte, bool) {
+	var combined []byte
+	for _, obj := range objs {
+		combined = append(combined, obj...)
+	}
+	return combined, len(objs) > 1
+}
+
+func TestMaxRecordsPerID(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	buf := &bytes.Buffer{}
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMaxRecordsPerID(3), WithLogger(log.NewLogfmtLogger(buf)))
+	require.NoError(t, err)
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	for i := 0; i < 100; i++ {
+		err = block.Write(id, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+
+	other := make([]byte, 16)
+	rand.Read(other)
+	err = block.Write(other, []byte{0x01})
+	require.NoError(t, err)
+
+	obj, err := block.Find(context.Background(), id, appendCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{97, 98, 99}, obj)
+	assert.Contains(t, buf.String(), "level=warn")
+	assert.Contains(t, buf.String(), "records=100")
+	assert.Contains(t, buf.String(), "limit=3")
+
+	// ids under the cap are not capped
+	buf.Reset()
+	obj, err = block.Find(context.Background(), other, appendCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01}, obj)
+	assert.Empty(t, buf.String())
+
+	// the cap also applies when using the search index
+	err = block.ReindexForSearch()
+	require.NoError(t, err)
+	obj, err = block.Find(context.Background(), id, appendCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{97, 98, 99}, obj)
+}
+
+func TestFindAll(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithMaxRecordsPerID(1))
+	require.NoError(t, err)
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, block.Write(id, []byte{byte(i)}))
+		writeTestObjects(t, block, 1)
+	}
+
+	objs, err := block.FindAll(id)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{{0}, {1}, {2}}, objs)
+
+	missing := make([]byte, 16)
+	rand.Read(missing)
+	objs, err = block.FindAll(missing)
+	require.NoError(t, err)
+	assert.Nil(t, objs)
+
+	indexless, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithoutIndex())
+	require.NoError(t, err)
+	_, err = indexless.FindAll(id)
+	assert.Equal(t, ErrNoIndex, err)
+}
+
+func TestWriteMetaSidecar(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncZstd, "foo")
+	require.NoError(t, err)
+	writeTestObjects(t, block, 10)
+
+	// replayed blocks don't track id bounds so confirm they are recomputed
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+
+	sidecarDir := filepath.Join(tempDir, "sidecar")
+	err = os.MkdirAll(sidecarDir, os.ModePerm)
+	require.NoError(t, err)
+	err = replayed.WriteMetaSidecar(sidecarDir)
+	require.NoError(t, err)
+
+	bMeta, err := ioutil.ReadFile(filepath.Join(sidecarDir, backend.MetaName))
+	require.NoError(t, err)
+	actual := &backend.BlockMeta{}
+	err = json.Unmarshal(bMeta, actual)
+	require.NoError(t, err)
+
+	expected := block.Meta()
+	assert.True(t, actual.StartTime.Equal(replayed.Meta().StartTime))
+	assert.True(t, actual.EndTime.Equal(replayed.Meta().EndTime))
+	actual.StartTime = expected.StartTime
+	actual.EndTime = expected.EndTime
+	assert.Equal(t, expected, actual)
+}
+
+func TestGetIteratorForIDs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 20)
+
+	// write a second object for one of the requested ids to confirm they are combined
+	err = block.Write(ids[3], []byte{0x01})
+	require.NoError(t, err)
+
+	requested := []common.ID{ids[7], ids[3], ids[15], ids[3], make([]byte, 16)}
+	iter, err := block.GetIteratorForIDs(requested, appendCombiner{})
+	require.NoError(t, err)
+	defer iter.Close()
+
+	expected := map[string][]byte{
+		hex.EncodeToString(ids[3]):  append(append([]byte(nil), objs[3]...), 0x01),
+		hex.EncodeToString(ids[7]):  objs[7],
+		hex.EncodeToString(ids[15]): objs[15],
+	}
+
+	var previous common.ID
+	actual := map[string][]byte{}
+	for {
+		id, obj, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if id == nil {
+			break
+		}
+
+		assert.Equal(t, -1, bytes.Compare(previous, id))
+		previous = append([]byte(nil), id...)
+		actual[hex.EncodeToString(id)] = obj
+	}
+	assert.Equal(t, expected, actual)
+
+	// the block can still be appended to
+	writeTestObjects(t, block, 1)
+}
+
+func TestEmptyBlockDoesNotOpenFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	obj, err := block.Find(context.Background(), make([]byte, 16), &mockCombiner{})
+	require.NoError(t, err)
+	assert.Nil(t, obj)
+	assert.Nil(t, block.readFile)
+
+	iter, err := block.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	defer iter.Close()
+	assert.Nil(t, block.readFile)
+	assert.Nil(t, block.appendFile)
+
+	id, _, err := iter.Next(context.Background())
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, id)
+
+	err = block.Clear()
+	require.NoError(t, err)
+	assert.NoFileExists(t, block.fullFilename())
+}
+
+func TestQuickHealth(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	healthy, reason := block.QuickHealth()
+	assert.True(t, healthy)
+	assert.Empty(t, reason)
+
+	writeTestObjects(t, block, 10)
+	healthy, reason = block.QuickHealth()
+	assert.True(t, healthy)
+	assert.Empty(t, reason)
+
+	// truncated underneath
+	err = os.Truncate(block.fullFilename(), int64(block.DataLength())-1)
+	require.NoError(t, err)
+	healthy, reason = block.QuickHealth()
+	assert.False(t, healthy)
+	assert.Contains(t, reason, "smaller than data length")
+
+	err = os.Truncate(block.fullFilename(), 0)
+	require.NoError(t, err)
+	healthy, reason = block.QuickHealth()
+	assert.False(t, healthy)
+	assert.Contains(t, reason, "empty")
+
+	// deleted underneath
+	err = os.Remove(block.fullFilename())
+	require.NoError(t, err)
+	healthy, reason = block.QuickHealth()
+	assert.False(t, healthy)
+	assert.Contains(t, reason, "unable to stat file")
+}
+
+func TestMirror(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	mirrorDir := filepath.Join(tempDir, "mirror")
+	err = os.MkdirAll(mirrorDir, os.ModePerm)
+	require.NoError(t, err)
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMirror(mirrorDir))
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 10)
+
+	primary, err := ioutil.ReadFile(block.fullFilename())
+	require.NoError(t, err)
+	mirror, err := ioutil.ReadFile(block.mirrorFilename())
+	require.NoError(t, err)
+	assert.Equal(t, primary, mirror)
+
+	// corrupt the primary
+	err = os.Truncate(block.fullFilename(), int64(len(primary)/2+3))
+	require.NoError(t, err)
+
+	filename := filepath.Base(block.fullFilename())
+	_, warning, err := newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	require.Error(t, warning)
+
+	replayed, warning, err := newAppendBlockFromFile(filename, tempDir, WithMirror(mirrorDir))
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	require.Equal(t, len(ids), replayed.appender.Length())
+	for i, id := range ids {
+		obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	err = replayed.Clear()
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(tempDir, filename))
+	assert.NoFileExists(t, filepath.Join(mirrorDir, filename))
+}
+
+func TestEstimateWriteSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	for _, opts := range [][]AppendBlockOption{nil, {WithPageFooters()}} {
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", opts...)
+		require.NoError(t, err)
+
+		for _, size := range []int{0, 1, 100, 10000} {
+			id := make([]byte, 16)
+			rand.Read(id)
+			obj := make([]byte, size)
+			rand.Read(obj)
+
+			estimate := block.EstimateWriteSize(obj)
+			before := block.DataLength()
+			err = block.Write(id, obj)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(estimate), block.DataLength()-before)
+		}
+	}
+}
+
+func TestLargeRecords(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	large := map[string]struct{}{}
+	for i := 0; i < 20; i++ {
+		id := make([]byte, 16)
+		rand.Read(id)
+		size := 10
+		if i%4 == 0 {
+			size = 1000
+			large[string(id)] = struct{}{}
+		}
+		obj := make([]byte, size)
+		rand.Read(obj)
+
+		err = block.Write(id, obj)
+		require.NoError(t, err)
+	}
+
+	records := block.LargeRecords(500)
+	require.Len(t, records, len(large))
+	for _, r := range records {
+		assert.Contains(t, large, string(r.ID))
+		assert.Greater(t, r.Length, uint32(500))
+	}
+
+	assert.Empty(t, block.LargeRecords(10000))
+	assert.Len(t, block.LargeRecords(0), 20)
+}
+
+func TestIsWALFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "v1")
+	require.NoError(t, err)
+	_, _ = writeTestObjects(t, block, 1)
+
+	walFiles := []string{
+		filepath.Base(block.fullFilename()),
+		"fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:tenant",
+		"fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:tenant:v2:gzip",
+	}
+	otherFiles := []string{
+		"fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:tenant:v2:notanencoding",
+		"fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:tenant:v2:gzip:v1:extra",
+		"notauuid:tenant:v2:gzip",
+		"fe0b83eb-a86b-4b6c-9a74-dc272cd5700e::v2:gzip",
+		backend.MetaName,
+		".tmp123",
+		"archive.gz",
+	}
+	for _, name := range append(walFiles[1:], otherFiles...) {
+		err = os.WriteFile(filepath.Join(tempDir, name), []byte{}, 0644)
+		require.NoError(t, err)
+	}
+
+	files, err := ioutil.ReadDir(tempDir)
+	require.NoError(t, err)
+
+	var actual []string
+	for _, f := range files {
+		if IsWALFile(f.Name()) {
+			actual = append(actual, f.Name())
+		}
+	}
+	assert.ElementsMatch(t, walFiles, actual)
+}
+
+func TestMaxRecords(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMaxRecords(5))
+	require.NoError(t, err)
+
+	ids, objs := writeTestObjects(t, block, 4)
+
+	// the last record fits, even for an existing id
+	err = block.Write(ids[0], objs[0])
+	require.NoError(t, err)
+
+	err = block.Write(ids[1], objs[1])
+	assert.Equal(t, ErrBlockFull, err)
+
+	err = block.Write([]byte{0x01}, []byte{0x02})
+	assert.Equal(t, ErrBlockFull, err)
+	assert.Len(t, block.appender.Records(), 5)
+
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+}
+
+func TestMissingFrom(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	source, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	local, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	ids, objs := writeTestObjects(t, source, 20)
+	// duplicate records in the source are only reported once
+	err = source.Write(ids[0], objs[0])
+	require.NoError(t, err)
+
+	var expected []common.ID
+	for i, id := range ids {
+		if i%3 == 0 {
+			expected = append(expected, id)
+			continue
+		}
+		err = local.Write(id, objs[i])
+		require.NoError(t, err)
+	}
+	// ids only in the local block are ignored
+	_, _ = writeTestObjects(t, local, 5)
+
+	sort.Slice(expected, func(i, j int) bool {
+		return bytes.Compare(expected[i], expected[j]) < 0
+	})
+
+	missing, err := local.MissingFrom(source)
+	require.NoError(t, err)
+	assert.Equal(t, expected, missing)
+
+	missing, err = source.MissingFrom(source)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+}
+
+func TestWithoutIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithoutIndex())
+	require.NoError(t, err)
+	indexed, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+
+	objects := 100
+	ids, objs := writeTestObjects(t, block, objects)
+	for i, id := range ids {
+		err = indexed.Write(id, objs[i])
+		require.NoError(t, err)
+	}
+
+	// pages are written but no records are held in memory
+	assert.Equal(t, objects, block.appender.Length())
+	assert.Equal(t, indexed.DataLength(), block.DataLength())
+	assert.Empty(t, block.appender.Records())
+	assert.Len(t, indexed.appender.Records(), objects)
+
+	_, err = block.Find(context.Background(), ids[0], &mockCombiner{})
+	assert.Equal(t, ErrNoIndex, err)
+	_, err = block.GetIteratorForIDs([]common.ID{ids[0]}, &mockCombiner{})
+	assert.Equal(t, ErrNoIndex, err)
+	assert.Equal(t, ErrNoIndex, block.ReindexForSearch())
+
+	// iterating rebuilds the index from the file
+	actual, err := block.ReadAll(&mockCombiner{})
+	require.NoError(t, err)
+	require.Len(t, actual, objects)
+	for i, id := range ids {
+		assert.Equal(t, objs[i], actual[hex.EncodeToString(id)])
+	}
+	assert.Equal(t, indexed.appender.Records(), block.appender.Records())
+
+	obj, err := block.Find(context.Background(), ids[0], &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, objs[0], obj)
+}
+
+func TestCompactionLevel(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	_, _ = writeTestObjects(t, block, 5)
+	assert.Equal(t, uint8(0), block.Meta().CompactionLevel)
+
+	// consolidate the block and a new level 0 block into a new one a few times
+	for i := 1; i <= 3; i++ {
+		fresh, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+		require.NoError(t, err)
+		_, _ = writeTestObjects(t, fresh, 2)
+
+		output, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+		require.NoError(t, err)
+		require.NoError(t, output.Combine(fresh, &mockCombiner{}))
+		assert.Equal(t, uint8(1), output.Meta().CompactionLevel)
+		require.NoError(t, output.Combine(block, &mockCombiner{}))
+		assert.Equal(t, uint8(i), output.Meta().CompactionLevel)
+
+		sidecarDir := filepath.Join(tempDir, output.BlockID().String())
+		require.NoError(t, os.MkdirAll(sidecarDir, os.ModePerm))
+		require.NoError(t, output.WriteMetaSidecar(sidecarDir))
+		bMeta, err := ioutil.ReadFile(filepath.Join(sidecarDir, backend.MetaName))
+		require.NoError(t, err)
+		actual := &backend.BlockMeta{}
+		require.NoError(t, json.Unmarshal(bMeta, actual))
+		assert.Equal(t, uint8(i), actual.CompactionLevel)
+
+		// the level is kept across replay
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(output.fullFilename()), tempDir)
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		assert.Equal(t, uint8(i), replayed.Meta().CompactionLevel)
+		require.NoError(t, replayed.CloseRead())
+
+		require.NoError(t, fresh.Clear())
+		require.NoError(t, block.Clear())
+		assert.NoFileExists(t, block.compactionLevelFilename())
+		block = output
+	}
+
+	// blocks created with a level store it too
+	leveled, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithCompactionLevel(5))
+	require.NoError(t, err)
+	_, _ = writeTestObjects(t, leveled, 1)
+	replayed, _, err := newAppendBlockFromFile(filepath.Base(leveled.fullFilename()), tempDir)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(5), replayed.Meta().CompactionLevel)
+	require.NoError(t, replayed.CloseRead())
+}
+
+func TestTempDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	// defaults to the wal path
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	f, err := block.createTemp("test")
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, tempDir, filepath.Dir(f.Name()))
+
+	scratch := filepath.Join(tempDir, "scratch")
+	err = os.MkdirAll(scratch, os.ModePerm)
+	require.NoError(t, err)
+
+	block, err = newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithTempDir(scratch))
+	require.NoError(t, err)
+	f, err = block.createTemp("test")
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, scratch, filepath.Dir(f.Name()))
+	assert.True(t, strings.HasPrefix(filepath.Base(f.Name()), "test"))
+}
+
+func TestMaxAge(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMaxAge(time.Minute), WithClock(clock))
+	require.NoError(t, err)
+
+	ids, objs := writeTestObjects(t, block, 1)
+
+	clock.advance(time.Minute)
+	_, _ = writeTestObjects(t, block, 1)
+
+	clock.advance(time.Second)
+	err = block.Write(ids[0], objs[0])
+	assert.Equal(t, ErrBlockExpired, err)
+	assert.Len(t, block.appender.Records(), 2)
+}
+
+func TestConcurrentWritesAndReads(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+
+	writers := 4
+	objectsPerWriter := 100
+
+	var written sync.Map
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < objectsPerWriter; i++ {
+				id := make([]byte, 16)
+				rand.Read(id)
+				obj := make([]byte, 100)
+				rand.Read(obj)
+
+				assert.NoError(t, block.Write(id, obj))
+				written.Store(string(id), obj)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				_ = block.DataLength()
+				_ = block.Meta()
+				written.Range(func(k, v interface{}) bool {
+					assert.True(t, block.Contains([]byte(k.(string))))
+					obj, err := block.Find(context.Background(), []byte(k.(string)), &mockCombiner{})
+					assert.NoError(t, err)
+					assert.Equal(t, v, obj)
+					return false
+				})
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	iter, err := block.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	defer iter.Close()
+
+	count := 0
+	for {
+		id, obj, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		expected, ok := written.Load(string(id))
+		require.True(t, ok)
+		assert.Equal(t, expected, obj)
+		count++
+	}
+	assert.Equal(t, writers*objectsPerWriter, count)
+}
+
+func TestVersion(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	_, err = newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithVersion("v0"))
+	assert.EqualError(t, err, "invalid wal version: v0 is not a valid block version")
+
+	_, err = New(&Config{Filepath: tempDir, Version: "v0"})
+	assert.Error(t, err)
+
+	// v2 is the only version available so this only confirms the version is threaded through
+	w, err := New(&Config{Filepath: tempDir, Encoding: backend.EncSnappy, Version: "v2"})
+	require.NoError(t, err)
+	block, err := w.NewBlock(uuid.New(), testTenantID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "v2", block.Meta().Version)
+	ids, objs := writeTestObjects(t, block, 5)
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, WithVersion("v0"))
+	require.NoError(t, err, "replay uses the version in the file name")
+	require.NoError(t, warning)
+	assert.Equal(t, "v2", replayed.Meta().Version)
+	for i, id := range ids {
+		obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+}
+
+func TestGetIteratorContext(t *testing.T) {
+	for name, getIterator := range map[string]func(*AppendBlock, context.Context) (encoding.Iterator, error){
+		"GetIterator": func(block *AppendBlock, ctx context.Context) (encoding.Iterator, error) {
+			return block.GetIterator(ctx, &mockCombiner{})
+		},
+		"GetIteratorWithReadAhead": func(block *AppendBlock, ctx context.Context) (encoding.Iterator, error) {
+			return block.GetIteratorWithReadAhead(ctx, &mockCombiner{}, 2)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+			require.NoError(t, err)
+			writeTestObjects(t, block, 5)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err = getIterator(block, ctx)
+			assert.Equal(t, context.Canceled, err)
+
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			iter, err := getIterator(block, ctx)
+			require.NoError(t, err)
+			defer iter.Close()
+
+			_, _, err = iter.Next(context.Background())
+			require.NoError(t, err)
+
+			cancel()
+			_, _, err = iter.Next(context.Background())
+			assert.Equal(t, context.Canceled, err)
+		})
+	}
+}
+
+func TestFull(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, block, 3)
+	length := block.DataLength()
+
+	tests := []struct {
+		name       string
+		maxBytes   uint64
+		maxObjects int
+		expected   bool
+	}{
+		{name: "no limits"},
+		{name: "bytes one below", maxBytes: length - 1, expected: true},
+		{name: "bytes exactly at", maxBytes: length, expected: true},
+		{name: "bytes one above", maxBytes: length + 1},
+		{name: "objects one below", maxObjects: 2, expected: true},
+		{name: "objects exactly at", maxObjects: 3, expected: true},
+		{name: "objects one above", maxObjects: 4},
+		{name: "either", maxBytes: length + 1, maxObjects: 3, expected: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, block.Full(tc.maxBytes, tc.maxObjects))
+		})
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMaxObjectSize(100))
+	require.NoError(t, err)
+
+	// writeTestObjects writes 100 byte objects
+	ids, _ := writeTestObjects(t, block, 2)
+
+	info, err := os.Stat(block.fullFilename())
+	require.NoError(t, err)
+	meta := block.Meta()
+
+	err = block.Write(ids[0], make([]byte, 101))
+	assert.Equal(t, ErrObjectTooLarge, err)
+
+	after, err := os.Stat(block.fullFilename())
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), after.Size())
+	assert.Equal(t, uint64(info.Size()), block.DataLength())
+	assert.Equal(t, meta, block.Meta())
+	assert.Len(t, block.appender.Records(), 2)
+}
+
+func TestGetIteratorWithReadAhead(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 50)
+	// a duplicate id is combined
+	require.NoError(t, block.Write(ids[0], objs[0]))
+
+	expected, err := block.ReadAll(&mockCombiner{})
+	require.NoError(t, err)
+
+	iter, err := block.GetIteratorWithReadAhead(context.Background(), &mockCombiner{}, 5)
+	require.NoError(t, err)
+
+	actual := map[string][]byte{}
+	for {
+		id, obj, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		actual[hex.EncodeToString(id)] = obj
+	}
+	iter.Close()
+	require.Len(t, actual, len(ids))
+	assert.Equal(t, expected, actual)
+
+	// closing early stops the read ahead goroutine
+	goroutines := runtime.NumGoroutine()
+	iter, err = block.GetIteratorWithReadAhead(context.Background(), &mockCombiner{}, 1)
+	require.NoError(t, err)
+	_, _, err = iter.Next(context.Background())
+	require.NoError(t, err)
+	iter.Close()
+	for start := time.Now(); runtime.NumGoroutine() > goroutines; time.Sleep(10 * time.Millisecond) {
+		require.Less(t, time.Since(start), 5*time.Second, "read ahead goroutine did not exit")
+	}
+}
+
+func BenchmarkGetIterator(b *testing.B) {
+	benchmarkGetIterator(b, func(block *AppendBlock) (encoding.Iterator, error) {
+		return block.GetIterator(context.Background(), &mockCombiner{})
+	})
+}
+
+func BenchmarkGetIteratorWithReadAhead(b *testing.B) {
+	benchmarkGetIterator(b, func(block *AppendBlock) (encoding.Iterator, error) {
+		return block.GetIteratorWithReadAhead(context.Background(), &mockCombiner{}, 1000)
+	})
+}
+
+func benchmarkGetIterator(b *testing.B, getIterator func(*AppendBlock) (encoding.Iterator, error)) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(b, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(b, err)
+	writeTestObjects(b, block, 100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter, err := getIterator(block)
+		require.NoError(b, err)
+		for {
+			_, _, err := iter.Next(context.Background())
+			if err == io.EOF {
+				break
+			}
+			require.NoError(b, err)
+		}
+		iter.Close()
+	}
+}
+
+func TestReset(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "v1", WithIndexCheckpoints(2))
+	require.NoError(t, err)
+	blockID := block.Meta().BlockID
+	appendFile := block.appendFile
+
+	oldIDs, _ := writeTestObjects(t, block, 5)
+	_, err = block.Find(context.Background(), oldIDs[0], &mockCombiner{})
+	require.NoError(t, err)
+
+	require.NoError(t, block.Reset())
+	assert.Same(t, appendFile, block.appendFile)
+	assert.Equal(t, uint64(0), block.DataLength())
+	assert.Equal(t, blockID, block.Meta().BlockID)
+	assert.Equal(t, "v1", block.Meta().DataEncoding)
+	assert.Equal(t, 0, block.Meta().TotalObjects)
+	assert.NoFileExists(t, block.checkpointFilename())
+	info, err := os.Stat(block.fullFilename())
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	ids, objs := writeTestObjects(t, block, 3)
+	obj, err := block.Find(context.Background(), oldIDs[0], &mockCombiner{})
+	require.NoError(t, err)
+	assert.Nil(t, obj)
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	// sealed blocks reopen the append file
+	iter, err := block.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	iter.Close()
+	require.NoError(t, block.Reset())
+	ids, _ = writeTestObjects(t, block, 2)
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Len(t, replayed.appender.Records(), len(ids))
+}
+
+func TestSizeMismatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	buf := &bytes.Buffer{}
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithLogger(log.NewLogfmtLogger(buf)))
+	require.NoError(t, err)
+	writeTestObjects(t, block, 5)
+
+	dataLength := block.DataLength()
+	require.NoError(t, os.Truncate(block.fullFilename(), int64(dataLength)-10))
+
+	_, err = block.GetIterator(context.Background(), &mockCombiner{})
+	var mismatch *ErrWALSizeMismatch
+	require.True(t, errors.As(err, &mismatch))
+	assert.Equal(t, int64(dataLength)-10, mismatch.FileSize)
+	assert.Equal(t, dataLength, mismatch.DataLength)
+	assert.Contains(t, buf.String(), "level=warn")
+	assert.Contains(t, buf.String(), fmt.Sprintf("dataLength=%d", dataLength))
+}
+
+func TestGetAppendOrderIterator(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 20)
+
+	readAll := func(block *AppendBlock) ([]common.ID, [][]byte) {
+		iter, err := block.GetAppendOrderIterator(&mockCombiner{})
+		require.NoError(t, err)
+		defer iter.Close()
+
+		var actualIDs []common.ID
+		var actualObjs [][]byte
+		for {
+			id, obj, err := iter.Next(context.Background())
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			actualIDs = append(actualIDs, append(common.ID(nil), id...))
+			actualObjs = append(actualObjs, append([]byte(nil), obj...))
+		}
+		return actualIDs, actualObjs
+	}
+
+	expectedIDs := make([]common.ID, 0, len(ids))
+	for _, id := range ids {
+		expectedIDs = append(expectedIDs, id)
+	}
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+
+	actualIDs, actualObjs := readAll(block)
+	assert.Equal(t, expectedIDs, actualIDs)
+	assert.Equal(t, objs, actualObjs)
+
+	actualIDs, actualObjs = readAll(replayed)
+	assert.Equal(t, expectedIDs, actualIDs)
+	assert.Equal(t, objs, actualObjs)
+}
+
+func TestGetRawIterator(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	ids, objs := makeTestBatch(5)
+	expected := map[string][][]byte{}
+	for i := range ids {
+		require.NoError(t, block.Write(ids[i], objs[i]))
+		expected[string(ids[i])] = append(expected[string(ids[i])], objs[i])
+	}
+	// write the first 3 ids again with other objects
+	_, duplicates := makeTestBatch(3)
+	for i := range duplicates {
+		require.NoError(t, block.Write(ids[i], duplicates[i]))
+		expected[string(ids[i])] = append(expected[string(ids[i])], duplicates[i])
+	}
+
+	readAll := func(iter encoding.Iterator) ([]common.ID, map[string][][]byte) {
+		defer iter.Close()
+
+		var actualIDs []common.ID
+		actual := map[string][][]byte{}
+		for {
+			id, obj, err := iter.Next(context.Background())
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			actualIDs = append(actualIDs, append(common.ID(nil), id...))
+			actual[string(id)] = append(actual[string(id)], append([]byte(nil), obj...))
+		}
+		return actualIDs, actual
+	}
+	sortObjs := func(m map[string][][]byte) {
+		for _, objs := range m {
+			sort.Slice(objs, func(i, j int) bool { return bytes.Compare(objs[i], objs[j]) < 0 })
+		}
+	}
+	sortObjs(expected)
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+
+	for _, b := range []*AppendBlock{block, replayed} {
+		iter, err := b.GetRawIterator(context.Background())
+		require.NoError(t, err)
+		actualIDs, actual := readAll(iter)
+		require.Len(t, actualIDs, 8)
+		assert.True(t, sort.SliceIsSorted(actualIDs, func(i, j int) bool { return bytes.Compare(actualIDs[i], actualIDs[j]) < 0 }))
+		sortObjs(actual)
+		assert.Equal(t, expected, actual)
+
+		iter, err = b.GetIterator(context.Background(), &mockCombiner{})
+		require.NoError(t, err)
+		actualIDs, _ = readAll(iter)
+		assert.Len(t, actualIDs, 5)
+	}
+
+	// blocks can not be appended to afterwards
+	assert.Error(t, block.Write(ids[0], objs[0]))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = block.GetRawIterator(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCombine(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	other, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithClock(clock))
+	require.NoError(t, err)
+	clock.advance(time.Minute)
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithClock(clock))
+	require.NoError(t, err)
+
+	ids, objs := makeTestBatch(8)
+	expected := map[string][]byte{}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, block.Write(ids[i], objs[i]))
+		expected[hex.EncodeToString(ids[i])] = objs[i]
+	}
+	// ids 3 and 4 are in both blocks, the longer objects of other win with mockCombiner
+	for i := 3; i < 8; i++ {
+		obj := append(append([]byte(nil), objs[i]...), objs[i]...)
+		require.NoError(t, other.Write(ids[i], obj))
+		expected[hex.EncodeToString(ids[i])] = obj
+	}
+	// and 7 is in other twice
+	require.NoError(t, other.Write(ids[7], objs[7]))
+
+	require.NoError(t, block.Combine(other, &mockCombiner{}))
+
+	meta := block.Meta()
+	assert.Equal(t, other.Meta().StartTime, meta.StartTime)
+	assert.Equal(t, 10, meta.TotalObjects)
+	for _, id := range ids {
+		assert.True(t, bytes.Compare(meta.MinID, id) <= 0)
+		assert.True(t, bytes.Compare(meta.MaxID, id) >= 0)
+	}
+
+	raw, err := block.GetRawIterator(context.Background())
+	require.NoError(t, err)
+	count := 0
+	for {
+		_, _, err := raw.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		count++
+	}
+	raw.Close()
+	assert.Equal(t, 10, count, "other's objects are combined before they are appended")
+
+	actual, err := block.ReadAll(&mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	// other is kept
+	assert.FileExists(t, other.fullFilename())
+	assert.Error(t, block.Combine(block, &mockCombiner{}))
+
+	v1, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "v1")
+	require.NoError(t, err)
+	assert.Error(t, v1.Combine(other, &mockCombiner{}))
+}
+
+func TestCombineIteratorError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	other, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	// write in id order so other's iterator fails after returning the first objects
+	ids, objs := makeTestBatch(6)
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i], ids[j]) < 0 })
+	var offsets []uint64
+	for i, id := range ids {
+		offset, _, err := other.WriteAt(id, objs[i])
+		require.NoError(t, err)
+		offsets = append(offsets, offset)
+	}
+	// corrupt the lengths at the start of the fourth page
+	f, err := os.OpenFile(other.fullFilename(), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 16), int64(offsets[3]))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	err = block.Combine(other, &mockCombiner{})
+	require.Error(t, err)
+	// the deduping iterator reads an object ahead so the error is returned after the first two objects
+	assert.Equal(t, 2, block.RecordCount(), "the objects before the error are kept")
+}
+
+func TestWritable(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	assert.True(t, block.Writable())
+	ids, objs := writeTestObjects(t, block, 3)
+	batchIDs := []common.ID{ids[0]}
+
+	replayed, _, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	assert.False(t, replayed.Writable())
+	assert.Equal(t, ErrBlockNotWritable, replayed.Write(ids[0], objs[0]))
+	assert.True(t, errors.Is(replayed.WriteBatch(batchIDs, objs[:1]), ErrBlockNotWritable))
+	assert.Equal(t, ErrBlockNotWritable, replayed.WriteReader(ids[0], bytes.NewReader(objs[0]), len(objs[0])))
+	replayed.closeReadFile()
+
+	resumed, _, err := ResumeAppendBlock(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	assert.True(t, resumed.Writable())
+	require.NoError(t, resumed.Close())
+	assert.False(t, resumed.Writable())
+
+	// sealed blocks are writable again once reset
+	iter, err := block.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	iter.Close()
+	assert.False(t, block.Writable())
+	assert.Equal(t, ErrBlockNotWritable, block.Write(ids[0], objs[0]))
+	require.NoError(t, block.Reset())
+	assert.True(t, block.Writable())
+
+	require.NoError(t, block.Clear())
+	assert.False(t, block.Writable())
+}
+
+func TestValidateWALFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncGZIP, "")
+	require.NoError(t, err)
+	writeTestObjects(t, block, 10)
+	filename := filepath.Base(block.fullFilename())
+
+	warning, err := ValidateWALFile(filename, tempDir)
+	require.NoError(t, err)
+	assert.NoError(t, warning)
+
+	appendGarbage(t, block.fullFilename())
+	warning, err = ValidateWALFile(filename, tempDir)
+	require.NoError(t, err)
+	assert.Error(t, warning)
+
+	// validation does not change the file and replay agrees with it
+	replayed, replayWarning, err := newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	assert.Error(t, replayWarning)
+	assert.Equal(t, 10, replayed.appender.Length())
+
+	_, err = ValidateWALFile("not-a-wal-file", tempDir)
+	assert.Error(t, err)
+
+	_, err = ValidateWALFile(filepath.Base(block.fullFilename())+"x", tempDir)
+	assert.Error(t, err)
+}
+
+func TestClose(t *testing.T) {
+	for _, opts := range [][]AppendBlockOption{nil, {WithIndexCheckpoints(2)}, {WithoutIndex()}} {
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		defer os.RemoveAll(tempDir)
+		require.NoError(t, err, "unexpected error creating temp dir")
+
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", opts...)
+		require.NoError(t, err)
+		ids, objs := writeTestObjects(t, block, 5)
+		seq, err := block.FlushBarrier()
+		require.NoError(t, err)
+
+		require.NoError(t, block.Close())
+		require.NoError(t, block.Close(), "closing twice is fine")
+		require.NoError(t, block.WaitFlushed(seq))
+		assert.FileExists(t, block.fullFilename())
+		assert.Nil(t, block.appendFile)
+		assert.Nil(t, block.readFile)
+		assert.Equal(t, ErrBlockClosed, block.Write(ids[0], objs[0]))
+
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, opts...)
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		assert.Equal(t, 5, replayed.appender.Length())
+		for i, id := range ids {
+			obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+			require.NoError(t, err)
+			assert.Equal(t, objs[i], obj)
+		}
+		replayed.closeReadFile()
+
+		// the closed block can still be read and reset
+		iter, err := block.GetIterator(context.Background(), &mockCombiner{})
+		require.NoError(t, err)
+		iter.Close()
+		require.NoError(t, block.Reset())
+		writeTestObjects(t, block, 1)
+		assert.Equal(t, 1, block.RecordCount())
+		require.NoError(t, block.Clear())
+	}
+}
+
+func TestClearRetriesRemove(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		exists   bool
+	}{
+		{
+			name:     "first remove fails",
+			failures: 1,
+		},
+		{
+			name:     "every remove fails",
+			failures: clearRemoveAttempts,
+			exists:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			buf := &bytes.Buffer{}
+			block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithLogger(log.NewLogfmtLogger(buf)))
+			require.NoError(t, err)
+			writeTestObjects(t, block, 5)
+			name := block.fullFilename()
+
+			failures := 0
+			removeFile = func(path string) error {
+				if path == name && failures < tc.failures {
+					failures++
+					return &os.PathError{Op: "remove", Path: path, Err: errors.New("file is in use")}
+				}
+				return os.Remove(path)
+			}
+			defer func() { removeFile = os.Remove }()
+
+			err = block.Clear()
+			assert.Equal(t, tc.failures, failures)
+
+			_, statErr := os.Stat(name)
+			if !tc.exists {
+				require.NoError(t, err)
+				assert.True(t, os.IsNotExist(statErr))
+				assert.Empty(t, buf.String())
+				return
+			}
+			assert.Contains(t, buf.String(), "level=error")
+			assert.Contains(t, buf.String(), "exists=true")
+
+			var clearErr *ErrClear
+			require.True(t, errors.As(err, &clearErr))
+			assert.Equal(t, name, clearErr.Filename)
+			assert.True(t, clearErr.Exists)
+			assert.Contains(t, err.Error(), name)
+			assert.NoError(t, statErr)
+		})
+	}
+}
+
+func TestClearRemovesWALFileAfterFailure(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	mirrorDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(mirrorDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithIndexCheckpoints(1), WithMirror(mirrorDir))
+	require.NoError(t, err)
+	writeTestObjects(t, block, 5)
+	checkpoint := block.checkpointFilename()
+	require.FileExists(t, checkpoint)
+
+	removeFile = func(path string) error {
+		if path == checkpoint {
+			return &os.PathError{Op: "remove", Path: path, Err: errors.New("file is in use")}
+		}
+		return os.Remove(path)
+	}
+	defer func() { removeFile = os.Remove }()
+
+	err = block.Clear()
+	var clearErr *ErrClear
+	require.True(t, errors.As(err, &clearErr))
+	assert.Equal(t, checkpoint, clearErr.Filename)
+	assert.FileExists(t, checkpoint)
+
+	// the wal file and its mirror are removed anyway
+	assert.NoFileExists(t, block.fullFilename())
+	assert.NoFileExists(t, block.mirrorFilename())
+}
+
+func TestWriteBatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	ids, objs := makeTestBatch(10)
+
+	batch, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithIndexCheckpoints(4))
+	require.NoError(t, err)
+	require.NoError(t, batch.WriteBatch(ids, objs))
+
+	sequential, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	for i := range ids {
+		require.NoError(t, sequential.Write(ids[i], objs[i]))
+	}
+
+	assert.Equal(t, sequential.appender.Records(), batch.appender.Records())
+	assert.Equal(t, sequential.DataLength(), batch.DataLength())
+	assert.Equal(t, sequential.Meta().MinID, batch.Meta().MinID)
+	assert.Equal(t, sequential.Meta().MaxID, batch.Meta().MaxID)
+	assert.Equal(t, len(ids), batch.Meta().TotalObjects)
+
+	// the batch crossed a checkpoint boundary so it is checkpointed as a whole
+	checkpointed, _, err := batch.loadCheckpoint(int64(batch.DataLength()))
+	require.NoError(t, err)
+	assert.Len(t, checkpointed, len(ids))
+
+	for i, id := range ids {
+		obj, err := batch.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	// objects before the failure are kept
+	full, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMaxRecords(7))
+	require.NoError(t, err)
+	require.NoError(t, full.Write(ids[0], objs[0]))
+
+	err = full.WriteBatch(ids[1:], objs[1:])
+	var batchErr *ErrWriteBatch
+	require.True(t, errors.As(err, &batchErr))
+	assert.Equal(t, 6, batchErr.Index)
+	assert.True(t, errors.Is(err, ErrBlockFull))
+	assert.Equal(t, 7, full.appender.Length())
+	assert.Equal(t, 7, full.Meta().TotalObjects)
+
+	assert.Error(t, batch.WriteBatch(ids, objs[1:]))
+}
+
+func TestWriteAt(t *testing.T) {
+	for _, opts := range [][]AppendBlockOption{nil, {WithPageFooters()}} {
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		defer os.RemoveAll(tempDir)
+		require.NoError(t, err, "unexpected error creating temp dir")
+
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", opts...)
+		require.NoError(t, err)
+
+		ids, objs := makeTestBatch(10)
+		written := map[string]common.Record{}
+		var end uint64
+		for i, id := range ids {
+			offset, length, err := block.WriteAt(id, objs[i])
+			require.NoError(t, err)
+			assert.Equal(t, end, offset)
+			end = offset + length
+			written[string(id)] = common.Record{ID: id, Start: offset, Length: uint32(length)}
+		}
+		assert.Equal(t, end, block.DataLength())
+
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, opts...)
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		records := replayed.appender.Records()
+		require.Len(t, records, len(ids))
+		for _, r := range records {
+			assert.Equal(t, written[string(r.ID)], r)
+		}
+
+		full, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMaxRecords(1))
+		require.NoError(t, err)
+		_, _, err = full.WriteAt(ids[0], objs[0])
+		require.NoError(t, err)
+		offset, length, err := full.WriteAt(ids[1], objs[1])
+		assert.Equal(t, ErrBlockFull, err)
+		assert.Zero(t, offset)
+		assert.Zero(t, length)
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	for _, opts := range [][]AppendBlockOption{nil, {WithPageFooters()}, {WithPageChecksums()}} {
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		defer os.RemoveAll(tempDir)
+		require.NoError(t, err, "unexpected error creating temp dir")
+
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", opts...)
+		require.NoError(t, err)
+
+		ids, objs := makeTestBatch(10)
+		records := make([]common.Record, 0, len(ids))
+		for i, id := range ids {
+			offset, length, err := block.WriteAt(id, objs[i])
+			require.NoError(t, err)
+			records = append(records, common.Record{ID: id, Start: offset, Length: uint32(length)})
+		}
+
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, opts...)
+		require.NoError(t, err)
+		require.NoError(t, warning)
+
+		for _, b := range []*AppendBlock{block, replayed} {
+			for i, r := range records {
+				obj, err := b.ReadAt(r.Start, uint64(r.Length))
+				require.NoError(t, err)
+				assert.Equal(t, objs[i], obj)
+			}
+
+			var offsetErr *ErrPageOffset
+			_, err = b.ReadAt(records[1].Start+1, uint64(records[1].Length))
+			assert.True(t, errors.As(err, &offsetErr))
+			_, err = b.ReadAt(records[1].Start, uint64(records[1].Length)+1)
+			assert.True(t, errors.As(err, &offsetErr))
+			_, err = b.ReadAt(block.DataLength(), uint64(records[1].Length))
+			assert.True(t, errors.As(err, &offsetErr))
+		}
+	}
+}
+
+func TestWriteReader(t *testing.T) {
+	for _, opts := range [][]AppendBlockOption{nil, {WithPageChecksums()}, {WithoutIndex()}} {
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		defer os.RemoveAll(tempDir)
+		require.NoError(t, err, "unexpected error creating temp dir")
+
+		ids, objs := makeTestBatch(10)
+
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", opts...)
+		require.NoError(t, err)
+		for i := range ids {
+			r := io.Reader(bytes.NewReader(objs[i]))
+			if i%2 == 1 {
+				// the block only reads size bytes
+				r = io.LimitReader(io.MultiReader(r, bytes.NewReader(objs[i])), int64(2*len(objs[i])))
+			}
+			require.NoError(t, block.WriteReader(ids[i], r, len(objs[i])))
+		}
+
+		// a short read appends nothing
+		dataLength := block.DataLength()
+		err = block.WriteReader(ids[0], io.LimitReader(bytes.NewReader(objs[0]), 1), len(objs[0]))
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+		assert.Equal(t, dataLength, block.DataLength())
+		assert.Equal(t, len(ids), block.Meta().TotalObjects)
+
+		sequential, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", opts...)
+		require.NoError(t, err)
+		for i := range ids {
+			require.NoError(t, sequential.Write(ids[i], objs[i]))
+		}
+		assert.Equal(t, sequential.DataLength(), block.DataLength())
+
+		iter, err := block.GetIterator(context.Background(), &mockCombiner{})
+		require.NoError(t, err)
+		actual := map[string][]byte{}
+		for {
+			id, obj, err := iter.Next(context.Background())
+			if err == io.EOF || id == nil {
+				break
+			}
+			require.NoError(t, err)
+			actual[string(id)] = obj
+		}
+		iter.Close()
+
+		require.Len(t, actual, len(ids))
+		for i, id := range ids {
+			assert.Equal(t, objs[i], actual[string(id)])
+		}
+	}
+
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMaxObjectSize(10))
+	require.NoError(t, err)
+	assert.Equal(t, ErrObjectTooLarge, block.WriteReader([]byte{0x01}, bytes.NewReader(make([]byte, 11)), 11))
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrite(b, func(block *AppendBlock, ids []common.ID, objs [][]byte) error {
+		for i := range ids {
+			err := block.Write(ids[i], objs[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkWrite(b, func(block *AppendBlock, ids []common.ID, objs [][]byte) error {
+		return block.WriteBatch(ids, objs)
+	})
+}
+
+func benchmarkWrite(b *testing.B, write func(*AppendBlock, []common.ID, [][]byte) error) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(b, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(b, err)
+	ids, objs := makeTestBatch(1000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = write(block, ids, objs)
+		require.NoError(b, err)
+	}
+}
+
+// makeTestBatch returns count random ids and objects
+func makeTestBatch(count int) ([]common.ID, [][]byte) {
+	ids := make([]common.ID, 0, count)
+	objs := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		id := make([]byte, 16)
+		rand.Read(id)
+		obj := make([]byte, 100)
+		rand.Read(obj)
+
+		ids = append(ids, id)
+		objs = append(objs, obj)
+	}
+
+	return ids, objs
+}
+
+func TestContains(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	ids, _ := writeTestObjects(t, block, 10)
+	missing := uuid.New()
+
+	for _, id := range ids {
+		assert.True(t, block.Contains(id))
+	}
+	assert.False(t, block.Contains(missing[:]))
+	assert.Nil(t, block.readFile, "the file is not opened")
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	for _, id := range ids {
+		assert.True(t, replayed.Contains(id))
+	}
+	assert.False(t, replayed.Contains(missing[:]))
+
+	require.NoError(t, block.Clear())
+	assert.False(t, block.Contains(ids[0]))
+}
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestAppendedTimes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	start := time.Unix(1000, 0)
+	clock := &fakeClock{now: start}
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithClock(clock))
+	require.NoError(t, err)
+	assert.True(t, block.AppendedStart().IsZero())
+	assert.True(t, block.AppendedEnd().IsZero())
+	assert.Equal(t, start, block.Meta().StartTime)
+
+	clock.advance(time.Second)
+	writeTestObjects(t, block, 1)
+	first := start.Add(time.Second)
+	assert.Equal(t, first, block.AppendedStart())
+	assert.Equal(t, first, block.AppendedEnd())
+
+	clock.advance(time.Second)
+	writeTestObjects(t, block, 1)
+	assert.Equal(t, first, block.AppendedStart())
+	assert.Equal(t, first.Add(time.Second), block.AppendedEnd())
+
+	clock.advance(time.Minute)
+	ids, objs := makeTestBatch(2)
+	require.NoError(t, block.WriteBatch(ids, objs))
+	last := first.Add(time.Second + time.Minute)
+	assert.Equal(t, first, block.AppendedStart())
+	assert.Equal(t, last, block.AppendedEnd())
+	assert.Equal(t, last, block.Meta().EndTime)
+	assert.Equal(t, BlockStats{
+		BlockID:       block.BlockID(),
+		Objects:       4,
+		DataLength:    block.DataLength(),
+		Encoding:      backend.EncNone,
+		AppendedStart: first,
+		AppendedEnd:   last,
+	}, block.Stats())
+
+	replayed, _, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	assert.True(t, replayed.AppendedStart().IsZero())
+
+	clock.advance(time.Hour)
+	require.NoError(t, block.Reset())
+	assert.True(t, block.AppendedStart().IsZero())
+	assert.True(t, block.AppendedEnd().IsZero())
+	assert.Equal(t, clock.now, block.Meta().StartTime)
+}
+
+func BenchmarkReplayLargeObjects(b *testing.B) {
+	for _, size := range []int{0, 640 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(b, err, "unexpected error creating temp dir")
+
+			block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+			require.NoError(b, err)
+			obj := make([]byte, 512*1024)
+			for i := 0; i < 100; i++ {
+				rand.Read(obj)
+				id := uuid.New()
+				require.NoError(b, block.Write(id[:], obj))
+			}
+			filename := filepath.Base(block.fullFilename())
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				replayed, warning, err := newAppendBlockFromFile(filename, tempDir, WithReplayBufferSize(size))
+				require.NoError(b, err)
+				require.NoError(b, warning)
+				replayed.closeReadFile()
+			}
+		})
+	}
+}
+
+func TestReplayBufferReuse(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	// alternate large and small pages so the buffer is reused for pages smaller than it
+	var ids [][]byte
+	var objs [][]byte
+	for i := 0; i < 20; i++ {
+		obj := make([]byte, 10+(i%2)*100000)
+		rand.Read(obj)
+		id := uuid.New()
+		require.NoError(t, block.Write(id[:], obj))
+		ids = append(ids, id[:])
+		objs = append(objs, obj)
+	}
+
+	for _, size := range []int{0, 16, 1024 * 1024} {
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, WithReplayBufferSize(size))
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		assert.Equal(t, block.appender.Records(), replayed.appender.Records())
+
+		for i, id := range ids {
+			obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+			require.NoError(t, err)
+			assert.Equal(t, objs[i], obj)
+		}
+		replayed.closeReadFile()
+	}
+}
+
+func TestRecordCountAndDataEncoding(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "v1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, block.RecordCount())
+	assert.Equal(t, "v1", block.DataEncoding())
+
+	writeTestObjects(t, block, 3)
+	assert.Equal(t, 3, block.RecordCount())
+	writeTestObjects(t, block, 2)
+	assert.Equal(t, 5, block.RecordCount())
+
+	replayed, _, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	assert.Equal(t, 5, replayed.RecordCount())
+	assert.Equal(t, "v1", replayed.DataEncoding())
+}
+
+func TestStats(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "v1")
+	require.NoError(t, err)
+	assert.Equal(t, BlockStats{
+		BlockID:      block.BlockID(),
+		Encoding:     backend.EncSnappy,
+		DataEncoding: "v1",
+	}, block.Stats())
+
+	writeTestObjects(t, block, 3)
+	ids, objs := makeTestBatch(2)
+	require.NoError(t, block.WriteBatch(ids, objs))
+	writeTestObjects(t, block, 1)
+
+	stats := block.Stats()
+	assert.Equal(t, block.BlockID(), stats.BlockID)
+	assert.Equal(t, 6, stats.Objects)
+	assert.Equal(t, block.RecordCount(), stats.Objects)
+	assert.Equal(t, block.DataLength(), stats.DataLength)
+	assert.NotZero(t, stats.DataLength)
+	assert.Equal(t, backend.EncSnappy, stats.Encoding)
+	assert.Equal(t, "v1", stats.DataEncoding)
+	assert.Equal(t, block.AppendedStart(), stats.AppendedStart)
+	assert.Equal(t, block.AppendedEnd(), stats.AppendedEnd)
+	assert.False(t, stats.AppendedStart.IsZero())
+}
+
+func TestGetSnapshotIterator(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+
+	count := func(iter encoding.Iterator) int {
+		defer iter.Close()
+		n := 0
+		for {
+			id, _, err := iter.Next(context.Background())
+			if err == io.EOF || id == nil {
+				break
+			}
+			require.NoError(t, err)
+			n++
+		}
+		return n
+	}
+
+	iter, err := block.GetSnapshotIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, count(iter))
+
+	writeTestObjects(t, block, 10)
+	iter, err = block.GetSnapshotIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+
+	// writes after the snapshot are not returned
+	ids, objs := writeTestObjects(t, block, 5)
+	assert.Equal(t, 10, count(iter))
+
+	iter, err = block.GetSnapshotIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, 15, count(iter))
+
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	iter, err = block.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, 15, count(iter))
+	assert.Error(t, block.Write(ids[0], objs[0]), "GetIterator seals the block")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = block.GetSnapshotIterator(ctx, &mockCombiner{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestErrBlockCleared(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	rawIDs, objs := writeTestObjects(t, block, 5)
+	ids := make([]common.ID, 0, len(rawIDs))
+	for _, id := range rawIDs {
+		ids = append(ids, id)
+	}
+	other, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	require.NoError(t, block.Clear())
+	require.NoError(t, block.Clear(), "clearing twice is fine")
+
+	ctx := context.Background()
+	returnsCleared := map[string]func() error{
+		"Write":      func() error { return block.Write(ids[0], objs[0]) },
+		"WriteBatch": func() error { return block.WriteBatch(ids, objs) },
+		"WriteReader": func() error {
+			return block.WriteReader(ids[0], bytes.NewReader(objs[0]), len(objs[0]))
+		},
+		"Import": func() error { return block.Import(nil, nil) },
+		"Close":  block.Close,
+		"Find": func() error {
+			_, err := block.Find(ctx, ids[0], &mockCombiner{})
+			return err
+		},
+		"FindAll": func() error {
+			_, err := block.FindAll(ids[0])
+			return err
+		},
+		"FindTrace": func() error {
+			_, err := block.FindTrace(ids[0], model.TraceCombiner)
+			return err
+		},
+		"ReadObjectRange": func() error {
+			_, err := block.ReadObjectRange(ids[0], 0, 1, &mockCombiner{})
+			return err
+		},
+		"ReadAll": func() error {
+			_, err := block.ReadAll(&mockCombiner{})
+			return err
+		},
+		"GetIterator": func() error {
+			_, err := block.GetIterator(ctx, &mockCombiner{})
+			return err
+		},
+		"GetIteratorWithReadAhead": func() error {
+			_, err := block.GetIteratorWithReadAhead(ctx, &mockCombiner{}, 10)
+			return err
+		},
+		"GetAppendOrderIterator": func() error {
+			_, err := block.GetAppendOrderIterator(&mockCombiner{})
+			return err
+		},
+		"GetSnapshotIterator": func() error {
+			_, err := block.GetSnapshotIterator(ctx, &mockCombiner{})
+			return err
+		},
+		"GetIteratorForIDs": func() error {
+			_, err := block.GetIteratorForIDs(ids, &mockCombiner{})
+			return err
+		},
+		"GetPeekingIterator": func() error {
+			_, err := block.GetPeekingIterator(&mockCombiner{})
+			return err
+		},
+		"GetTraceIterator": func() error {
+			_, err := block.GetTraceIterator(model.TraceCombiner)
+			return err
+		},
+		"Fingerprint": func() error {
+			_, err := block.Fingerprint()
+			return err
+		},
+		"MissingFrom": func() error {
+			_, err := other.MissingFrom(block)
+			return err
+		},
+		"ReindexForSearch": block.ReindexForSearch,
+		"WriteMetaSidecar": func() error { return block.WriteMetaSidecar(tempDir) },
+		"Checkpoint":       block.Checkpoint,
+		"Flush":            block.Flush,
+		"FlushBarrier": func() error {
+			_, err := block.FlushBarrier()
+			return err
+		},
+		"WaitFlushed": func() error { return block.WaitFlushed(1) },
+		"Prefetch":    block.Prefetch,
+		"Repair": func() error {
+			_, err := block.Repair()
+			return err
+		},
+		"SwapIn": func() error { return block.SwapIn(block.fullFilename()) },
+		"Reset":  block.Reset,
+	}
+
+	for name, fn := range returnsCleared {
+		t.Run(name, func(t *testing.T) {
+			err := fn()
+			assert.Equal(t, ErrBlockCleared, err)
+			assert.True(t, errors.Is(err, os.ErrClosed))
+		})
+	}
+
+	assert.False(t, block.Contains(ids[0]))
+}
+
+type filterIterator struct {
+	encoding.Iterator
+	keep func(common.ID) bool
+	seen *int
+}
+
+func (i *filterIterator) Next(ctx context.Context) (common.ID, []byte, error) {
+	for {
+		id, obj, err := i.Iterator.Next(ctx)
+		if id == nil || err != nil {
+			return id, obj, err
+		}
+
+		*i.seen++
+		if i.keep(id) {
+			return id, obj, nil
+		}
+	}
+}
+
+func TestGetIteratorDecorators(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	ids, objs := writeTestObjects(t, block, 20)
+	for i := range ids {
+		require.NoError(t, block.Write(ids[i], objs[i]))
+	}
+
+	keep := func(id common.ID) bool { return id[0]%2 == 0 }
+	expected := map[string]struct{}{}
+	for _, id := range ids {
+		if keep(id) {
+			expected[string(id)] = struct{}{}
+		}
+	}
+
+	var order []string
+	seen := 0
+	iter, err := block.GetIterator(context.Background(), &mockCombiner{},
+		func(iter encoding.Iterator) encoding.Iterator {
+			order = append(order, "filter")
+			return &filterIterator{Iterator: iter, keep: keep, seen: &seen}
+		},
+		func(iter encoding.Iterator) encoding.Iterator {
+			order = append(order, "second")
+			return iter
+		},
+	)
+	require.NoError(t, err)
+	defer iter.Close()
+	assert.Equal(t, []string{"filter", "second"}, order)
+
+	actual := map[string]struct{}{}
+	for {
+		id, _, err := iter.Next(context.Background())
+		if err == io.EOF || id == nil {
+			break
+		}
+		require.NoError(t, err)
+		require.True(t, keep(id))
+		_, ok := actual[string(id)]
+		require.False(t, ok, "ids are combined after decorators")
+		actual[string(id)] = struct{}{}
+	}
+
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, 2*len(ids), seen, "decorators see every record")
+}
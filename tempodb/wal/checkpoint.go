@@ -0,0 +1,210 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// checkpointDir is the folder in the wal path that holds index checkpoints. It is a folder so the checkpoints
+// are skipped when rescanning blocks.
+const checkpointDir = "checkpoints"
+
+// An index checkpoint file is a series of entries, each holding the records appended since the previous entry.
+// dataLength is the length of the data file covered by the checkpoint once the entry is applied. The crc covers
+// the payload so a torn entry at the end of the file is detected and ignored.
+//
+//	|  32 bits  | 32 bits |  64 bits   | per record:  32 bits | id | 64 bits | 32 bits |
+//	| payload   |   crc   | dataLength |              id len  |    |  start  | length  |
+const checkpointEntryHeaderLength = 8
+
+var (
+	errCheckpointTorn = errors.New("index checkpoint entry is incomplete")
+)
+
+// Checkpoint appends the records written since the last checkpoint to the block's index checkpoint file. On
+// replay the checkpoint is loaded and only the part of the data file written after the last complete checkpoint
+// is replayed.
+func (a *AppendBlock) Checkpoint() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	return a.checkpoint()
+}
+
+func (a *AppendBlock) checkpoint() error {
+	if a.appendFile == nil {
+		return common.ErrUnsupported
+	}
+
+	dataLength := a.appender.DataLength()
+	if dataLength == a.checkpointedLength {
+		return nil
+	}
+
+	var records []common.Record
+	for _, r := range a.appender.Records() {
+		if r.Start >= a.checkpointedLength {
+			records = append(records, r)
+		}
+	}
+
+	if a.checkpointFile == nil {
+		err := os.MkdirAll(filepath.Dir(a.checkpointFilename()), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		a.checkpointFile, err = os.OpenFile(a.checkpointFilename(), os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, a.fileMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := a.checkpointFile.Write(marshalCheckpointEntry(records, dataLength))
+	if err != nil {
+		return err
+	}
+
+	a.checkpointedLength = dataLength
+	return nil
+}
+
+// maybeCheckpoint checkpoints after every checkpointEvery records, previousRecords is the record count before the
+// last write. Failures are logged, the records are still
+// in the data file and will be replayed from there.
+func (a *AppendBlock) maybeCheckpoint(previousRecords int) {
+	if a.checkpointEvery <= 0 || a.records/a.checkpointEvery == previousRecords/a.checkpointEvery {
+		return
+	}
+
+	err := a.checkpoint()
+	if err != nil {
+		level.Warn(a.logger).Log("msg", "failed to checkpoint wal index", "block", a.meta.BlockID, "err", err)
+	}
+}
+
+func (a *AppendBlock) checkpointFilename() string {
+	return filepath.Join(a.filepath, checkpointDir, filepath.Base(a.fullFilename()))
+}
+
+// loadCheckpoint returns the records and covered data length from the block's checkpoint file. Entries after the
+// first incomplete or corrupt entry are ignored. Returns no records if there is no checkpoint.
+func (a *AppendBlock) loadCheckpoint(dataFileSize int64) ([]common.Record, uint64, error) {
+	b, err := ioutil.ReadFile(a.checkpointFilename())
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var records []common.Record
+	var dataLength uint64
+	for len(b) > 0 {
+		entryRecords, entryDataLength, n, err := unmarshalCheckpointEntry(b)
+		if err != nil {
+			level.Warn(a.logger).Log("msg", "ignoring wal index checkpoint tail", "file", a.checkpointFilename(), "dataLength", dataLength, "err", err)
+			break
+		}
+		if entryDataLength > uint64(dataFileSize) {
+			level.Warn(a.logger).Log("msg", "wal index checkpoint beyond end of data file", "file", a.checkpointFilename(), "dataLength", entryDataLength, "size", dataFileSize)
+			break
+		}
+
+		records = append(records, entryRecords...)
+		dataLength = entryDataLength
+		b = b[n:]
+	}
+
+	return records, dataLength, nil
+}
+
+func (a *AppendBlock) closeCheckpointFile() {
+	if a.checkpointFile != nil {
+		_ = a.checkpointFile.Close()
+		a.checkpointFile = nil
+	}
+}
+
+func marshalCheckpointEntry(records []common.Record, dataLength uint64) []byte {
+	payloadLength := 8
+	for _, r := range records {
+		payloadLength += 4 + len(r.ID) + 8 + 4
+	}
+
+	b := make([]byte, checkpointEntryHeaderLength+payloadLength)
+	payload := b[checkpointEntryHeaderLength:]
+	binary.LittleEndian.PutUint64(payload, dataLength)
+	cursor := 8
+	for _, r := range records {
+		binary.LittleEndian.PutUint32(payload[cursor:], uint32(len(r.ID)))
+		cursor += 4
+		cursor += copy(payload[cursor:], r.ID)
+		binary.LittleEndian.PutUint64(payload[cursor:], r.Start)
+		cursor += 8
+		binary.LittleEndian.PutUint32(payload[cursor:], r.Length)
+		cursor += 4
+	}
+
+	binary.LittleEndian.PutUint32(b, uint32(payloadLength))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+	return b
+}
+
+// unmarshalCheckpointEntry returns the records and data length of the first entry in b and the length of the entry
+func unmarshalCheckpointEntry(b []byte) ([]common.Record, uint64, int, error) {
+	if len(b) < checkpointEntryHeaderLength {
+		return nil, 0, 0, errCheckpointTorn
+	}
+	payloadLength := int(binary.LittleEndian.Uint32(b))
+	if len(b) < checkpointEntryHeaderLength+payloadLength {
+		return nil, 0, 0, errCheckpointTorn
+	}
+
+	payload := b[checkpointEntryHeaderLength : checkpointEntryHeaderLength+payloadLength]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(b[4:]) {
+		return nil, 0, 0, errors.New("index checkpoint entry crc mismatch")
+	}
+	if len(payload) < 8 {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+
+	dataLength := binary.LittleEndian.Uint64(payload)
+	var records []common.Record
+	for cursor := 8; cursor < len(payload); {
+		if len(payload) < cursor+4 {
+			return nil, 0, 0, io.ErrUnexpectedEOF
+		}
+		idLength := int(binary.LittleEndian.Uint32(payload[cursor:]))
+		cursor += 4
+		if len(payload) < cursor+idLength+12 {
+			return nil, 0, 0, fmt.Errorf("index checkpoint record out of bounds at %d", cursor)
+		}
+
+		r := common.Record{
+			ID: append([]byte(nil), payload[cursor:cursor+idLength]...),
+		}
+		cursor += idLength
+		r.Start = binary.LittleEndian.Uint64(payload[cursor:])
+		cursor += 8
+		r.Length = binary.LittleEndian.Uint32(payload[cursor:])
+		cursor += 4
+
+		records = append(records, r)
+	}
+
+	return records, dataLength, checkpointEntryHeaderLength + payloadLength, nil
+}
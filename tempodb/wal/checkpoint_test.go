@@ -0,0 +1,162 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+// writeCheckpointedBlock writes 100 checkpointed objects followed by 5 that are not and corrupts the first
+// page of the data file. A full replay stops at the corrupt page so only a replay that uses the checkpoint
+// finds every object.
+func writeCheckpointedBlock(t *testing.T, tempDir string, opts ...AppendBlockOption) (*AppendBlock, [][]byte, [][]byte) {
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", append([]AppendBlockOption{WithIndexCheckpoints(10)}, opts...)...)
+	require.NoError(t, err)
+
+	ids, objs := writeTestObjects(t, block, 105)
+	assert.FileExists(t, block.checkpointFilename())
+
+	f, err := os.OpenFile(block.fullFilename(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x01, 0x00, 0x00, 0x00}, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	return block, ids, objs
+}
+
+func TestCheckpointReplay(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []AppendBlockOption
+	}{
+		{name: "default"},
+		{name: "footers", opts: []AppendBlockOption{WithPageFooters()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			block, ids, objs := writeCheckpointedBlock(t, tempDir, tc.opts...)
+
+			replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, tc.opts...)
+			require.NoError(t, err)
+			require.NoError(t, warning)
+			require.Equal(t, len(ids), replayed.appender.Length())
+
+			for i, id := range ids[1:] {
+				obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+				require.NoError(t, err)
+				assert.Equal(t, objs[i+1], obj)
+			}
+
+			// checkpoints are removed with the block
+			require.NoError(t, replayed.Clear())
+			assert.NoFileExists(t, block.checkpointFilename())
+		})
+	}
+}
+
+func TestCheckpointTornTail(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, ids, _ := writeCheckpointedBlock(t, tempDir)
+
+	// entries are all the same size. tear the last one and corrupt the one before it
+	info, err := os.Stat(block.checkpointFilename())
+	require.NoError(t, err)
+	entryLength := info.Size() / 10
+	err = os.Truncate(block.checkpointFilename(), info.Size()-entryLength/2)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(block.checkpointFilename(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x00, 0x01}, 9*entryLength-4)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the first 8 entries cover the corrupt page, the rest of the file is replayed
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	require.Equal(t, len(ids), replayed.appender.Length())
+
+	// with the checkpoint fully torn the full replay stops at the corrupt page
+	err = os.Truncate(block.checkpointFilename(), 3)
+	require.NoError(t, err)
+	replayed, warning, err = newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	assert.Error(t, warning)
+	assert.Equal(t, 0, replayed.appender.Length())
+}
+
+func TestCheckpointNoNewRecords(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	// nothing to checkpoint
+	require.NoError(t, block.Checkpoint())
+	assert.NoFileExists(t, block.checkpointFilename())
+
+	_, _ = writeTestObjects(t, block, 5)
+	require.NoError(t, block.Checkpoint())
+	info, err := os.Stat(block.checkpointFilename())
+	require.NoError(t, err)
+
+	require.NoError(t, block.Checkpoint())
+	after, err := os.Stat(block.checkpointFilename())
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), after.Size())
+}
+
+func TestCheckpointCorruptPageAfter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithIndexCheckpoints(10))
+	require.NoError(t, err)
+
+	// the checkpoint holds its records in id order, write the highest id first so it does not end the checkpoint
+	ids, objs := makeTestBatch(11)
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i], ids[j]) > 0 })
+	for i, id := range ids {
+		require.NoError(t, block.Write(id, objs[i]))
+	}
+	checkpointed, checkpointedLength, err := block.loadCheckpoint(int64(block.DataLength()))
+	require.NoError(t, err)
+	require.Len(t, checkpointed, 10)
+
+	// corrupt the page written after the checkpoint
+	f, err := os.OpenFile(block.fullFilename(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x01, 0x00, 0x00, 0x00}, int64(checkpointedLength))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.Error(t, warning)
+	assert.Equal(t, 10, replayed.appender.Length())
+
+	result := replayed.ReplayResult()
+	assert.Equal(t, checkpointedLength, result.TruncatedAtOffset)
+	assert.Equal(t, block.DataLength()-checkpointedLength, result.SkippedBytes)
+}
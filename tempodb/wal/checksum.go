@@ -0,0 +1,29 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cespare/xxhash"
+)
+
+const checksumChunkSize = 1024 * 1024
+
+// ChecksumFile returns the xxhash of the wal file filename in path. The file is streamed in fixed size
+// chunks so large files can be checksummed without reading them into memory.
+func ChecksumFile(filename, path string) (uint64, error) {
+	f, err := os.Open(filepath.Join(path, filename))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := xxhash.New()
+	_, err = io.CopyBuffer(h, f, make([]byte, checksumChunkSize))
+	if err != nil {
+		return 0, err
+	}
+
+	return h.Sum64(), nil
+}
@@ -0,0 +1,39 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cespare/xxhash"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestChecksumFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	// enough objects to span several chunks
+	_, _ = writeTestObjects(t, block, 25000)
+
+	filename := filepath.Base(block.fullFilename())
+	actual, err := ChecksumFile(filename, tempDir)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(block.fullFilename())
+	require.NoError(t, err)
+	require.Greater(t, len(data), checksumChunkSize)
+	assert.Equal(t, xxhash.Sum64(data), actual)
+
+	_, err = ChecksumFile("missing", tempDir)
+	assert.Error(t, err)
+}
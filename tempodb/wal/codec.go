@@ -0,0 +1,135 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/grafana/tempo/tempodb/backend"
+	v2 "github.com/grafana/tempo/tempodb/encoding/v2"
+)
+
+// customEncodingPrefix prefixes the codec name in the encoding segment of the file name of blocks written
+// with a registered Codec. i.e. <blockID>:<tenantID>:v2:custom-<codec>:<dataEncoding>
+const customEncodingPrefix = "custom-"
+
+// Codec compresses wal pages. Codecs are registered by name with RegisterCodec and used by blocks created
+// WithCodec in place of the block's backend.Encoding. The codec name is stored in the file name so replay
+// uses the same codec, it must be registered before replaying.
+type Codec interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	codecsMtx sync.RWMutex
+	codecs    = map[string]Codec{}
+)
+
+// RegisterCodec makes codec available to blocks by name
+func RegisterCodec(name string, codec Codec) error {
+	if name == "" || !validFilenameField(name) {
+		return fmt.Errorf("codec name %s is invalid", name)
+	}
+
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+
+	if _, ok := codecs[name]; ok {
+		return fmt.Errorf("codec %s is already registered", name)
+	}
+	codecs[name] = codec
+	return nil
+}
+
+func getCodec(name string) (Codec, error) {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("codec %s is not registered", name)
+	}
+	return codec, nil
+}
+
+// codecFromFilename returns the codec name from a wal file name or "" if it uses a backend.Encoding
+func codecFromFilename(name string) string {
+	splits := strings.Split(name, ":")
+	if len(splits) < 4 || !strings.HasPrefix(splits[3], customEncodingPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(splits[3], customEncodingPrefix)
+}
+
+// codecPool adapts a Codec to the v2 compression pools. The codec operates on whole pages so writers buffer
+// the page until it is closed and readers decompress the full page up front.
+type codecPool struct {
+	codec Codec
+}
+
+var _ v2.WriterPool = (*codecPool)(nil)
+var _ v2.ReaderPool = (*codecPool)(nil)
+
+func (p *codecPool) GetWriter(dst io.Writer) (io.WriteCloser, error) {
+	return &codecWriter{codec: p.codec, dst: dst}, nil
+}
+
+func (p *codecPool) PutWriter(io.WriteCloser) {}
+
+func (p *codecPool) ResetWriter(dst io.Writer, resetWriter io.WriteCloser) (io.WriteCloser, error) {
+	w := resetWriter.(*codecWriter)
+	w.dst = dst
+	w.buffer = w.buffer[:0]
+	return w, nil
+}
+
+func (p *codecPool) GetReader(src io.Reader) (io.Reader, error) {
+	compressed, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, err := p.codec.Decompress(compressed)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(decompressed), nil
+}
+
+func (p *codecPool) PutReader(io.Reader) {}
+
+func (p *codecPool) ResetReader(src io.Reader, _ io.Reader) (io.Reader, error) {
+	return p.GetReader(src)
+}
+
+// Encoding is the encoding of the v2 pool interfaces. Pages are stored as compressed by the codec.
+func (p *codecPool) Encoding() backend.Encoding {
+	return backend.EncNone
+}
+
+type codecWriter struct {
+	codec  Codec
+	dst    io.Writer
+	buffer []byte
+}
+
+func (w *codecWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	return len(p), nil
+}
+
+// Close compresses the buffered page to dst
+func (w *codecWriter) Close() error {
+	compressed, err := w.codec.Compress(w.buffer)
+	if err != nil {
+		return err
+	}
+	w.buffer = w.buffer[:0]
+
+	_, err = w.dst.Write(compressed)
+	return err
+}
@@ -0,0 +1,86 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+// xorCodec is a trivial codec that flips every bit
+type xorCodec struct{}
+
+func (xorCodec) Compress(src []byte) ([]byte, error) {
+	return xor(src), nil
+}
+
+func (xorCodec) Decompress(src []byte) ([]byte, error) {
+	return xor(src), nil
+}
+
+func xor(src []byte) []byte {
+	dst := make([]byte, len(src))
+	for i, b := range src {
+		dst[i] = b ^ 0xff
+	}
+	return dst
+}
+
+func TestCodec(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	err = RegisterCodec("xor", xorCodec{})
+	require.NoError(t, err)
+	assert.Error(t, RegisterCodec("xor", xorCodec{}), "already registered")
+	assert.Error(t, RegisterCodec("x:or", xorCodec{}), "invalid name")
+
+	_, err = newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithCodec("missing"))
+	assert.Error(t, err)
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "v1", WithCodec("xor"))
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 20)
+
+	filename := filepath.Base(block.fullFilename())
+	assert.Equal(t, block.meta.BlockID.String()+":"+testTenantID+":v2:custom-xor:v1", filename)
+	assert.True(t, IsWALFile(filename))
+	assert.Equal(t, backend.EncNone, block.Meta().Encoding)
+
+	// confirm the codec was applied
+	raw, err := ioutil.ReadFile(block.fullFilename())
+	require.NoError(t, err)
+	assert.False(t, strings.Contains(string(raw), string(objs[0])))
+
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	// replay resolves the codec from the file name
+	replayed, warning, err := newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Equal(t, len(ids), replayed.appender.Length())
+	for i, id := range ids {
+		obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	// unregistered codecs fail replay
+	err = os.Rename(block.fullFilename(), filepath.Join(tempDir, strings.Replace(filename, "custom-xor", "custom-unknown", 1)))
+	require.NoError(t, err)
+	_, _, err = newAppendBlockFromFile(strings.Replace(filename, "custom-xor", "custom-unknown", 1), tempDir)
+	assert.Error(t, err)
+}
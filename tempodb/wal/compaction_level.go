@@ -0,0 +1,74 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// compactionLevelSuffix is appended to the name of a block's checkpoint for the file storing its compaction level.
+// The level is not part of the wal file name so it is kept next to the checkpoint, which is also skipped when
+// rescanning blocks.
+const compactionLevelSuffix = ".level"
+
+func (a *AppendBlock) compactionLevelFilename() string {
+	return a.checkpointFilename() + compactionLevelSuffix
+}
+
+// writeCompactionLevel stores the block's compaction level so replay restores it. Nothing is stored for level 0.
+func (a *AppendBlock) writeCompactionLevel() error {
+	name := a.compactionLevelFilename()
+	if a.meta.CompactionLevel == 0 {
+		err := os.Remove(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	err := os.MkdirAll(filepath.Dir(name), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it so a crash leaves either level
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(strconv.Itoa(int(a.meta.CompactionLevel)))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// loadCompactionLevel restores the compaction level stored by writeCompactionLevel. The level passed
+// WithCompactionLevel is kept if none is stored.
+func (a *AppendBlock) loadCompactionLevel() error {
+	b, err := ioutil.ReadFile(a.compactionLevelFilename())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	level, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 8)
+	if err != nil {
+		return err
+	}
+	a.meta.CompactionLevel = uint8(level)
+	return nil
+}
@@ -0,0 +1,209 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+const (
+	// completeFlushSizeBytes is the amount of data Complete buffers before flushing it to the backend
+	completeFlushSizeBytes = 30 * 1024 * 1024 // 30 MiB
+
+	// estimateSampleObjects is the number of objects EstimatedCompletedSize compresses to estimate the block's size
+	estimateSampleObjects = 100
+)
+
+// ErrObjectCountMismatch is returned by Complete WithVerifiedObjectCount when the TotalObjects of the block's meta is not
+// the number of objects read from its file
+type ErrObjectCountMismatch struct {
+	TotalObjects int
+	Objects      int
+}
+
+func (e *ErrObjectCountMismatch) Error() string {
+	return fmt.Sprintf("wal block meta has %d total objects but %d objects were read", e.TotalObjects, e.Objects)
+}
+
+// Complete writes the block's objects, combined with combiner, to a new backend block with the same id using w and
+// returns its meta. The block can not be appended to afterwards, even if completing it fails.
+func (a *AppendBlock) Complete(ctx context.Context, cfg *encoding.BlockConfig, w backend.Writer,
+	combiner common.ObjectCombiner) (*backend.BlockMeta, error) {
+	// seal the block before anything can fail so it is not appended to after a failed Complete
+	a.mtx.Lock()
+	err := ErrBlockCleared
+	if !a.cleared {
+		err = a.seal()
+	}
+	a.mtx.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error sealing completing block: %w", err)
+	}
+
+	err = encoding.ValidateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block config: %w", err)
+	}
+
+	meta := a.Meta()
+	if a.verifyObjectCount {
+		err = a.verifyTotalObjects(ctx, meta.TotalObjects)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	iter, err := a.GetIterator(ctx, combiner)
+	if err != nil {
+		return nil, fmt.Errorf("error getting completing block iterator: %w", err)
+	}
+	defer iter.Close()
+
+	newBlock, err := encoding.NewStreamingBlock(cfg, meta.BlockID, meta.TenantID, []*backend.BlockMeta{meta}, meta.TotalObjects)
+	if err != nil {
+		return nil, fmt.Errorf("error creating streaming block: %w", err)
+	}
+
+	var tracker backend.AppendTracker
+	for {
+		id, obj, err := iter.Next(ctx)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error iterating: %w", err)
+		}
+		if id == nil {
+			break
+		}
+
+		err = newBlock.AddObject(id, obj)
+		if err != nil {
+			return nil, fmt.Errorf("error adding object to streaming block: %w", err)
+		}
+
+		if newBlock.CurrentBufferLength() > completeFlushSizeBytes {
+			tracker, _, err = newBlock.FlushBuffer(ctx, tracker, w)
+			if err != nil {
+				return nil, fmt.Errorf("error flushing streaming block: %w", err)
+			}
+		}
+	}
+
+	_, err = newBlock.Complete(ctx, tracker, w)
+	if err != nil {
+		return nil, fmt.Errorf("error completing streaming block: %w", err)
+	}
+
+	return newBlock.BlockMeta(), nil
+}
+
+// verifyTotalObjects counts the objects of the block without combining them and returns an *ErrObjectCountMismatch if
+// there are not totalObjects
+func (a *AppendBlock) verifyTotalObjects(ctx context.Context, totalObjects int) error {
+	iter, err := a.GetRawIterator(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting block iterator to verify object count: %w", err)
+	}
+	defer iter.Close()
+
+	objects := 0
+	for {
+		id, _, err := iter.Next(ctx)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error iterating to verify object count: %w", err)
+		}
+		if id == nil {
+			break
+		}
+		objects++
+	}
+
+	if objects != totalObjects {
+		return &ErrObjectCountMismatch{TotalObjects: totalObjects, Objects: objects}
+	}
+	return nil
+}
+
+// EstimatedCompletedSize estimates the size of the data of the backend block Complete would create with the block's
+// encoding. Wal pages usually hold a single object while backend pages hold many, so up to 100 objects spread across
+// the block are compressed together and their ratio to their share of the wal pages is applied to DataLength.
+// Objects with the same id are not combined and the index and bloom filters are not included. If the sample can not
+// be read DataLength is returned.
+func (a *AppendBlock) EstimatedCompletedSize() uint64 {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	dataLength := a.appender.DataLength()
+	records := a.appender.Records()
+	if len(records) == 0 {
+		return dataLength
+	}
+
+	sampled, compressed, err := a.compressSample(records)
+	if err != nil || sampled == 0 {
+		return dataLength
+	}
+
+	return uint64(float64(dataLength) * float64(compressed) / float64(sampled))
+}
+
+// compressSample reads up to estimateSampleObjects of records and writes them to a single page with the block's
+// encoding. It returns the length of the sampled objects' share of their wal pages and of the page they were compressed
+// to.
+func (a *AppendBlock) compressSample(records []common.Record) (uint64, int, error) {
+	file, err := a.file()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	dataReader, err := a.newDataReader(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dataReader.Close()
+
+	dataWriter, err := a.encoding.NewDataWriter(ioutil.Discard, a.meta.Encoding)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dataWriter.Complete()
+
+	step := 1
+	if len(records) > estimateSampleObjects {
+		step = len(records) / estimateSampleObjects
+	}
+
+	// records of a page written WithBatchedPages share it, each is charged an equal part of the page
+	pageRecords := make(map[uint64]uint64, len(records))
+	for _, r := range records {
+		pageRecords[r.Start]++
+	}
+
+	objectRW := a.encoding.NewObjectReaderWriter()
+	var sampled uint64
+	var pages [][]byte
+	var buffer []byte
+	for i := 0; i < len(records); i += step {
+		var obj []byte
+		obj, pages, buffer, err = readRecordObject(context.Background(), dataReader, objectRW, records[i], pages, buffer)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		_, err = dataWriter.Write(records[i].ID, obj)
+		if err != nil {
+			return 0, 0, err
+		}
+		sampled += uint64(records[i].Length) / pageRecords[records[i].Start]
+	}
+
+	compressed, err := dataWriter.CutPage()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return sampled, compressed, nil
+}
@@ -0,0 +1,239 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/backend/local"
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+func TestComplete(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	backendDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(backendDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	rawR, rawW, _, err := local.New(&local.Config{
+		Path: backendDir,
+	})
+	require.NoError(t, err)
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "v1")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 20)
+	// duplicates are combined
+	require.NoError(t, block.Write(ids[0], objs[0]))
+
+	cfg := &encoding.BlockConfig{
+		IndexDownsampleBytes: 1000,
+		IndexPageSizeBytes:   1000,
+		BloomFP:              0.01,
+		BloomShardSizeBytes:  100,
+		Encoding:             backend.EncZstd,
+	}
+	meta, err := block.Complete(context.Background(), cfg, backend.NewWriter(rawW), &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, block.Meta().BlockID, meta.BlockID)
+	assert.Equal(t, testTenantID, meta.TenantID)
+	assert.Equal(t, "v1", meta.DataEncoding)
+	assert.Equal(t, backend.EncZstd, meta.Encoding)
+	assert.Equal(t, len(ids), meta.TotalObjects)
+
+	assert.Error(t, block.Write(ids[0], objs[0]), "completed blocks are sealed")
+
+	backendBlock, err := encoding.NewBackendBlock(meta, backend.NewReader(rawR))
+	require.NoError(t, err)
+	for i, id := range ids {
+		obj, err := backendBlock.Find(context.Background(), id)
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	_, err = block.Complete(context.Background(), &encoding.BlockConfig{}, backend.NewWriter(rawW), &mockCombiner{})
+	assert.Error(t, err, "invalid config")
+}
+
+func TestCompleteSealsOnError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	backendDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(backendDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	_, rawW, _, err := local.New(&local.Config{
+		Path: backendDir,
+	})
+	require.NoError(t, err)
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 5)
+
+	_, err = block.Complete(context.Background(), &encoding.BlockConfig{}, backend.NewWriter(rawW), &mockCombiner{})
+	require.Error(t, err, "invalid config")
+	assert.Equal(t, ErrBlockNotWritable, block.Write(ids[0], objs[0]))
+	assert.False(t, block.Writable())
+
+	// the objects written before are still read
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+}
+
+func TestCompleteVerifiedObjectCount(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	backendDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(backendDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	_, rawW, _, err := local.New(&local.Config{
+		Path: backendDir,
+	})
+	require.NoError(t, err)
+
+	cfg := &encoding.BlockConfig{
+		IndexDownsampleBytes: 1000,
+		IndexPageSizeBytes:   1000,
+		BloomFP:              0.01,
+		BloomShardSizeBytes:  100,
+		Encoding:             backend.EncZstd,
+	}
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithVerifiedObjectCount())
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 10)
+	// duplicates are counted before combining
+	require.NoError(t, block.Write(ids[0], objs[0]))
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, WithVerifiedObjectCount())
+	require.NoError(t, err)
+	require.NoError(t, warning)
+
+	replayed.meta.TotalObjects++
+	_, err = replayed.Complete(context.Background(), cfg, backend.NewWriter(rawW), &mockCombiner{})
+	var mismatch *ErrObjectCountMismatch
+	require.True(t, errors.As(err, &mismatch))
+	assert.Equal(t, ErrBlockNotWritable, replayed.Write(ids[0], objs[0]))
+	assert.Equal(t, len(ids)+2, mismatch.TotalObjects)
+	assert.Equal(t, len(ids)+1, mismatch.Objects)
+
+	// nothing was written for the mismatched block
+	_, err = os.Stat(filepath.Join(backendDir, testTenantID, replayed.meta.BlockID.String()))
+	assert.True(t, os.IsNotExist(err))
+
+	meta, err := block.Complete(context.Background(), cfg, backend.NewWriter(rawW), &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, len(ids), meta.TotalObjects)
+	_, err = os.Stat(filepath.Join(backendDir, testTenantID, meta.BlockID.String()))
+	assert.NoError(t, err)
+}
+
+func TestEstimatedCompletedSize(t *testing.T) {
+	for _, enc := range []backend.Encoding{backend.EncNone, backend.EncSnappy, backend.EncZstd} {
+		t.Run(enc.String(), func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			backendDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(backendDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			_, rawW, _, err := local.New(&local.Config{
+				Path: backendDir,
+			})
+			require.NoError(t, err)
+
+			block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, enc, "")
+			require.NoError(t, err)
+			assert.Equal(t, uint64(0), block.EstimatedCompletedSize())
+
+			// objects that compress much better together than alone
+			for i := 0; i < 1000; i++ {
+				id := uuid.New()
+				obj := []byte(fmt.Sprintf(`{"service":"frontend","span":"GET /api/traces","status":"ok","duration":%d}`, i))
+				require.NoError(t, block.Write(id[:], obj))
+			}
+
+			estimate := block.EstimatedCompletedSize()
+			if enc != backend.EncNone {
+				assert.Less(t, estimate, block.DataLength())
+			}
+
+			cfg := &encoding.BlockConfig{
+				IndexDownsampleBytes: 100000,
+				IndexPageSizeBytes:   1000,
+				BloomFP:              0.01,
+				BloomShardSizeBytes:  100,
+				Encoding:             enc,
+			}
+			meta, err := block.Complete(context.Background(), cfg, backend.NewWriter(rawW), &mockCombiner{})
+			require.NoError(t, err)
+			assert.InEpsilon(t, meta.Size, estimate, 0.25, "estimate %d actual %d", estimate, meta.Size)
+		})
+	}
+}
+
+func TestEstimatedCompletedSizeBatchedPages(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	backendDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(backendDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	_, rawW, _, err := local.New(&local.Config{
+		Path: backendDir,
+	})
+	require.NoError(t, err)
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithBatchedPages(2000))
+	require.NoError(t, err)
+
+	ids := make([]common.ID, 0, 1000)
+	objs := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		id := uuid.New()
+		ids = append(ids, id[:])
+		objs = append(objs, []byte(fmt.Sprintf(`{"service":"frontend","span":"GET /api/traces","status":"ok","duration":%d}`, i)))
+	}
+	require.NoError(t, block.WriteBatch(ids, objs))
+	records := block.appender.Records()
+	require.Less(t, block.DataLength(), uint64(len(records))*uint64(records[0].Length), "objects share pages")
+
+	estimate := block.EstimatedCompletedSize()
+
+	cfg := &encoding.BlockConfig{
+		IndexDownsampleBytes: 100000,
+		IndexPageSizeBytes:   1000,
+		BloomFP:              0.01,
+		BloomShardSizeBytes:  100,
+		Encoding:             backend.EncSnappy,
+	}
+	meta, err := block.Complete(context.Background(), cfg, backend.NewWriter(rawW), &mockCombiner{})
+	require.NoError(t, err)
+	assert.InEpsilon(t, meta.Size, estimate, 0.25, "estimate %d actual %d", estimate, meta.Size)
+}
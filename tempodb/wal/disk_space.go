@@ -0,0 +1,64 @@
+package wal
+
+import (
+	"errors"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+var (
+	// ErrWALDiskLow is returned by writes to blocks configured WithDiskLowWatermark when the write would leave less
+	// than the watermark available on the wal disk. Callers can use it to shed load before the disk fills up.
+	ErrWALDiskLow = errors.New("wal disk space below low watermark")
+	// ErrWALDiskFull is returned by writes to blocks configured WithDiskLowWatermark when the object does not fit on
+	// the wal disk
+	ErrWALDiskFull = errors.New("wal disk full")
+)
+
+// DiskSpaceFunc returns the number of bytes available on the filesystem holding path
+type DiskSpaceFunc func(path string) (uint64, error)
+
+// checkDiskSpace returns the error a write of size bytes fails with for lack of disk space, if any. The disk is only
+// checked every diskCheckInterval writes, in between the bytes accepted since the last check are subtracted from the
+// space it found. Writes that are accepted but then fail to append must return their bytes with releaseDiskSpace. If
+// the check fails writes are not limited until the next one.
+func (a *AppendBlock) checkDiskSpace(size int) error {
+	if a.writesSinceDiskCheck == 0 {
+		diskSpace := a.diskSpace
+		if diskSpace == nil {
+			diskSpace = availableDiskSpace
+		}
+
+		available, err := diskSpace(a.filepath)
+		a.diskSpaceKnown = err == nil
+		a.diskAvailable = available
+		if err != nil {
+			level.Warn(a.logger).Log("msg", "failed to check wal disk space", "path", a.filepath, "err", err)
+		}
+	}
+	a.writesSinceDiskCheck++
+	if a.writesSinceDiskCheck >= a.diskCheckInterval {
+		a.writesSinceDiskCheck = 0
+	}
+
+	if !a.diskSpaceKnown {
+		return nil
+	}
+	if uint64(size) >= a.diskAvailable {
+		return ErrWALDiskFull
+	}
+	if a.diskAvailable-uint64(size) < a.diskLowWatermark {
+		return ErrWALDiskLow
+	}
+
+	a.diskAvailable -= uint64(size)
+	return nil
+}
+
+// releaseDiskSpace adds the size bytes checkDiskSpace subtracted for a write that failed to append back to the space
+// available
+func (a *AppendBlock) releaseDiskSpace(size int) {
+	if a.diskLowWatermark > 0 && a.diskSpaceKnown {
+		a.diskAvailable += uint64(size)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package wal
+
+import "github.com/grafana/tempo/tempodb/encoding/common"
+
+// availableDiskSpace is unsupported on this platform, writes are not limited by WithDiskLowWatermark
+func availableDiskSpace(string) (uint64, error) {
+	return 0, common.ErrUnsupported
+}
@@ -0,0 +1,107 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+// fakeDiskSpace is a DiskSpaceFunc reporting available bytes, or err if set
+type fakeDiskSpace struct {
+	available uint64
+	err       error
+	checks    int
+}
+
+func (f *fakeDiskSpace) diskSpace(string) (uint64, error) {
+	f.checks++
+	return f.available, f.err
+}
+
+func TestDiskLowWatermark(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	disk := &fakeDiskSpace{available: 1000}
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithDiskLowWatermark(500, 3), WithDiskSpace(disk.diskSpace))
+	require.NoError(t, err)
+
+	ids, objs := makeTestBatch(10)
+	obj := func(size int) []byte { return make([]byte, size) }
+
+	// the disk is checked on the first write and the writes accepted since are subtracted until the next check
+	require.NoError(t, block.Write(ids[0], obj(200)))
+	require.NoError(t, block.Write(ids[1], obj(200)))
+	assert.Equal(t, ErrWALDiskLow, block.Write(ids[2], obj(200)))
+	assert.Equal(t, 1, disk.checks)
+	assert.Equal(t, 2, block.RecordCount())
+
+	// the next check finds the disk full
+	disk.available = 100
+	assert.Equal(t, ErrWALDiskFull, block.Write(ids[3], obj(200)))
+	assert.Equal(t, 2, disk.checks)
+	assert.Equal(t, ErrWALDiskLow, block.Write(ids[4], obj(10)))
+
+	var batchErr *ErrWriteBatch
+	require.True(t, errors.As(block.WriteBatch(ids[5:7], objs[5:7]), &batchErr))
+	assert.Equal(t, ErrWALDiskFull, batchErr.Err)
+
+	// writes are not limited while the disk can not be checked
+	disk.err = errors.New("statfs failed")
+	require.NoError(t, block.Write(ids[7], obj(2000)))
+	require.NoError(t, block.Write(ids[8], obj(2000)))
+	assert.Equal(t, 3, disk.checks)
+	assert.Equal(t, 4, block.RecordCount())
+
+	// blocks without a watermark never check the disk
+	unlimited, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithDiskSpace(disk.diskSpace))
+	require.NoError(t, err)
+	require.NoError(t, unlimited.Write(ids[9], objs[9]))
+	assert.Equal(t, 3, disk.checks)
+}
+
+func TestDiskLowWatermarkFailedWrites(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	disk := &fakeDiskSpace{available: 1000}
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithDiskLowWatermark(500, 100), WithDiskSpace(disk.diskSpace))
+	require.NoError(t, err)
+
+	ids, _ := makeTestBatch(3)
+	obj := make([]byte, 200)
+
+	// writes that fail to append do not use up the space
+	for i := 0; i < 5; i++ {
+		err = block.WriteReader(ids[0], bytes.NewReader(obj[:100]), len(obj))
+		require.Error(t, err)
+		require.NotEqual(t, ErrWALDiskFull, err)
+		require.NotEqual(t, ErrWALDiskLow, err)
+	}
+	assert.Equal(t, 0, block.RecordCount())
+
+	require.NoError(t, block.Write(ids[1], obj))
+	require.NoError(t, block.Write(ids[2], obj))
+	assert.Equal(t, ErrWALDiskLow, block.Write(ids[0], obj))
+	assert.Equal(t, 1, disk.checks)
+}
+
+func TestAvailableDiskSpace(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	available, err := availableDiskSpace(tempDir)
+	require.NoError(t, err)
+	assert.NotZero(t, available)
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package wal
+
+import "golang.org/x/sys/unix"
+
+// availableDiskSpace returns the bytes available to unprivileged users on the filesystem holding path
+func availableDiskSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,9 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package wal
+
+import "syscall"
+
+// dsyncFlag is OR'd into the append file flags by WithDataSync
+const dsyncFlag = syscall.O_DSYNC
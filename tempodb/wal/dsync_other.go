@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package wal
+
+import "os"
+
+// dsyncFlag falls back to O_SYNC on platforms without O_DSYNC. This is more expensive because file
+// metadata is synced as well, but preserves the data durability guarantee.
+const dsyncFlag = os.O_SYNC
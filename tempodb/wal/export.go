@@ -0,0 +1,57 @@
+package wal
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// jsonlObject is a single line written by ExportJSONL
+type jsonlObject struct {
+	ID   string `json:"id"`
+	Len  int    `json:"len"`
+	Data []byte `json:"data"`
+}
+
+// ExportJSONL iterates the block and writes every combined object to w as one JSON object per line
+// of the form {"id":"<hex>","len":N,"data":"<base64>"}. This is meant for debugging and tooling.
+// Like GetIterator, the block can not be appended to afterwards.
+func (a *AppendBlock) ExportJSONL(ctx context.Context, w io.Writer, combiner common.ObjectCombiner) error {
+	iter, err := a.GetIterator(ctx, combiner)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	encoder := json.NewEncoder(w)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		id, obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if id == nil {
+			break
+		}
+
+		err = encoder.Encode(jsonlObject{
+			ID:   hex.EncodeToString(id),
+			Len:  len(obj),
+			Data: obj,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
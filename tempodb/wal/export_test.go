@@ -0,0 +1,67 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestExportJSONL(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncLZ4_64k, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 25)
+
+	expected := map[string][]byte{}
+	for i, id := range ids {
+		expected[hex.EncodeToString(id)] = objs[i]
+	}
+
+	buf := &bytes.Buffer{}
+	err = block.ExportJSONL(context.Background(), buf, &mockCombiner{})
+	require.NoError(t, err)
+
+	actual := map[string][]byte{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		obj := jsonlObject{}
+		err = json.Unmarshal(scanner.Bytes(), &obj)
+		require.NoError(t, err)
+		assert.Equal(t, len(obj.Data), obj.Len)
+		actual[obj.ID] = obj.Data
+	}
+	require.NoError(t, scanner.Err())
+	assert.Equal(t, expected, actual)
+}
+
+func TestExportJSONLCancelled(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, block, 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	buf := &bytes.Buffer{}
+	err = block.ExportJSONL(ctx, buf, &mockCombiner{})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, buf.Len())
+}
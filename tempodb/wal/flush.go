@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// flushTracker correlates writes with the Flush that made them durable. Writes are numbered in order and
+// flushed is the last write covered by a successful Flush.
+type flushTracker struct {
+	mtx     sync.Mutex
+	written uint64
+	flushed uint64
+	err     error
+
+	// waiting is closed and replaced whenever flushed or err changes
+	waiting chan struct{}
+}
+
+func (f *flushTracker) wrote(n int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.written += uint64(n)
+}
+
+func (f *flushTracker) done(seq uint64, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if err != nil {
+		f.err = err
+	} else if seq > f.flushed {
+		f.flushed = seq
+	}
+
+	if f.waiting != nil {
+		close(f.waiting)
+		f.waiting = nil
+	}
+}
+
+// Flush syncs the append file, and the mirror file if configured, to stable storage. Every write made
+// before the call is durable once it returns. Write cuts a page per object so there is no buffered data
+// to flush first. Flush is a no-op for blocks that are no longer appended to, their files were synced when GetIterator
+// or Close stopped the appends.
+func (a *AppendBlock) Flush() error {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	a.flushes.mtx.Lock()
+	seq := a.flushes.written
+	a.flushes.mtx.Unlock()
+
+	if a.appendFile == nil && a.mirrorFile == nil {
+		a.flushes.done(seq, nil)
+		return nil
+	}
+
+	start := time.Now()
+	var err error
+	if a.appendFile != nil {
+		err = a.appendFile.Sync()
+	}
+	if err == nil && a.mirrorFile != nil {
+		err = a.mirrorFile.Sync()
+	}
+	if a.metrics != nil {
+		a.metrics.Flushed(time.Since(start), err)
+	}
+
+	a.flushes.done(seq, err)
+	return err
+}
+
+// FlushBarrier returns a sequence number covering every write made before the call. Pass it to
+// WaitFlushed to wait until those writes are durable.
+func (a *AppendBlock) FlushBarrier() (uint64, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return 0, ErrBlockCleared
+	}
+
+	if a.appendFile == nil {
+		return 0, common.ErrUnsupported
+	}
+
+	a.flushes.mtx.Lock()
+	defer a.flushes.mtx.Unlock()
+
+	return a.flushes.written, nil
+}
+
+// WaitFlushed blocks until a Flush has completed that covers the writes represented by seq. It returns
+// an error if a Flush fails or the block is cleared before then.
+func (a *AppendBlock) WaitFlushed(seq uint64) error {
+	for {
+		a.flushes.mtx.Lock()
+		if a.flushes.flushed >= seq {
+			a.flushes.mtx.Unlock()
+			return nil
+		}
+		if a.flushes.err != nil {
+			err := a.flushes.err
+			a.flushes.mtx.Unlock()
+			return err
+		}
+		if a.flushes.waiting == nil {
+			a.flushes.waiting = make(chan struct{})
+		}
+		waiting := a.flushes.waiting
+		a.flushes.mtx.Unlock()
+
+		<-waiting
+	}
+}
@@ -0,0 +1,135 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestWaitFlushed(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+
+	seq, err := block.FlushBarrier()
+	require.NoError(t, err)
+	assert.NoError(t, block.WaitFlushed(seq), "nothing written yet")
+
+	_, _ = writeTestObjects(t, block, 10)
+	seq, err = block.FlushBarrier()
+	require.NoError(t, err)
+
+	flushed := atomic.NewBool(false)
+	done := make(chan error)
+	go func() {
+		done <- block.WaitFlushed(seq)
+	}()
+
+	select {
+	case <-done:
+		require.FailNow(t, "WaitFlushed returned before Flush")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// writes after the barrier are not required by WaitFlushed
+	_, _ = writeTestObjects(t, block, 1)
+	flushed.Store(true)
+	require.NoError(t, block.Flush())
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+		assert.True(t, flushed.Load())
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "WaitFlushed did not return after Flush")
+	}
+
+	next, err := block.FlushBarrier()
+	require.NoError(t, err)
+	assert.Greater(t, next, seq)
+}
+
+func TestWaitFlushedSealed(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	_, _ = writeTestObjects(t, block, 10)
+	seq, err := block.FlushBarrier()
+	require.NoError(t, err)
+
+	// sealing the block syncs it so the writes are flushed without calling Flush
+	iter, err := block.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	iter.Close()
+
+	block.flushes.mtx.Lock()
+	assert.Equal(t, seq, block.flushes.flushed)
+	block.flushes.mtx.Unlock()
+	assert.NoError(t, block.WaitFlushed(seq))
+	assert.NoError(t, block.Flush())
+}
+
+func TestWaitFlushedCleared(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	_, _ = writeTestObjects(t, block, 1)
+
+	seq, err := block.FlushBarrier()
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- block.WaitFlushed(seq)
+	}()
+
+	require.NoError(t, block.Clear())
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, os.ErrClosed)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "WaitFlushed did not return after Clear")
+	}
+
+	_, err = block.FlushBarrier()
+	assert.Equal(t, ErrBlockCleared, err)
+}
+
+func TestFlushReplay(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+
+	ids, _ := writeTestObjects(t, block, 20)
+	require.NoError(t, block.Flush())
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Len(t, replayed.appender.Records(), len(ids))
+
+	// replayed blocks are not appended to so Flush does nothing
+	assert.NoError(t, replayed.Flush())
+}
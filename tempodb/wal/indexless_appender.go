@@ -0,0 +1,95 @@
+package wal
+
+import (
+	"io"
+
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// indexlessAppender writes pages like the standard appender but does not keep records for them. It is used
+// by blocks created WithoutIndex.
+type indexlessAppender struct {
+	dataWriter    common.DataWriter
+	length        int
+	currentOffset uint64
+}
+
+var _ encoding.Appender = (*indexlessAppender)(nil)
+var _ encoding.ReaderAppender = (*indexlessAppender)(nil)
+var _ encoding.PageAppender = (*indexlessAppender)(nil)
+
+func newIndexlessAppender(dataWriter common.DataWriter) *indexlessAppender {
+	return &indexlessAppender{
+		dataWriter: dataWriter,
+	}
+}
+
+// Append implements encoding.Appender
+func (a *indexlessAppender) Append(id common.ID, b []byte) error {
+	_, err := a.dataWriter.Write(id, b)
+	if err != nil {
+		return err
+	}
+
+	return a.cutPage(1)
+}
+
+// AppendReader implements encoding.ReaderAppender
+func (a *indexlessAppender) AppendReader(id common.ID, r io.Reader, size int) error {
+	_, err := encoding.WriteReader(a.dataWriter, id, r, size)
+	if err != nil {
+		return err
+	}
+
+	return a.cutPage(1)
+}
+
+// AppendPage implements encoding.PageAppender
+func (a *indexlessAppender) AppendPage(ids []common.ID, objs [][]byte) error {
+	for i, id := range ids {
+		_, err := a.dataWriter.Write(id, objs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.cutPage(len(ids))
+}
+
+// cutPage cuts the page holding the last objects written
+func (a *indexlessAppender) cutPage(objects int) error {
+	bytesWritten, err := a.dataWriter.CutPage()
+	if err != nil {
+		return err
+	}
+
+	a.length += objects
+	a.currentOffset += uint64(bytesWritten)
+	return nil
+}
+
+// Records implements encoding.Appender. No records are kept.
+func (a *indexlessAppender) Records() []common.Record {
+	return nil
+}
+
+// RecordsForID implements encoding.Appender. No records are kept.
+func (a *indexlessAppender) RecordsForID(common.ID) []common.Record {
+	return nil
+}
+
+// Length implements encoding.Appender. It is the number of objects appended.
+func (a *indexlessAppender) Length() int {
+	return a.length
+}
+
+// DataLength implements encoding.Appender
+func (a *indexlessAppender) DataLength() uint64 {
+	return a.currentOffset
+}
+
+// Complete implements encoding.Appender
+func (a *indexlessAppender) Complete() error {
+	return a.dataWriter.Complete()
+}
@@ -0,0 +1,23 @@
+package wal
+
+import "time"
+
+// MetricsSink receives events from AppendBlocks configured WithMetrics so they can be exported, for instance as
+// prometheus counters and histograms.
+type MetricsSink interface {
+	// Appended is called after every successful Write with the number of bytes appended to the file, including
+	// page and object framing
+	Appended(bytes int)
+	// Flushed is called after every Flush that syncs a file
+	Flushed(d time.Duration, err error)
+	// Replayed is called once per file replayed. warning and err are the warning and error returned by the replay.
+	Replayed(filename string, d time.Duration, result ReplayResult, warning error, err error)
+}
+
+// ObjectSizeSink can be implemented by a MetricsSink to also receive the size of every object written, for instance
+// to build a histogram of object sizes per tenant. It is optional so sinks that do not need it cost nothing per object.
+type ObjectSizeSink interface {
+	// ObjectAppended is called for every object appended by Write, WriteReader and WriteBatch with the tenant of the
+	// block and the length of the object, excluding page and object framing
+	ObjectAppended(tenantID string, size int)
+}
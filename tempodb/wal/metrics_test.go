@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+type testMetricsSink struct {
+	mtx      sync.Mutex
+	appended []int
+	flushes  int
+	replays  []ReplayResult
+	warnings []error
+}
+
+func (s *testMetricsSink) Appended(bytes int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.appended = append(s.appended, bytes)
+}
+
+func (s *testMetricsSink) Flushed(_ time.Duration, _ error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.flushes++
+}
+
+func (s *testMetricsSink) Replayed(_ string, _ time.Duration, result ReplayResult, warning error, _ error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.replays = append(s.replays, result)
+	s.warnings = append(s.warnings, warning)
+}
+
+func TestMetrics(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	sink := &testMetricsSink{}
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMetrics(sink))
+	require.NoError(t, err)
+	writeTestObjects(t, block, 3)
+	require.NoError(t, block.Flush())
+
+	require.Len(t, sink.appended, 3)
+	total := 0
+	for _, b := range sink.appended {
+		total += b
+	}
+	assert.Equal(t, int(block.DataLength()), total)
+	assert.Equal(t, 1, sink.flushes)
+
+	appendGarbage(t, block.fullFilename())
+	_, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, WithMetrics(sink))
+	require.NoError(t, err)
+	require.Error(t, warning)
+
+	require.Len(t, sink.replays, 1)
+	assert.Equal(t, 3, sink.replays[0].Recovered)
+	assert.Equal(t, warning, sink.warnings[0])
+}
+
+// testObjectSizeSink is a testMetricsSink that also records object sizes by tenant
+type testObjectSizeSink struct {
+	testMetricsSink
+	sizes map[string][]int
+}
+
+func (s *testObjectSizeSink) ObjectAppended(tenantID string, size int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.sizes == nil {
+		s.sizes = map[string][]int{}
+	}
+	s.sizes[tenantID] = append(s.sizes[tenantID], size)
+}
+
+func TestObjectSizeMetrics(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	sink := &testObjectSizeSink{}
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithMetrics(sink), WithMaxObjectSize(35))
+	require.NoError(t, err)
+	other, err := newAppendBlock(uuid.New(), "other", tempDir, backend.EncNone, "", WithMetrics(sink))
+	require.NoError(t, err)
+
+	ids, _ := makeTestBatch(3)
+	require.NoError(t, block.Write(ids[0], make([]byte, 10)))
+	require.NoError(t, block.WriteReader(ids[1], bytes.NewReader(make([]byte, 20)), 20))
+	require.NoError(t, other.Write(ids[0], make([]byte, 50)))
+
+	// objects that fail to be written are not observed
+	assert.Error(t, block.WriteBatch(ids, [][]byte{make([]byte, 30), make([]byte, 40), make([]byte, 5)}))
+	assert.Error(t, block.Write(ids[2], make([]byte, 60)))
+
+	assert.Equal(t, map[string][]int{
+		testTenantID: {10, 20, 30},
+		"other":      {50},
+	}, sink.sizes)
+	assert.Len(t, sink.appended, 4)
+}
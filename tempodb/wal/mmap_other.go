@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package wal
+
+import (
+	"os"
+
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// mmapFile is unsupported on this platform, Find falls back to reading the file
+func mmapFile(*os.File) ([]byte, error) {
+	return nil, common.ErrUnsupported
+}
+
+func munmapFile([]byte) error {
+	return nil
+}
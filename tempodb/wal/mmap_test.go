@@ -0,0 +1,82 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestMmap(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("mmap is not supported on " + runtime.GOOS)
+	}
+
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithMmap(), WithPageFooters())
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 50)
+
+	// blocks being appended to read the file
+	obj, err := block.Find(context.Background(), ids[0], &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, objs[0], obj)
+	assert.Nil(t, block.mapped)
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, WithMmap(), WithPageFooters())
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	for i, id := range ids {
+		obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+	assert.NotNil(t, replayed.mapped)
+
+	missing := uuid.New()
+	obj, err = replayed.Find(context.Background(), missing[:], &mockCombiner{})
+	require.NoError(t, err)
+	assert.Nil(t, obj)
+
+	require.NoError(t, replayed.Clear())
+	assert.Nil(t, replayed.mapped)
+}
+
+func BenchmarkFind(b *testing.B) {
+	benchmarkFind(b)
+}
+
+func BenchmarkFindMmap(b *testing.B) {
+	benchmarkFind(b, WithMmap())
+}
+
+func benchmarkFind(b *testing.B, opts ...AppendBlockOption) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(b, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(b, err)
+	ids, _ := writeTestObjects(b, block, 100000)
+
+	replayed, _, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, opts...)
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := replayed.Find(context.Background(), ids[rand.Intn(len(ids))], &mockCombiner{})
+		require.NoError(b, err)
+	}
+}
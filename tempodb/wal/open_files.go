@@ -0,0 +1,44 @@
+package wal
+
+import (
+	"sync"
+)
+
+var (
+	readFileSlotsMtx sync.Mutex
+	readFileSlots    chan struct{}
+)
+
+// SetMaxOpenReadFiles bounds the number of wal files that can be open for reading across all blocks. A block opening
+// a file beyond the limit waits until another block closes its read file with CloseRead, Close or Clear. The block
+// waits while holding its lock so its other methods, including Write and Flush, wait with it. Other blocks are not
+// affected. 0 is unlimited. Changing the limit only applies to files opened afterwards.
+func SetMaxOpenReadFiles(max int) {
+	readFileSlotsMtx.Lock()
+	defer readFileSlotsMtx.Unlock()
+
+	if max <= 0 {
+		readFileSlots = nil
+		return
+	}
+	readFileSlots = make(chan struct{}, max)
+}
+
+// acquireReadFileSlot blocks until a file can be opened for reading. It is called by file() under the block's lock. The
+// returned channel must be passed to releaseReadFileSlot when the file is closed.
+func acquireReadFileSlot() chan struct{} {
+	readFileSlotsMtx.Lock()
+	slots := readFileSlots
+	readFileSlotsMtx.Unlock()
+
+	if slots != nil {
+		slots <- struct{}{}
+	}
+	return slots
+}
+
+func releaseReadFileSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
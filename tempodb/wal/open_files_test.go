@@ -0,0 +1,203 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestMaxOpenReadFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	SetMaxOpenReadFiles(1)
+	defer SetMaxOpenReadFiles(0)
+
+	blockA, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	idsA, _ := writeTestObjects(t, blockA, 5)
+	blockB, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	idsB, _ := writeTestObjects(t, blockB, 5)
+
+	_, err = blockA.Find(context.Background(), idsA[0], &mockCombiner{})
+	require.NoError(t, err)
+
+	// blockB has to wait for blockA to close its file
+	done := make(chan error)
+	go func() {
+		_, err := blockB.Find(context.Background(), idsB[0], &mockCombiner{})
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		require.FailNow(t, "second file opened while at the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, blockA.Clear())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "second file not opened after the first was closed")
+	}
+
+	require.NoError(t, blockB.Clear())
+}
+
+func TestOpenAndCloseRead(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	opens := 0
+	openReadFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		opens++
+		return os.OpenFile(name, flag, perm)
+	}
+	defer func() { openReadFile = os.OpenFile }()
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 5)
+
+	require.NoError(t, block.Open())
+	require.Equal(t, 1, opens)
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		require.Equal(t, objs[i], obj)
+	}
+	require.Equal(t, 1, opens, "Find uses the opened file")
+	require.NoError(t, block.Open())
+	require.Equal(t, 1, opens, "Open is a noop while the file is open")
+
+	// the next Find reopens the file
+	require.NoError(t, block.CloseRead())
+	require.Nil(t, block.readFile)
+	obj, err := block.Find(context.Background(), ids[0], &mockCombiner{})
+	require.NoError(t, err)
+	require.Equal(t, objs[0], obj)
+	require.Equal(t, 2, opens)
+
+	// closing the read file releases its slot for other blocks
+	SetMaxOpenReadFiles(1)
+	defer SetMaxOpenReadFiles(0)
+	require.NoError(t, block.Open())
+	require.NoError(t, block.CloseRead())
+	other, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, other, 1)
+	require.NoError(t, other.Open())
+	require.NoError(t, other.Clear())
+
+	require.NoError(t, block.Clear())
+	require.Equal(t, ErrBlockCleared, block.Open())
+	require.Equal(t, ErrBlockCleared, block.CloseRead())
+}
+
+func TestReadFileOpenRetried(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	SetMaxOpenReadFiles(1)
+	defer SetMaxOpenReadFiles(0)
+
+	opens := 0
+	openReadFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		opens++
+		if opens == 1 {
+			return nil, syscall.EMFILE
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+	defer func() { openReadFile = os.OpenFile }()
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 5)
+
+	_, err = block.Find(context.Background(), ids[0], &mockCombiner{})
+	require.ErrorIs(t, err, syscall.EMFILE)
+	require.Nil(t, block.readFile)
+
+	// the failed open released its slot and is retried by the next read
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		require.Equal(t, objs[i], obj)
+	}
+	require.Equal(t, 2, opens)
+
+	require.NoError(t, block.Clear())
+}
+
+func TestMaxOpenReadFilesContended(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	SetMaxOpenReadFiles(1)
+	defer SetMaxOpenReadFiles(0)
+
+	holder, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, holder, 1)
+	require.NoError(t, holder.Open())
+
+	waiter, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, waiter, 2)
+
+	found := make(chan error)
+	go func() {
+		obj, err := waiter.Find(context.Background(), ids[0], &mockCombiner{})
+		if err == nil && !bytes.Equal(objs[0], obj) {
+			err = errors.New("unexpected object")
+		}
+		found <- err
+	}()
+	select {
+	case <-found:
+		require.FailNow(t, "Find returned while every slot was taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the waiting block's writes wait for its lock, other blocks are not affected
+	wrote := make(chan error)
+	go func() { wrote <- waiter.Write(ids[1], objs[1]) }()
+	require.NoError(t, holder.Write(ids[0], objs[0]))
+	select {
+	case <-wrote:
+		require.FailNow(t, "Write returned while the block waited for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// closing the read file of the other block releases its slot
+	require.NoError(t, holder.CloseRead())
+	for _, done := range []chan error{found, wrote} {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "block did not get the released slot")
+		}
+	}
+
+	require.NoError(t, waiter.Clear())
+	require.NoError(t, holder.Clear())
+}
@@ -0,0 +1,222 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// When page footers are enabled every page in the append file is followed by a
+// fixed size footer. A page without a complete footer at the end of the file was
+// torn by a crash.
+//
+//	|     32 bits    |  32 bits    |
+//	| footer magic   | page length |
+//
+// When page checksums are enabled the footer also holds the crc32 of the page
+// as written.
+//
+//	|     32 bits    |  32 bits    |  32 bits   |
+//	| checksum magic | page length | page crc32 |
+const (
+	pageFooterMagic          = uint32(0x7a3a9f11)
+	pageChecksumFooterMagic  = uint32(0x7a3a9f12)
+	pageFooterLength         = 8
+	pageChecksumFooterLength = 12
+	pageLengthSize           = 4 // v2 pages begin with their uint32 total length
+)
+
+var (
+	// ErrTruncatedTail is returned during replay when the last page in a file with page footers is incomplete
+	ErrTruncatedTail = errors.New("wal page truncated at end of file")
+	// ErrPageChecksum is returned during replay when a page does not match the checksum in its footer
+	ErrPageChecksum = errors.New("wal page checksum mismatch")
+)
+
+// footerLength returns the number of bytes that follow every page in the block's file
+func (a *AppendBlock) footerLength() int {
+	if !a.pageFooters {
+		return 0
+	}
+	if a.pageChecksums {
+		return pageChecksumFooterLength
+	}
+	return pageFooterLength
+}
+
+// footerDataWriter writes a page footer after every page written by the wrapped DataWriter. The length
+// returned by CutPage includes the footer so that records span both. If crc is set it must be fed every byte
+// the wrapped DataWriter writes and its sum is stored in the footer.
+type footerDataWriter struct {
+	common.DataWriter
+	w   io.Writer
+	crc hash.Hash32
+}
+
+func newFooterDataWriter(dataWriter common.DataWriter, w io.Writer, crc hash.Hash32) common.DataWriter {
+	return &footerDataWriter{
+		DataWriter: dataWriter,
+		w:          w,
+		crc:        crc,
+	}
+}
+
+// WriteReader implements common.ReaderDataWriter
+func (f *footerDataWriter) WriteReader(id common.ID, r io.Reader, size int) (int, error) {
+	return encoding.WriteReader(f.DataWriter, id, r, size)
+}
+
+// CutPage implements common.DataWriter
+func (f *footerDataWriter) CutPage() (int, error) {
+	bytesWritten, err := f.DataWriter.CutPage()
+	if err != nil {
+		return 0, err
+	}
+
+	var footer []byte
+	if f.crc != nil {
+		footer = make([]byte, pageChecksumFooterLength)
+		binary.LittleEndian.PutUint32(footer, pageChecksumFooterMagic)
+		binary.LittleEndian.PutUint32(footer[8:], f.crc.Sum32())
+		f.crc.Reset()
+	} else {
+		footer = make([]byte, pageFooterLength)
+		binary.LittleEndian.PutUint32(footer, pageFooterMagic)
+	}
+	binary.LittleEndian.PutUint32(footer[4:], uint32(bytesWritten))
+	_, err = f.w.Write(footer)
+	if err != nil {
+		return 0, err
+	}
+
+	return bytesWritten + len(footer), nil
+}
+
+// footerDataReader reads pages written by a footerDataWriter. Record lengths include the footer which is
+// stripped before reading the page from the wrapped DataReader. Checksums are only verified by NextPage.
+type footerDataReader struct {
+	common.DataReader
+	r         backend.ContextReader
+	checksums bool
+
+	offset     uint64
+	header     [pageLengthSize]byte
+	footer     [pageChecksumFooterLength]byte
+	pageBuffer []byte // reused by NextPage to verify checksums
+}
+
+func newFooterDataReader(dataReader common.DataReader, r backend.ContextReader, checksums bool) common.DataReader {
+	return &footerDataReader{
+		DataReader: dataReader,
+		r:          r,
+		checksums:  checksums,
+	}
+}
+
+// Read implements common.DataReader
+func (f *footerDataReader) Read(ctx context.Context, records []common.Record, pagesBuffer [][]byte, buffer []byte) ([][]byte, []byte, error) {
+	if len(records) == 1 {
+		return f.DataReader.Read(ctx, []common.Record{f.stripFooter(records[0])}, pagesBuffer, buffer)
+	}
+
+	// records are not contiguous once footers are stripped so read them one at a time
+	pages := make([][]byte, 0, len(records))
+	for _, r := range records {
+		page, _, err := f.DataReader.Read(ctx, []common.Record{f.stripFooter(r)}, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		pages = append(pages, page...)
+	}
+
+	return pages, buffer, nil
+}
+
+// NextPage implements common.DataReader. It confirms the page is followed by a valid footer before reading it
+// and returns ErrTruncatedTail if the file ends before the page or its footer is complete. With checksums
+// ErrPageChecksum is returned if the page does not match its footer.
+func (f *footerDataReader) NextPage(buffer []byte) ([]byte, uint32, error) {
+	ctx := context.Background()
+
+	lengthBytes := f.header[:]
+	n, err := f.r.ReadAt(ctx, lengthBytes, int64(f.offset))
+	if n == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if n < pageLengthSize {
+		return nil, 0, ErrTruncatedTail
+	}
+	pageLength := binary.LittleEndian.Uint32(lengthBytes)
+
+	footer := f.footer[:f.footerLength()]
+	n, err = f.r.ReadAt(ctx, footer, int64(f.offset)+int64(pageLength))
+	if n < len(footer) {
+		if err == io.EOF || err == nil {
+			return nil, 0, ErrTruncatedTail
+		}
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(footer) != f.footerMagic() || binary.LittleEndian.Uint32(footer[4:]) != pageLength {
+		return nil, 0, fmt.Errorf("invalid page footer at offset %d", f.offset+uint64(pageLength))
+	}
+
+	if f.checksums {
+		if cap(f.pageBuffer) < int(pageLength) {
+			f.pageBuffer = make([]byte, pageLength)
+		}
+		page := f.pageBuffer[:pageLength]
+		_, err = f.r.ReadAt(ctx, page, int64(f.offset))
+		if err != nil {
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(page) != binary.LittleEndian.Uint32(footer[8:]) {
+			return nil, 0, fmt.Errorf("%w at offset %d", ErrPageChecksum, f.offset)
+		}
+	}
+
+	buffer, pageLen, err := f.DataReader.NextPage(buffer)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// skip the footer on the underlying reader
+	reader, err := f.r.Reader()
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = io.ReadFull(reader, footer)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pageLen += uint32(len(footer))
+	f.offset += uint64(pageLen)
+	return buffer, pageLen, nil
+}
+
+func (f *footerDataReader) footerLength() int {
+	if f.checksums {
+		return pageChecksumFooterLength
+	}
+	return pageFooterLength
+}
+
+func (f *footerDataReader) footerMagic() uint32 {
+	if f.checksums {
+		return pageChecksumFooterMagic
+	}
+	return pageFooterMagic
+}
+
+func (f *footerDataReader) stripFooter(r common.Record) common.Record {
+	r.Length -= uint32(f.footerLength())
+	return r
+}
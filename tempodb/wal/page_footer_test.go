@@ -0,0 +1,201 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestPageFootersCleanLastPage(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithPageFooters())
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 10)
+
+	info, err := os.Stat(block.fullFilename())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(info.Size()), block.DataLength())
+
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, WithPageFooters())
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Equal(t, block.appender.Records(), replayed.appender.Records())
+
+	iter, err := replayed.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	defer iter.Close()
+
+	count := 0
+	for {
+		id, _, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if id == nil {
+			break
+		}
+		count++
+	}
+	assert.Equal(t, len(ids), count)
+}
+
+func TestPageFootersTornLastPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		truncate int64
+	}{
+		{
+			name:     "torn footer",
+			truncate: 3,
+		},
+		{
+			name:     "torn page",
+			truncate: pageFooterLength + 5,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithPageFooters())
+			require.NoError(t, err)
+			ids, objs := writeTestObjects(t, block, 10)
+
+			err = os.Truncate(block.fullFilename(), int64(block.DataLength())-tc.truncate)
+			require.NoError(t, err)
+
+			replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, WithPageFooters())
+			require.NoError(t, err)
+			assert.Equal(t, ErrTruncatedTail, warning)
+			assert.Equal(t, len(ids)-1, replayed.appender.Length())
+
+			for i, id := range ids[:len(ids)-1] {
+				obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+				require.NoError(t, err)
+				assert.Equal(t, objs[i], obj)
+			}
+		})
+	}
+}
+
+func TestPageChecksums(t *testing.T) {
+	tests := []struct {
+		name     string
+		opt      AppendBlockOption
+		expected error
+	}{
+		{
+			name: "footers only",
+			opt:  WithPageFooters(),
+		},
+		{
+			name:     "checksums",
+			opt:      WithPageChecksums(),
+			expected: ErrPageChecksum,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", tc.opt)
+			require.NoError(t, err)
+			ids, objs := writeTestObjects(t, block, 10)
+
+			for i, id := range ids {
+				obj, err := block.Find(context.Background(), id, &mockCombiner{})
+				require.NoError(t, err)
+				assert.Equal(t, objs[i], obj)
+			}
+
+			replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, tc.opt)
+			require.NoError(t, err)
+			require.NoError(t, warning)
+			assert.Equal(t, block.appender.Records(), replayed.appender.Records())
+
+			// flip a byte in the middle of the 5th object
+			records := block.appender.Records()
+			sort.Slice(records, func(i, j int) bool { return records[i].Start < records[j].Start })
+			corrupt := records[4]
+
+			f, err := os.OpenFile(block.fullFilename(), os.O_RDWR, 0644)
+			require.NoError(t, err)
+			b := make([]byte, 1)
+			offset := int64(corrupt.Start) + int64(corrupt.Length)/2
+			_, err = f.ReadAt(b, offset)
+			require.NoError(t, err)
+			_, err = f.WriteAt([]byte{^b[0]}, offset)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			replayed, warning, err = newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, tc.opt)
+			require.NoError(t, err)
+			if tc.expected == nil {
+				assert.NoError(t, warning)
+				assert.Equal(t, len(ids), replayed.appender.Length())
+				return
+			}
+			assert.True(t, errors.Is(warning, tc.expected))
+			assert.Equal(t, 4, replayed.appender.Length())
+			assert.Equal(t, corrupt.Start, replayed.ReplayResult().TruncatedAtOffset)
+		})
+	}
+}
+
+func TestPageChecksumsReuseBuffer(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithPageChecksums())
+	require.NoError(t, err)
+	ids, _ := writeTestObjects(t, block, 10)
+
+	f, err := os.Open(block.fullFilename())
+	require.NoError(t, err)
+	defer f.Close()
+	dataReader, err := block.newDataReader(f)
+	require.NoError(t, err)
+	footerReader := dataReader.(*footerDataReader)
+
+	// every page is the same size so the buffer checked against the footer is allocated once
+	var pageBuffer *byte
+	var buffer []byte
+	for range ids {
+		buffer, _, err = dataReader.NextPage(buffer)
+		require.NoError(t, err)
+		if pageBuffer == nil {
+			pageBuffer = &footerReader.pageBuffer[0]
+		}
+		assert.Equal(t, pageBuffer, &footerReader.pageBuffer[0])
+	}
+	_, _, err = dataReader.NextPage(buffer)
+	assert.Equal(t, io.EOF, err)
+}
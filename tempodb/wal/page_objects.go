@@ -0,0 +1,126 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// PageObjects is the number of objects replay expects in a wal page. Write cuts a page per object while WriteBatch
+// WithBatchedPages, or tools writing wal files, can write several objects to a page.
+type PageObjects int
+
+const (
+	// MultiObjectPages replays pages holding any number of objects. It is the default so files with batched pages
+	// replay whatever options they are replayed with.
+	MultiObjectPages PageObjects = iota
+	// SingleObjectPages stops replay with ErrMultiObjectPage at a page holding more than one object. It suits blocks
+	// that are never written WithBatchedPages, where such a page means the file is corrupt.
+	SingleObjectPages
+)
+
+// pageIDs appends the ids of the objects in page to ids. A page is only replayed if all of its objects can be read so
+// an error is returned if any can not, or if the page holds several objects and the block expects SingleObjectPages.
+func (a *AppendBlock) pageIDs(objectReader common.ObjectReaderWriter, page []byte, ids []common.ID) ([]common.ID, error) {
+	start := len(ids)
+	for rest := page; len(rest) > 0 || len(ids) == start; {
+		if len(ids) > start && a.pageObjects == SingleObjectPages {
+			return nil, ErrMultiObjectPage
+		}
+
+		var id common.ID
+		var err error
+		rest, id, _, err = objectReader.UnmarshalAndAdvanceBuffer(rest)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// pageObject returns a copy of the object for id in page. Wal pages hold a single object unless they were written by
+// WriteBatch WithBatchedPages, then they hold several objects with different ids.
+func pageObject(objectRW common.ObjectReaderWriter, page []byte, id common.ID) ([]byte, error) {
+	for {
+		var objID common.ID
+		var obj []byte
+		var err error
+		page, objID, obj, err = objectRW.UnmarshalAndAdvanceBuffer(page)
+		if err == io.EOF {
+			return nil, fmt.Errorf("object %x not found in page", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(objID, id) {
+			return append([]byte(nil), obj...), nil
+		}
+	}
+}
+
+// readRecordObject reads the page of r with dataReader and returns the object for r's id. pages and buffer are
+// reused between calls.
+func readRecordObject(ctx context.Context, dataReader common.DataReader, objectRW common.ObjectReaderWriter, r common.Record, pages [][]byte, buffer []byte) ([]byte, [][]byte, []byte, error) {
+	pages, buffer, err := dataReader.Read(ctx, []common.Record{r}, pages, buffer)
+	if err != nil {
+		return nil, pages, buffer, err
+	}
+	if len(pages) == 0 {
+		return nil, pages, buffer, errors.New("unexpected 0 length pages from dataReader")
+	}
+
+	obj, err := pageObject(objectRW, pages[0], r.ID)
+	return obj, pages, buffer, err
+}
+
+// recordObjectIterator iterates the objects of records in order. Unlike encoding.NewRecordIterator it returns exactly
+// one object per record so records sharing a page are not returned twice.
+type recordObjectIterator struct {
+	records  []common.Record
+	dataR    common.DataReader
+	objectRW common.ObjectReaderWriter
+
+	pages  [][]byte
+	buffer []byte
+}
+
+var _ encoding.Iterator = (*recordObjectIterator)(nil)
+
+func newRecordObjectIterator(records []common.Record, dataR common.DataReader, objectRW common.ObjectReaderWriter) *recordObjectIterator {
+	return &recordObjectIterator{
+		records:  records,
+		dataR:    dataR,
+		objectRW: objectRW,
+	}
+}
+
+// Next implements encoding.Iterator
+func (i *recordObjectIterator) Next(ctx context.Context) (common.ID, []byte, error) {
+	if len(i.records) == 0 {
+		return nil, nil, io.EOF
+	}
+
+	r := i.records[0]
+	var obj []byte
+	var err error
+	obj, i.pages, i.buffer, err = readRecordObject(ctx, i.dataR, i.objectRW, r, i.pages, i.buffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	i.records = i.records[1:]
+
+	return r.ID, obj, nil
+}
+
+// Close implements encoding.Iterator
+func (i *recordObjectIterator) Close() {
+	i.dataR.Close()
+}
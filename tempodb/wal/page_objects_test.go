@@ -0,0 +1,211 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+func TestBatchedPages(t *testing.T) {
+	for _, footers := range []bool{false, true} {
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		defer os.RemoveAll(tempDir)
+		require.NoError(t, err, "unexpected error creating temp dir")
+
+		ids, objs := makeTestBatch(50)
+		// a second object for an id starts a new page
+		ids[21], objs[21] = ids[20], append([]byte(nil), objs[20]...)
+		objs[21][0]++
+
+		opts := []AppendBlockOption{WithBatchedPages(1000)}
+		if footers {
+			opts = append(opts, WithPageChecksums())
+		}
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", opts...)
+		require.NoError(t, err)
+		require.NoError(t, block.WriteBatch(ids, objs))
+		assert.Equal(t, len(ids), block.Meta().TotalObjects)
+
+		pages := map[uint64]int{}
+		for _, r := range block.appender.Records() {
+			pages[r.Start]++
+		}
+		// 100 byte objects, 10 per page, and the duplicate id
+		assert.Len(t, pages, 6)
+
+		check := func(b *AppendBlock) {
+			found, err := b.FindAll(ids[20])
+			require.NoError(t, err)
+			assert.Equal(t, [][]byte{objs[20], objs[21]}, found)
+
+			for i, id := range ids {
+				if i == 20 || i == 21 {
+					continue
+				}
+				obj, err := b.Find(context.Background(), id, &mockCombiner{})
+				require.NoError(t, err)
+				assert.Equal(t, objs[i], obj)
+			}
+
+			iter, err := b.GetIterator(context.Background(), &mockCombiner{})
+			require.NoError(t, err)
+			defer iter.Close()
+			count := 0
+			for {
+				id, _, err := iter.Next(context.Background())
+				if err == io.EOF || id == nil {
+					break
+				}
+				require.NoError(t, err)
+				count++
+			}
+			assert.Equal(t, len(ids)-1, count)
+		}
+		check(block)
+
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, opts...)
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		assert.Equal(t, sortedRecords(block.appender.Records()), sortedRecords(replayed.appender.Records()))
+		check(replayed)
+
+		if !footers {
+			continue
+		}
+
+		// a torn page loses all of its objects, the last page holds 9
+		info, err := os.Stat(block.fullFilename())
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(block.fullFilename(), info.Size()-1))
+		replayed, warning, err = newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, opts...)
+		require.NoError(t, err)
+		require.Error(t, warning)
+		assert.Len(t, replayed.appender.Records(), len(ids)-9)
+	}
+}
+
+func TestBatchedPagesWriteBatchFailure(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithBatchedPages(1000), WithMaxRecords(15))
+	require.NoError(t, err)
+
+	// the objects before the failure are written, including the ones sharing its page
+	ids, objs := makeTestBatch(20)
+	err = block.WriteBatch(ids, objs)
+	var batchErr *ErrWriteBatch
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 15, batchErr.Index)
+	assert.ErrorIs(t, err, ErrBlockFull)
+	assert.Equal(t, 15, block.appender.Length())
+	assert.Equal(t, 15, block.Meta().TotalObjects)
+
+	for i, id := range ids[:15] {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+}
+
+// sortedRecords sorts records by id and start
+func TestPageObjects(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	ids, objs := makeSmallObjects(20)
+
+	single, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithPageObjects(SingleObjectPages))
+	require.NoError(t, err)
+	require.NoError(t, single.WriteBatch(ids, objs))
+
+	multi, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithBatchedPages(1000))
+	require.NoError(t, err)
+	require.NoError(t, multi.WriteBatch(ids[:10], objs[:10]))
+	// a page of its own after the batched pages
+	require.NoError(t, multi.Write(ids[10], objs[10]))
+
+	for _, pageObjects := range []PageObjects{MultiObjectPages, SingleObjectPages} {
+		replayed, warning, err := newAppendBlockFromFile(filepath.Base(single.fullFilename()), tempDir, WithPageObjects(pageObjects))
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		assert.Equal(t, sortedRecords(single.appender.Records()), sortedRecords(replayed.appender.Records()))
+		replayed.closeReadFile()
+	}
+
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(multi.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Equal(t, sortedRecords(multi.appender.Records()), sortedRecords(replayed.appender.Records()))
+	replayed.closeReadFile()
+
+	// expecting single object pages stops at the first batched page
+	replayed, warning, err = newAppendBlockFromFile(filepath.Base(multi.fullFilename()), tempDir, WithPageObjects(SingleObjectPages))
+	require.NoError(t, err)
+	assert.Equal(t, ErrMultiObjectPage, warning)
+	assert.Equal(t, 0, replayed.appender.Length())
+	replayed.closeReadFile()
+
+	_, err = newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithBatchedPages(1000), WithPageObjects(SingleObjectPages))
+	assert.Error(t, err)
+}
+
+func sortedRecords(records []common.Record) []common.Record {
+	sort.Slice(records, func(i, j int) bool {
+		if c := bytes.Compare(records[i].ID, records[j].ID); c != 0 {
+			return c < 0
+		}
+		return records[i].Start < records[j].Start
+	})
+	return records
+}
+
+// BenchmarkBatchedPages reports the bytes written per object for small objects written a page each and in batched
+// pages
+func BenchmarkBatchedPages(b *testing.B) {
+	for _, pageSize := range []int{0, 1024, 16 * 1024} {
+		for _, enc := range []backend.Encoding{backend.EncNone, backend.EncSnappy} {
+			b.Run(fmt.Sprintf("%s/page-size-%d", enc, pageSize), func(b *testing.B) {
+				tempDir, err := ioutil.TempDir("/tmp", "")
+				defer os.RemoveAll(tempDir)
+				require.NoError(b, err, "unexpected error creating temp dir")
+
+				ids, objs := makeSmallObjects(1000)
+				var written uint64
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, enc, "", WithBatchedPages(pageSize))
+					require.NoError(b, err)
+					require.NoError(b, block.WriteBatch(ids, objs))
+					written += block.DataLength()
+					require.NoError(b, block.Clear())
+				}
+				b.ReportMetric(float64(written)/float64(b.N*len(ids)), "bytes/object")
+			})
+		}
+	}
+}
+
+// makeSmallObjects returns count ids and small, somewhat compressible objects
+func makeSmallObjects(count int) ([]common.ID, [][]byte) {
+	ids, objs := makeTestBatch(count)
+	for i := range objs {
+		objs[i] = append(objs[i][:16], "service.name=frontend"...)
+	}
+	return ids, objs
+}
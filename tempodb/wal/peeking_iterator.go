@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// PeekingIterator iterates the combined objects of a block in id order. The id of the next object is known from
+// the index so callers can PeekID and Skip objects they are not interested in without reading their pages.
+type PeekingIterator struct {
+	records  []common.Record
+	dataR    common.DataReader
+	objectRW common.ObjectReaderWriter
+	combiner common.ObjectCombiner
+
+	dataEncoding string
+	pages        [][]byte
+	buffer       []byte
+}
+
+// GetPeekingIterator returns a PeekingIterator over the block. Like GetIteratorForIDs this does not prevent
+// further appends, objects appended after the call are not returned.
+func (a *AppendBlock) GetPeekingIterator(combiner common.ObjectCombiner) (*PeekingIterator, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	if a.missingIndex() {
+		return nil, ErrNoIndex
+	}
+
+	records := []common.Record(a.index)
+	if records == nil {
+		records = a.appender.Records()
+	}
+
+	readFile, err := a.file()
+	if err != nil {
+		return nil, err
+	}
+
+	dataReader, err := a.newDataReader(readFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dataReader, objectRW, combiner := a.instrumentRead(dataReader, a.encoding.NewObjectReaderWriter(), combiner)
+	return &PeekingIterator{
+		records:      records,
+		dataR:        dataReader,
+		objectRW:     objectRW,
+		combiner:     combiner,
+		dataEncoding: a.meta.DataEncoding,
+	}, nil
+}
+
+// PeekID returns the id of the object the next call to Next will return. It returns false if the iterator is exhausted.
+func (i *PeekingIterator) PeekID() (common.ID, bool) {
+	if len(i.records) == 0 {
+		return nil, false
+	}
+	return i.records[0].ID, true
+}
+
+// Skip advances past the next object without reading it
+func (i *PeekingIterator) Skip() {
+	_ = i.advance()
+}
+
+// Next reads and combines the records of the next object. It returns io.EOF when the iterator is exhausted.
+func (i *PeekingIterator) Next(ctx context.Context) (common.ID, []byte, error) {
+	records := i.advance()
+	if len(records) == 0 {
+		return nil, nil, io.EOF
+	}
+
+	var id common.ID
+	var obj []byte
+	for _, r := range records {
+		var recordObj []byte
+		var err error
+		recordObj, i.pages, i.buffer, err = readRecordObject(ctx, i.dataR, i.objectRW, r, i.pages, i.buffer)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if obj == nil {
+			id = append([]byte(nil), r.ID...)
+			obj = recordObj
+			continue
+		}
+		obj, _ = i.combiner.Combine(i.dataEncoding, obj, recordObj)
+	}
+
+	return id, obj, nil
+}
+
+// Close releases the iterator's reader
+func (i *PeekingIterator) Close() {
+	i.dataR.Close()
+}
+
+// advance removes and returns the records for the next id
+func (i *PeekingIterator) advance() []common.Record {
+	n := 0
+	for n < len(i.records) && bytes.Equal(i.records[n].ID, i.records[0].ID) {
+		n++
+	}
+
+	records := i.records[:n]
+	i.records = i.records[n:]
+	return records
+}
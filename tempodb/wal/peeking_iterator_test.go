@@ -0,0 +1,81 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+func TestPeekingIterator(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	sink := newTestTimingSink()
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithReadTimings(sink))
+	require.NoError(t, err)
+
+	objects := 20
+	ids, objs := writeTestObjects(t, block, objects)
+	// a shorter duplicate of the first id is combined away
+	err = block.Write(ids[0], objs[0][:10])
+	require.NoError(t, err)
+
+	expected := map[string][]byte{}
+	for i, id := range ids {
+		expected[string(id)] = objs[i]
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i], ids[j]) < 0
+	})
+
+	iter, err := block.GetPeekingIterator(&mockCombiner{})
+	require.NoError(t, err)
+	defer iter.Close()
+
+	// read every other id
+	read := 0
+	for i := 0; ; i++ {
+		id, ok := iter.PeekID()
+		if !ok {
+			break
+		}
+		require.Equal(t, common.ID(ids[i]), id)
+
+		if i%2 == 1 {
+			iter.Skip()
+			continue
+		}
+
+		actualID, obj, err := iter.Next(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, id, actualID)
+		assert.Equal(t, expected[string(id)], obj)
+		read++
+	}
+	assert.Equal(t, objects/2, read)
+
+	_, _, err = iter.Next(context.Background())
+	assert.Equal(t, io.EOF, err)
+
+	// skipped objects are never read or decoded
+	pages := 0
+	for i, id := range ids {
+		if i%2 == 0 {
+			pages += len(block.appender.RecordsForID(id))
+		}
+	}
+	assert.Equal(t, pages, sink.calls[ReadStagePage])
+	assert.Equal(t, pages, sink.calls[ReadStageDecode])
+}
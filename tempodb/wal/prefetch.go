@@ -0,0 +1,38 @@
+package wal
+
+import (
+	"io"
+)
+
+const prefetchChunkSize = 1024 * 1024
+
+// Prefetch is a best effort attempt to warm the OS page cache with the block's file before a burst of
+// reads. On Linux the kernel is asked to read the file ahead, elsewhere the file is read sequentially.
+func (a *AppendBlock) Prefetch() error {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	file, err := a.file()
+	if err != nil {
+		return err
+	}
+
+	if fadviseWillNeed(file) == nil {
+		return nil
+	}
+
+	buffer := make([]byte, prefetchChunkSize)
+	for off := int64(0); ; off += int64(len(buffer)) {
+		_, err = file.ReadAt(buffer, off)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
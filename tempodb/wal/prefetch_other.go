@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package wal
+
+import (
+	"os"
+
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// fadviseWillNeed is unsupported off Linux, Prefetch falls back to reading the file
+func fadviseWillNeed(*os.File) error {
+	return common.ErrUnsupported
+}
@@ -0,0 +1,50 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestPrefetch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 10000)
+
+	err = block.Prefetch()
+	require.NoError(t, err)
+
+	// reads after a prefetch should be served from the page cache. the bound is lenient to
+	// avoid flaking on slow machines.
+	start := time.Now()
+	for i, id := range ids {
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestPrefetchMissingFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(block.fullFilename()))
+
+	assert.Error(t, block.Prefetch())
+}
@@ -0,0 +1,75 @@
+package wal
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/tempo/pkg/model"
+	"github.com/grafana/tempo/pkg/tempopb"
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// GetIteratorForRange is GetIterator but only returns the combined objects with a span that overlaps start to end,
+// inclusive. Records do not hold the time of their objects so every object is unmarshalled as a trace with the block's
+// data encoding to be filtered, which is much more expensive than GetIterator. Objects without spans are skipped. Like
+// GetIterator, the block can not be appended to afterwards.
+func (a *AppendBlock) GetIteratorForRange(start, end time.Time, combiner common.ObjectCombiner) (encoding.Iterator, error) {
+	iter, err := a.GetIterator(context.Background(), combiner)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rangeIterator{
+		Iterator:     iter,
+		start:        uint64(start.UnixNano()),
+		end:          uint64(end.UnixNano()),
+		dataEncoding: a.Meta().DataEncoding,
+	}, nil
+}
+
+// rangeIterator skips objects whose spans are all outside start to end
+type rangeIterator struct {
+	encoding.Iterator
+	start        uint64
+	end          uint64
+	dataEncoding string
+}
+
+func (i *rangeIterator) Next(ctx context.Context) (common.ID, []byte, error) {
+	for {
+		id, obj, err := i.Iterator.Next(ctx)
+		if err != nil || id == nil {
+			return id, obj, err
+		}
+
+		trace, err := model.Unmarshal(obj, i.dataEncoding)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		traceStart, traceEnd, ok := traceRange(trace)
+		if ok && traceStart <= i.end && traceEnd >= i.start {
+			return id, obj, nil
+		}
+	}
+}
+
+// traceRange returns the earliest span start and latest span end of trace in unix nanoseconds. ok is false if the
+// trace has no spans.
+func traceRange(trace *tempopb.Trace) (start uint64, end uint64, ok bool) {
+	for _, b := range trace.Batches {
+		for _, ils := range b.InstrumentationLibrarySpans {
+			for _, s := range ils.Spans {
+				if !ok || s.StartTimeUnixNano < start {
+					start = s.StartTimeUnixNano
+				}
+				if !ok || s.EndTimeUnixNano > end {
+					end = s.EndTimeUnixNano
+				}
+				ok = true
+			}
+		}
+	}
+	return start, end, ok
+}
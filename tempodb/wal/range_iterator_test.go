@@ -0,0 +1,93 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/pkg/model"
+	"github.com/grafana/tempo/pkg/util/test"
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestGetIteratorForRange(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, model.CurrentEncoding)
+	require.NoError(t, err)
+
+	names := map[string]string{}
+	base := time.Unix(1000, 0)
+	start := base.Add(10 * time.Second)
+	end := base.Add(20 * time.Second)
+
+	tests := []struct {
+		name     string
+		start    time.Duration
+		end      time.Duration
+		expected bool
+	}{
+		{name: "before", start: 0, end: 5 * time.Second},
+		{name: "spans start", start: 5 * time.Second, end: 15 * time.Second, expected: true},
+		{name: "inside", start: 12 * time.Second, end: 18 * time.Second, expected: true},
+		{name: "spans end", start: 15 * time.Second, end: 25 * time.Second, expected: true},
+		{name: "spans range", start: 5 * time.Second, end: 25 * time.Second, expected: true},
+		{name: "ends at start", start: 5 * time.Second, end: 10 * time.Second, expected: true},
+		{name: "after", start: 21 * time.Second, end: 25 * time.Second},
+	}
+
+	var expected []string
+	for _, tc := range tests {
+		id := uuid.New()
+		trace := test.MakeTraceWithSpanCount(1, 1, id[:])
+		span := trace.Batches[0].InstrumentationLibrarySpans[0].Spans[0]
+		span.StartTimeUnixNano = uint64(base.Add(tc.start).UnixNano())
+		span.EndTimeUnixNano = uint64(base.Add(tc.end).UnixNano())
+
+		obj, err := model.TraceCombiner.Marshal(trace, model.CurrentEncoding)
+		require.NoError(t, err)
+		require.NoError(t, block.Write(id[:], obj))
+
+		if tc.expected {
+			expected = append(expected, tc.name)
+		}
+		names[string(id[:])] = tc.name
+	}
+
+	// a trace with no spans is skipped
+	empty, err := model.TraceCombiner.Marshal(test.MakeTraceWithSpanCount(0, 0, nil), model.CurrentEncoding)
+	require.NoError(t, err)
+	emptyID := uuid.New()
+	require.NoError(t, block.Write(emptyID[:], empty))
+
+	iter, err := block.GetIteratorForRange(start, end, model.ObjectCombiner)
+	require.NoError(t, err)
+	defer iter.Close()
+
+	var actual []string
+	for {
+		id, obj, err := iter.Next(context.Background())
+		if err == io.EOF || id == nil {
+			break
+		}
+		require.NoError(t, err)
+
+		trace, err := model.Unmarshal(obj, model.CurrentEncoding)
+		require.NoError(t, err)
+		traceStart, traceEnd, ok := traceRange(trace)
+		require.True(t, ok)
+		assert.LessOrEqual(t, traceStart, uint64(end.UnixNano()))
+		assert.GreaterOrEqual(t, traceEnd, uint64(start.UnixNano()))
+		actual = append(actual, names[string(id)])
+	}
+	assert.ElementsMatch(t, expected, actual)
+}
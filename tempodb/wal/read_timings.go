@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// ReadStage is a stage of reading objects from a block
+type ReadStage string
+
+const (
+	// ReadStagePage is time spent reading and decompressing pages
+	ReadStagePage ReadStage = "page"
+	// ReadStageDecode is time spent unmarshalling objects from pages
+	ReadStageDecode ReadStage = "decode"
+	// ReadStageCombine is time spent combining objects with the same id
+	ReadStageCombine ReadStage = "combine"
+)
+
+// ReadTimingSink receives the time spent in each stage of Find and the block iterators. Observe is called
+// once per page read, object decoded and combine.
+type ReadTimingSink interface {
+	Observe(stage ReadStage, d time.Duration)
+}
+
+// instrumentRead wraps the pieces of a read so their timings are reported to the sink configured with
+// WithReadTimings. They are returned unchanged if no sink is set. A nil combiner is not wrapped.
+func (a *AppendBlock) instrumentRead(dataReader common.DataReader, objectRW common.ObjectReaderWriter, combiner common.ObjectCombiner) (common.DataReader, common.ObjectReaderWriter, common.ObjectCombiner) {
+	if a.readTimings == nil {
+		return dataReader, objectRW, combiner
+	}
+
+	if combiner != nil {
+		combiner = &timedCombiner{combiner: combiner, sink: a.readTimings}
+	}
+	return &timedDataReader{DataReader: dataReader, sink: a.readTimings},
+		&timedObjectReaderWriter{ObjectReaderWriter: objectRW, sink: a.readTimings},
+		combiner
+}
+
+type timedDataReader struct {
+	common.DataReader
+	sink ReadTimingSink
+}
+
+// Read implements common.DataReader
+func (t *timedDataReader) Read(ctx context.Context, records []common.Record, pagesBuffer [][]byte, buffer []byte) ([][]byte, []byte, error) {
+	start := time.Now()
+	defer func() { t.sink.Observe(ReadStagePage, time.Since(start)) }()
+
+	return t.DataReader.Read(ctx, records, pagesBuffer, buffer)
+}
+
+// NextPage implements common.DataReader
+func (t *timedDataReader) NextPage(buffer []byte) ([]byte, uint32, error) {
+	start := time.Now()
+	defer func() { t.sink.Observe(ReadStagePage, time.Since(start)) }()
+
+	return t.DataReader.NextPage(buffer)
+}
+
+type timedObjectReaderWriter struct {
+	common.ObjectReaderWriter
+	sink ReadTimingSink
+}
+
+// UnmarshalObjectFromReader implements common.ObjectReaderWriter
+func (t *timedObjectReaderWriter) UnmarshalObjectFromReader(r io.Reader) (common.ID, []byte, error) {
+	start := time.Now()
+	defer func() { t.sink.Observe(ReadStageDecode, time.Since(start)) }()
+
+	return t.ObjectReaderWriter.UnmarshalObjectFromReader(r)
+}
+
+// UnmarshalAndAdvanceBuffer implements common.ObjectReaderWriter
+func (t *timedObjectReaderWriter) UnmarshalAndAdvanceBuffer(buffer []byte) ([]byte, common.ID, []byte, error) {
+	start := time.Now()
+	defer func() { t.sink.Observe(ReadStageDecode, time.Since(start)) }()
+
+	return t.ObjectReaderWriter.UnmarshalAndAdvanceBuffer(buffer)
+}
+
+type timedCombiner struct {
+	combiner common.ObjectCombiner
+	sink     ReadTimingSink
+}
+
+// Combine implements common.ObjectCombiner
+func (t *timedCombiner) Combine(dataEncoding string, objs ...[]byte) ([]byte, bool) {
+	start := time.Now()
+	defer func() { t.sink.Observe(ReadStageCombine, time.Since(start)) }()
+
+	return t.combiner.Combine(dataEncoding, objs...)
+}
@@ -0,0 +1,86 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+type testTimingSink struct {
+	mtx     sync.Mutex
+	timings map[ReadStage]time.Duration
+	calls   map[ReadStage]int
+}
+
+func (s *testTimingSink) Observe(stage ReadStage, d time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.timings[stage] += d
+	s.calls[stage]++
+}
+
+func newTestTimingSink() *testTimingSink {
+	return &testTimingSink{
+		timings: map[ReadStage]time.Duration{},
+		calls:   map[ReadStage]int{},
+	}
+}
+
+func TestReadTimings(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	sink := newTestTimingSink()
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithReadTimings(sink))
+	require.NoError(t, err)
+
+	// write every id twice so reads have to combine
+	ids, objs := writeTestObjects(t, block, 10)
+	for i, id := range ids {
+		err = block.Write(id, objs[i][:50])
+		require.NoError(t, err)
+	}
+
+	obj, err := block.Find(context.Background(), ids[0], &mockCombiner{})
+	require.NoError(t, err)
+	assert.Equal(t, objs[0], obj)
+
+	for _, stage := range []ReadStage{ReadStagePage, ReadStageDecode, ReadStageCombine} {
+		assert.Greater(t, sink.calls[stage], 0, stage)
+		assert.Greater(t, sink.timings[stage], time.Duration(0), stage)
+	}
+
+	sink = newTestTimingSink()
+	block.readTimings = sink
+	iter, err := block.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	defer iter.Close()
+
+	count := 0
+	for {
+		_, _, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		count++
+	}
+	assert.Equal(t, len(ids), count)
+
+	for _, stage := range []ReadStage{ReadStagePage, ReadStageDecode, ReadStageCombine} {
+		assert.Greater(t, sink.calls[stage], 0, stage)
+		assert.Greater(t, sink.timings[stage], time.Duration(0), stage)
+	}
+}
@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// RepairWAL truncates the wal file at the end of the last page that replays cleanly so that a file with a torn or
+// corrupt tail replays without a warning on the next start. Pages before it are never modified and nothing is done
+// if the file replays cleanly. Pass the options the file was written with, such as WithPageFooters.
+func RepairWAL(filename string, path string, opts ...AppendBlockOption) error {
+	b, err := blockFromFilename(filename, path, opts...)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(b.fullFilename(), os.O_RDWR, b.fileMode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var length uint64
+	warning, err := b.walkPages(file, filename, 0, func(_ common.ID, start uint64, pageLength uint32) {
+		length = start + uint64(pageLength)
+	})
+	if err != nil {
+		return err
+	}
+	if warning == nil {
+		return nil
+	}
+
+	err = file.Truncate(int64(length))
+	if err != nil {
+		return fmt.Errorf("error truncating %s at %d: %w", filename, length, err)
+	}
+	return file.Sync()
+}
+
+// Repair writes the pages of the block's file that replay cleanly to a new temporary file and returns its path.
+// Anything after the first page that fails to replay is dropped. The original file is not modified, use SwapIn
+// to replace it with the repaired file.
+func (a *AppendBlock) Repair() (string, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return "", ErrBlockCleared
+	}
+
+	// replay reads the file from its current offset so open a new handle instead of using a.file()
+	file, err := os.Open(a.fullFilename())
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	records, _, err := a.replay(file, filepath.Base(a.fullFilename()))
+	if err != nil {
+		return "", err
+	}
+
+	length := int64(recordsLength(records))
+
+	repaired, err := a.createTemp(a.meta.BlockID.String() + repairFileMarker)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(repaired, io.NewSectionReader(file, 0, length))
+	if err == nil {
+		err = repaired.Sync()
+	}
+	if closeErr := repaired.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(repaired.Name())
+		return "", err
+	}
+
+	return repaired.Name(), nil
+}
+
+// SwapIn atomically replaces the block's file with the repaired file at repairedPath, which must be on the same
+// volume. The repaired file must replay cleanly and, if it is named like a wal file, belong to this block. Readers
+// that already have the original open, such as iterators, continue to see it until the read file is closed by
+// CloseRead, Close or Clear. New readers see the repaired file and the records replayed from it. The block can not be
+// appended to afterwards.
+func (a *AppendBlock) SwapIn(repairedPath string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return ErrBlockCleared
+	}
+
+	if a.appendFile != nil {
+		return errors.New("can not swap in a file for a block that is being appended to")
+	}
+
+	name := filepath.Base(repairedPath)
+	if IsWALFile(name) {
+		blockID, tenantID, _, _, _, err := parseFilename(name)
+		if err != nil {
+			return err
+		}
+		if blockID != a.meta.BlockID || tenantID != a.meta.TenantID {
+			return fmt.Errorf("repaired file %s does not belong to block %v for tenant %s", name, a.meta.BlockID, a.meta.TenantID)
+		}
+	}
+
+	f, err := os.OpenFile(repairedPath, os.O_RDONLY, a.fileMode)
+	if err != nil {
+		return err
+	}
+
+	records, warning, err := a.replay(f, name)
+	if err == nil && warning != nil {
+		err = fmt.Errorf("repaired file %s does not replay cleanly: %w", name, warning)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	err = os.Rename(repairedPath, a.fullFilename())
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	// the checkpoint indexes the original file
+	err = os.Remove(a.checkpointFilename())
+	if err != nil && !os.IsNotExist(err) {
+		_ = f.Close()
+		return err
+	}
+
+	// f still refers to the repaired file after the rename. If the original is open readers may still be using it so
+	// it is kept open, and f takes its place and its slot. Otherwise the next read opens the repaired file.
+	a.unmapFile()
+	if a.readFile != nil {
+		a.swappedReadFiles = append(a.swappedReadFiles, a.readFile)
+		a.readFile = f
+	} else {
+		_ = f.Close()
+	}
+
+	common.SortRecords(records)
+	a.appender = encoding.NewRecordAppender(records)
+	a.records = len(records)
+	a.meta.TotalObjects = a.appender.Length()
+	a.index = nil
+
+	return nil
+}
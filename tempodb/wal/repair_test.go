@@ -0,0 +1,246 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestRepairSwapIn(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+
+	objects := 50
+	ids, objs := writeTestObjects(t, block, objects)
+	appendGarbage(t, block.fullFilename())
+
+	filename := filepath.Base(block.fullFilename())
+	replayed, warning, err := newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	require.Error(t, warning)
+
+	repairedPath, err := replayed.Repair()
+	require.NoError(t, err)
+	info, err := os.Stat(repairedPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(block.DataLength()), info.Size())
+	assert.Equal(t, tempDir, filepath.Dir(repairedPath))
+
+	// readers replay the file continuously while it is swapped and should always see every object
+	done := atomic.NewBool(false)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !done.Load() {
+			b, _, err := newAppendBlockFromFile(filename, tempDir)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, objects, b.appender.Length())
+			b.closeReadFile()
+		}
+	}()
+
+	err = replayed.SwapIn(repairedPath)
+	require.NoError(t, err)
+	done.Store(true)
+	wg.Wait()
+
+	assert.NoFileExists(t, repairedPath)
+	for i, id := range ids {
+		obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	_, warning, err = newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	assert.NoError(t, warning)
+}
+
+func TestSwapInKeepsOpenReaders(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	SetMaxOpenReadFiles(1)
+	defer SetMaxOpenReadFiles(0)
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithIndexCheckpoints(1))
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, block, 10)
+	require.NoError(t, block.Close())
+	appendGarbage(t, block.fullFilename())
+
+	filename := filepath.Base(block.fullFilename())
+	replayed, _, err := newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	repairedPath, err := replayed.Repair()
+	require.NoError(t, err)
+
+	iter, err := replayed.GetIterator(context.Background(), &mockCombiner{})
+	require.NoError(t, err)
+	defer iter.Close()
+	id, _, err := iter.Next(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, id)
+
+	// the block's slot is reused so swapping does not wait for a slot at the limit
+	swapped := make(chan error)
+	go func() { swapped <- replayed.SwapIn(repairedPath) }()
+	select {
+	case err = <-swapped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("SwapIn blocked")
+	}
+	assert.NoFileExists(t, replayed.checkpointFilename())
+
+	// the iterator keeps reading the original file
+	count := 1
+	for {
+		_, _, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		count++
+	}
+	assert.Equal(t, len(ids), count)
+
+	for i, id := range ids {
+		obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	// closing the read file closes the original too and releases the slot for the next block
+	require.NoError(t, replayed.CloseRead())
+	assert.Empty(t, replayed.swappedReadFiles)
+
+	// the block uses the records of the repaired file
+	repaired, warning, err := newAppendBlockFromFile(filename, tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Equal(t, repaired.appender.Records(), replayed.appender.Records())
+	require.NoError(t, repaired.Clear())
+}
+
+func TestSwapInValidates(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	_, _ = writeTestObjects(t, block, 5)
+
+	// blocks being appended to can't be swapped
+	assert.Error(t, block.SwapIn(block.fullFilename()))
+
+	replayed, _, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir)
+	require.NoError(t, err)
+
+	// another block's file
+	other, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	_, _ = writeTestObjects(t, other, 5)
+	assert.Error(t, replayed.SwapIn(other.fullFilename()))
+	assert.FileExists(t, other.fullFilename())
+
+	// a file that doesn't replay cleanly
+	corrupt := filepath.Join(tempDir, "corrupt")
+	err = os.WriteFile(corrupt, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}, 0644)
+	require.NoError(t, err)
+	assert.Error(t, replayed.SwapIn(corrupt))
+	assert.FileExists(t, corrupt)
+}
+
+func TestRepairWAL(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []AppendBlockOption
+		corrupt func(t *testing.T, block *AppendBlock)
+		objects int
+	}{
+		{
+			name:    "clean",
+			corrupt: func(t *testing.T, block *AppendBlock) {},
+			objects: 10,
+		},
+		{
+			name: "trailing garbage",
+			corrupt: func(t *testing.T, block *AppendBlock) {
+				appendGarbage(t, block.fullFilename())
+			},
+			objects: 10,
+		},
+		{
+			name: "torn last page",
+			opts: []AppendBlockOption{WithPageFooters()},
+			corrupt: func(t *testing.T, block *AppendBlock) {
+				require.NoError(t, os.Truncate(block.fullFilename(), int64(block.DataLength())-5))
+			},
+			objects: 9,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", tc.opts...)
+			require.NoError(t, err)
+			ids, objs := writeTestObjects(t, block, 10)
+			tc.corrupt(t, block)
+
+			before, err := ioutil.ReadFile(block.fullFilename())
+			require.NoError(t, err)
+
+			filename := filepath.Base(block.fullFilename())
+			require.NoError(t, RepairWAL(filename, tempDir, tc.opts...))
+
+			after, err := ioutil.ReadFile(block.fullFilename())
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(after), len(before))
+			assert.Equal(t, before[:len(after)], after, "valid data is not modified")
+
+			replayed, warning, err := newAppendBlockFromFile(filename, tempDir, tc.opts...)
+			require.NoError(t, err)
+			assert.NoError(t, warning)
+			assert.Equal(t, tc.objects, replayed.appender.Length())
+			for i, id := range ids[:tc.objects] {
+				obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+				require.NoError(t, err)
+				assert.Equal(t, objs[i], obj)
+			}
+
+			// repairing again does nothing
+			require.NoError(t, RepairWAL(filename, tempDir, tc.opts...))
+			again, err := ioutil.ReadFile(block.fullFilename())
+			require.NoError(t, err)
+			assert.Equal(t, after, again)
+		})
+	}
+
+	assert.Error(t, RepairWAL("not-a-wal-file", "/tmp"))
+}
@@ -0,0 +1,56 @@
+package wal
+
+import (
+	"os"
+)
+
+// replayProgressBytes is the number of bytes replayed between calls to a ReplayProgressFunc
+const replayProgressBytes = 4 * 1024 * 1024 // 4 MiB
+
+// ReplayProgressFunc is called while a wal file is replayed with the number of bytes of the file processed so far
+// and the size of the file. It is called about every 4 MiB and once when replay of the file ends.
+type ReplayProgressFunc func(processed uint64, total uint64)
+
+// replayProgress throttles calls to a ReplayProgressFunc. A nil replayProgress does nothing.
+type replayProgress struct {
+	fn    ReplayProgressFunc
+	total uint64
+	next  uint64
+}
+
+// newReplayProgress returns nil if the block has no ReplayProgressFunc or the size of f is unknown
+func (a *AppendBlock) newReplayProgress(f *os.File, start uint64) *replayProgress {
+	if a.replayProgress == nil {
+		return nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+
+	return &replayProgress{
+		fn:    a.replayProgress,
+		total: uint64(info.Size()),
+		next:  start + replayProgressBytes,
+	}
+}
+
+// processed reports progress if at least replayProgressBytes were replayed since it was last reported
+func (p *replayProgress) processed(offset uint64) {
+	if p == nil || offset < p.next {
+		return
+	}
+
+	p.fn(offset, p.total)
+	p.next = offset + replayProgressBytes
+}
+
+// done reports the final offset
+func (p *replayProgress) done(offset uint64) {
+	if p == nil {
+		return
+	}
+
+	p.fn(offset, p.total)
+}
@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestReplayProgress(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	obj := make([]byte, 10*1024)
+	for i := 0; i < 1000; i++ {
+		id := uuid.New()
+		require.NoError(t, block.Write(id[:], obj))
+	}
+	total := block.DataLength()
+
+	type call struct {
+		processed uint64
+		total     uint64
+	}
+	var calls []call
+	progress := WithReplayProgress(func(processed uint64, total uint64) {
+		calls = append(calls, call{processed, total})
+	})
+
+	_, warning, err := newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, progress)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+
+	// throttled to about every 4 MiB plus the final call
+	require.Len(t, calls, int(total/replayProgressBytes)+1)
+	for i, c := range calls {
+		assert.Equal(t, total, c.total)
+		if i > 0 {
+			assert.Greater(t, c.processed, calls[i-1].processed)
+		}
+	}
+	assert.Equal(t, total, calls[len(calls)-1].processed)
+
+	// torn files end where replay stopped
+	appendGarbage(t, block.fullFilename())
+	calls = nil
+	_, warning, err = newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, progress)
+	require.NoError(t, err)
+	require.Error(t, warning)
+	assert.Equal(t, total, calls[len(calls)-1].processed)
+	assert.Greater(t, calls[len(calls)-1].total, total)
+
+	// no callback is fine
+	_, _, err = newAppendBlockFromFile(filepath.Base(block.fullFilename()), tempDir, WithReplayProgress(nil))
+	require.NoError(t, err)
+}
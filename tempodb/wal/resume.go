@@ -0,0 +1,94 @@
+package wal
+
+import (
+	"errors"
+	"os"
+
+	"github.com/grafana/tempo/tempodb/encoding"
+)
+
+// ResumeAppendBlock replays the wal file filename in path and reopens it so the block can be appended to after a
+// restart instead of being completed. Anything after the pages that replayed cleanly, such as a page torn by a crash,
+// is truncated first and the replay warning is returned. Pass the options the file was written with. Blocks with a
+// mirror can not be resumed.
+func ResumeAppendBlock(filename string, path string, opts ...AppendBlockOption) (*AppendBlock, error, error) {
+	b, warning, err := newAppendBlockFromFile(filename, path, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = b.resume()
+	if err != nil {
+		b.closeReadFile()
+		return nil, nil, err
+	}
+
+	return b, warning, nil
+}
+
+// resume reopens the file of a replayed block for appending after its replayed records
+func (a *AppendBlock) resume() error {
+	if a.mirrorPath != "" {
+		return errors.New("blocks with a mirror can not be resumed")
+	}
+
+	f, err := os.OpenFile(a.fullFilename(), os.O_APPEND|os.O_WRONLY|a.appendFlags, a.fileMode)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	length := replayedLength(a)
+	if uint64(info.Size()) > length {
+		err = f.Truncate(int64(length))
+		if err == nil {
+			err = f.Sync()
+		}
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+
+		// the checkpoint may cover truncated pages. the next checkpoint rewrites it
+		err = os.Remove(a.checkpointFilename())
+		if err != nil && !os.IsNotExist(err) {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	dataWriter, err := a.newDataWriter(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	records := a.appender.Records()
+	if a.indexless {
+		appender := newIndexlessAppender(dataWriter)
+		appender.length = len(records)
+		appender.currentOffset = length
+		a.appender = appender
+	} else {
+		appender := encoding.NewAppender(dataWriter)
+		appender.(encoding.RecordImporter).ImportRecords(records, length)
+		a.appender = appender
+	}
+
+	a.appendFile = f
+	a.appendWriter = f
+	a.records = len(records)
+	a.meta.TotalObjects = len(records)
+	if len(records) > 0 {
+		a.meta.ObjectsAdded(records[0].ID, records[len(records)-1].ID, 0)
+	}
+	a.checkpointedLength = 0
+	a.index = nil
+
+	return nil
+}
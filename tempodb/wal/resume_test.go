@@ -0,0 +1,74 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestResumeAppendBlock(t *testing.T) {
+	for _, opts := range [][]AppendBlockOption{nil, {WithPageChecksums()}, {WithIndexCheckpoints(2)}} {
+		tempDir, err := ioutil.TempDir("/tmp", "")
+		defer os.RemoveAll(tempDir)
+		require.NoError(t, err, "unexpected error creating temp dir")
+
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", opts...)
+		require.NoError(t, err)
+		ids, objs := writeTestObjects(t, block, 5)
+		filename := filepath.Base(block.fullFilename())
+
+		// the process is killed while writing a page
+		appendGarbage(t, block.fullFilename())
+
+		resumed, warning, err := ResumeAppendBlock(filename, tempDir, opts...)
+		require.NoError(t, err)
+		require.Error(t, warning)
+		assert.Equal(t, block.DataLength(), resumed.DataLength())
+		assert.Equal(t, 5, resumed.Meta().TotalObjects)
+
+		moreIDs, moreObjs := writeTestObjects(t, resumed, 3)
+		ids, objs = append(ids, moreIDs...), append(objs, moreObjs...)
+		assert.Equal(t, 8, resumed.Meta().TotalObjects)
+		for i, id := range ids {
+			obj, err := resumed.Find(context.Background(), id, &mockCombiner{})
+			require.NoError(t, err)
+			assert.Equal(t, objs[i], obj)
+		}
+
+		// a second restart replays everything
+		replayed, warning, err := newAppendBlockFromFile(filename, tempDir, opts...)
+		require.NoError(t, err)
+		require.NoError(t, warning)
+		assert.Equal(t, resumed.DataLength(), replayedLength(replayed))
+		assert.Equal(t, resumed.appender.Records(), replayed.appender.Records())
+		for i, id := range ids {
+			obj, err := replayed.Find(context.Background(), id, &mockCombiner{})
+			require.NoError(t, err)
+			assert.Equal(t, objs[i], obj)
+		}
+	}
+}
+
+func TestResumeAppendBlockMirror(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+	mirrorDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(mirrorDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithMirror(mirrorDir))
+	require.NoError(t, err)
+	writeTestObjects(t, block, 2)
+
+	_, _, err = ResumeAppendBlock(filepath.Base(block.fullFilename()), tempDir, WithMirror(mirrorDir))
+	assert.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// WALBlockReport describes a file found by ScanWALDir. It is meant to be serialized as JSON by tooling.
+type WALBlockReport struct {
+	// Filename is the name of the file relative to the scanned path
+	Filename     string           `json:"filename"`
+	BlockID      uuid.UUID        `json:"blockID"`
+	TenantID     string           `json:"tenantID"`
+	Version      string           `json:"version"`
+	Encoding     backend.Encoding `json:"encoding"`
+	DataEncoding string           `json:"dataEncoding"`
+	// Objects is the number of objects that replay and DataLength the bytes of the pages holding them
+	Objects    int    `json:"objects"`
+	DataLength uint64 `json:"dataLength"`
+	// Size is the size of the file
+	Size int64 `json:"size"`
+	// Clean is true if the whole file replays. Otherwise Warning holds the replay warning, or Error why the file could
+	// not be read at all, such as it not being a wal file.
+	Clean   bool   `json:"clean"`
+	Warning string `json:"warning,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ScanWALDir reports on every file ReplayWALDir would replay or report in path without replaying them. Pages are read
+// like ValidateWALFile does so no records are kept and nothing is modified. Pass the options the files were written
+// with, such as WithPageFooters. The error is only set if the directory could not be read.
+func ScanWALDir(path string, opts ...AppendBlockOption) ([]WALBlockReport, error) {
+	files, err := listWALDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]WALBlockReport, 0, len(files))
+	for _, f := range files {
+		report := WALBlockReport{Filename: filepath.Join(f.tenantDir, f.name)}
+		if f.nameErr != nil {
+			report.Error = f.nameErr.Error()
+			reports = append(reports, report)
+			continue
+		}
+
+		blockOpts := append(append([]AppendBlockOption{}, opts...), withTenantDirs(f.tenantDir != ""))
+		warning, err := scanWALFile(&report, f.name, path, blockOpts...)
+		if err != nil {
+			report.Error = err.Error()
+		} else if warning != nil {
+			report.Warning = warning.Error()
+		}
+		report.Clean = err == nil && warning == nil
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// scanWALFile fills report for the wal file filename in path. It returns the replay warning and fatal error of the
+// file.
+func scanWALFile(report *WALBlockReport, filename string, path string, opts ...AppendBlockOption) (error, error) {
+	b, err := blockFromFilename(filename, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	report.BlockID = b.meta.BlockID
+	report.TenantID = b.meta.TenantID
+	report.Version = b.meta.Version
+	report.Encoding = b.meta.Encoding
+	report.DataEncoding = b.meta.DataEncoding
+
+	f, err := os.Open(b.fullFilename())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	report.Size = info.Size()
+
+	return b.walkPages(f, filename, 0, func(_ common.ID, start uint64, length uint32) {
+		report.Objects++
+		if end := start + uint64(length); end > report.DataLength {
+			report.DataLength = end
+		}
+	})
+}
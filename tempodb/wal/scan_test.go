@@ -0,0 +1,84 @@
+package wal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+func TestScanWALDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	clean, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "v1")
+	require.NoError(t, err)
+	writeTestObjects(t, clean, 5)
+
+	corrupt, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithTenantDirs())
+	require.NoError(t, err)
+	writeTestObjects(t, corrupt, 3)
+	corruptLength := corrupt.DataLength()
+	appendGarbage(t, corrupt.fullFilename())
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "notawalfile"), []byte{0x01}, 0644))
+
+	reports, err := ScanWALDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, reports, 3)
+
+	byName := map[string]WALBlockReport{}
+	for _, r := range reports {
+		byName[r.Filename] = r
+	}
+
+	assert.Equal(t, WALBlockReport{
+		Filename:     filepath.Base(clean.fullFilename()),
+		BlockID:      clean.meta.BlockID,
+		TenantID:     testTenantID,
+		Version:      clean.meta.Version,
+		Encoding:     backend.EncSnappy,
+		DataEncoding: "v1",
+		Objects:      5,
+		DataLength:   clean.DataLength(),
+		Size:         int64(clean.DataLength()),
+		Clean:        true,
+	}, byName[filepath.Base(clean.fullFilename())])
+
+	report := byName[filepath.Join(testTenantID, filepath.Base(corrupt.fullFilename()))]
+	assert.Equal(t, corrupt.meta.BlockID, report.BlockID)
+	assert.Equal(t, 3, report.Objects)
+	assert.Equal(t, corruptLength, report.DataLength)
+	assert.Equal(t, int64(corruptLength)+11, report.Size)
+	assert.False(t, report.Clean)
+	assert.NotEmpty(t, report.Warning)
+	assert.Empty(t, report.Error)
+
+	report = byName["notawalfile"]
+	assert.False(t, report.Clean)
+	assert.NotEmpty(t, report.Error)
+
+	// reports round trip through json
+	b, err := json.Marshal(reports)
+	require.NoError(t, err)
+	var unmarshalled []WALBlockReport
+	require.NoError(t, json.Unmarshal(b, &unmarshalled))
+	assert.Equal(t, reports, unmarshalled)
+
+	// nothing is modified
+	replayed, warning, err := newAppendBlockFromFile(filepath.Base(clean.fullFilename()), tempDir)
+	require.NoError(t, err)
+	require.NoError(t, warning)
+	assert.Equal(t, 5, replayed.appender.Length())
+
+	_, err = ScanWALDir(filepath.Join(tempDir, "missing"))
+	assert.Error(t, err)
+}
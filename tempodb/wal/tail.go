@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// TailFile follows a wal file that may still be appended to by another process and calls fn with every
+// object in the order it was written. Instead of stopping at the end of the file it polls for new pages
+// every pollInterval. A page that is only partially written is waited on until it is complete. TailFile
+// returns nil once ctx is done or the first error returned by fn.
+func TailFile(ctx context.Context, filename string, path string, pollInterval time.Duration, fn func(common.ID, []byte) error, opts ...AppendBlockOption) error {
+	b, err := blockFromFilename(filename, path, opts...)
+	if err != nil {
+		return err
+	}
+
+	f, err := b.file()
+	if err != nil {
+		return err
+	}
+	defer b.closeReadFile()
+
+	dataReader, err := b.newDataReader(f)
+	if err != nil {
+		return err
+	}
+	defer dataReader.Close()
+
+	objectReader := b.encoding.NewObjectReaderWriter()
+	lengthBytes := make([]byte, pageLengthSize)
+	offset := uint64(0)
+	var pages [][]byte
+	var buffer []byte
+	for {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		// read all complete pages
+		for offset+pageLengthSize <= uint64(info.Size()) {
+			_, err = f.ReadAt(lengthBytes, int64(offset))
+			if err != nil {
+				return err
+			}
+
+			pageLength := binary.LittleEndian.Uint32(lengthBytes)
+			pageLength += uint32(b.footerLength())
+			if offset+uint64(pageLength) > uint64(info.Size()) {
+				break // torn page at the tail. wait for the rest
+			}
+
+			pages, buffer, err = dataReader.Read(ctx, []common.Record{{Start: offset, Length: pageLength}}, pages, buffer)
+			if err != nil {
+				return err
+			}
+
+			reader := bytes.NewReader(pages[0])
+			for {
+				id, obj, err := objectReader.UnmarshalObjectFromReader(reader)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+
+				err = fn(id, obj)
+				if err != nil {
+					return err
+				}
+			}
+
+			offset += uint64(pageLength)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pollInterval):
+		}
+	}
+}
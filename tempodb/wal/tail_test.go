@@ -0,0 +1,121 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+func TestTailFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+
+	objects := 50
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var ids [][]byte
+	var objs [][]byte
+	var actualIDs [][]byte
+	var actualObjs [][]byte
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := TailFile(ctx, filepath.Base(block.fullFilename()), tempDir, time.Millisecond, func(id common.ID, obj []byte) error {
+			actualIDs = append(actualIDs, append([]byte(nil), id...))
+			actualObjs = append(actualObjs, append([]byte(nil), obj...))
+			if len(actualIDs) == objects {
+				cancel()
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+	}()
+
+	for i := 0; i < objects; i++ {
+		id, obj := writeTestObjects(t, block, 1)
+		ids = append(ids, id...)
+		objs = append(objs, obj...)
+		time.Sleep(time.Millisecond)
+	}
+
+	wg.Wait()
+	require.Len(t, actualIDs, objects)
+	assert.Equal(t, ids, actualIDs)
+	assert.Equal(t, objs, actualObjs)
+}
+
+func TestTailFileWaitsForTornPage(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	// write a block elsewhere to get the bytes of a page
+	sourceDir := filepath.Join(tempDir, "source")
+	err = os.MkdirAll(sourceDir, os.ModePerm)
+	require.NoError(t, err)
+	source, err := newAppendBlock(uuid.New(), testTenantID, sourceDir, backend.EncNone, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, source, 1)
+	page, err := ioutil.ReadFile(source.fullFilename())
+	require.NoError(t, err)
+
+	// write half of the page
+	filename := filepath.Base(source.fullFilename())
+	f, err := os.OpenFile(filepath.Join(tempDir, filename), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(page[:len(page)/2])
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	received := make(chan []byte, 1)
+	done := make(chan error)
+	go func() {
+		done <- TailFile(ctx, filename, tempDir, time.Millisecond, func(id common.ID, obj []byte) error {
+			assert.Equal(t, common.ID(ids[0]), id)
+			received <- append([]byte(nil), obj...)
+			return nil
+		})
+	}()
+
+	select {
+	case <-received:
+		require.FailNow(t, "received object from torn page")
+	case err := <-done:
+		require.FailNow(t, "tail stopped on torn page", "%v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// complete the page
+	_, err = f.Write(page[len(page)/2:])
+	require.NoError(t, err)
+
+	select {
+	case obj := <-received:
+		assert.Equal(t, objs[0], obj)
+	case <-ctx.Done():
+		require.FailNow(t, "timed out waiting for object")
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
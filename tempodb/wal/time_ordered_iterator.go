@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// GetTimeOrderedIterator returns an iterator over the block's combined objects ordered by the time returned by
+// extractor, for instance the trace start time in seconds. Objects with the same time are returned in id order.
+// Every object in the block is read, combined and held in memory before the first is returned so this is only
+// suitable for debugging and small blocks. Like GetIterator, the block can not be appended to afterwards.
+func (a *AppendBlock) GetTimeOrderedIterator(extractor func([]byte) (uint32, error), combiner common.ObjectCombiner) (encoding.Iterator, error) {
+	iter, err := a.GetIterator(context.Background(), combiner)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var objs []timedObject
+	for {
+		id, obj, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if id == nil {
+			break
+		}
+
+		t, err := extractor(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		// make a copy so we don't hold onto the iterator buffer
+		objs = append(objs, timedObject{
+			id:   append([]byte(nil), id...),
+			obj:  append([]byte(nil), obj...),
+			time: t,
+		})
+	}
+
+	sort.SliceStable(objs, func(i, j int) bool {
+		return objs[i].time < objs[j].time
+	})
+
+	return &timeOrderedIterator{objs: objs}, nil
+}
+
+type timedObject struct {
+	id   common.ID
+	obj  []byte
+	time uint32
+}
+
+type timeOrderedIterator struct {
+	objs []timedObject
+}
+
+func (i *timeOrderedIterator) Next(context.Context) (common.ID, []byte, error) {
+	if len(i.objs) == 0 {
+		return nil, nil, io.EOF
+	}
+
+	o := i.objs[0]
+	i.objs = i.objs[1:]
+	return o.id, o.obj, nil
+}
+
+func (i *timeOrderedIterator) Close() {}
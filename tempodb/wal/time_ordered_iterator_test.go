@@ -0,0 +1,85 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/tempodb/backend"
+)
+
+// testTime objects store their time in the first 4 bytes
+func testTime(obj []byte) (uint32, error) {
+	if len(obj) < 4 {
+		return 0, errors.New("object too short")
+	}
+	return binary.LittleEndian.Uint32(obj), nil
+}
+
+func TestTimeOrderedIterator(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+
+	// write objects with times in the reverse of write order
+	objects := 20
+	expected := make([][]byte, objects)
+	for i := 0; i < objects; i++ {
+		id := make([]byte, 16)
+		rand.Read(id)
+		obj := make([]byte, 20)
+		rand.Read(obj)
+		binary.LittleEndian.PutUint32(obj, uint32(1000+objects-i))
+
+		err = block.Write(id, obj)
+		require.NoError(t, err)
+		expected[objects-i-1] = id
+	}
+
+	iter, err := block.GetTimeOrderedIterator(testTime, &mockCombiner{})
+	require.NoError(t, err)
+	defer iter.Close()
+
+	var actual [][]byte
+	lastTime := uint32(0)
+	for {
+		id, obj, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		objTime, err := testTime(obj)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, objTime, lastTime)
+		lastTime = objTime
+		actual = append(actual, id)
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestTimeOrderedIteratorExtractorError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	err = block.Write([]byte{0x01}, []byte{0x01})
+	require.NoError(t, err)
+
+	_, err = block.GetTimeOrderedIterator(testTime, &mockCombiner{})
+	assert.Error(t, err)
+}
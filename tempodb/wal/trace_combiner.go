@@ -0,0 +1,193 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/grafana/tempo/pkg/tempopb"
+	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+// TraceCombiner combines objects as trace protos. All objects for an id are unmarshalled once, combined into a
+// single trace and marshalled once. common.ObjectCombiner instead unmarshals and marshals on every pair which is
+// expensive for ids with many records.
+type TraceCombiner interface {
+	Unmarshal(obj []byte, dataEncoding string) (*tempopb.Trace, error)
+	// Combine combines b into a and returns the result. It may modify both.
+	Combine(a, b *tempopb.Trace) *tempopb.Trace
+	Marshal(trace *tempopb.Trace, dataEncoding string) ([]byte, error)
+}
+
+// FindTrace is Find using a TraceCombiner
+func (a *AppendBlock) FindTrace(id common.ID, combiner TraceCombiner) ([]byte, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	records, err := a.findRecords(id)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+
+	file, err := a.file()
+	if err != nil {
+		return nil, err
+	}
+
+	dataReader, err := a.newDataReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer dataReader.Close()
+	dataReader, objectRW, _ := a.instrumentRead(dataReader, a.encoding.NewObjectReaderWriter(), nil)
+
+	c := newTraceCombination(combiner, a.meta.DataEncoding)
+	var pages [][]byte
+	var buffer []byte
+	for _, r := range records {
+		var obj []byte
+		obj, pages, buffer, err = readRecordObject(context.Background(), dataReader, objectRW, r, pages, buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.add(obj)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.result()
+}
+
+// GetTraceIterator is GetIterator using a TraceCombiner
+func (a *AppendBlock) GetTraceIterator(combiner TraceCombiner) (encoding.Iterator, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.cleared {
+		return nil, ErrBlockCleared
+	}
+
+	iterator, _, err := a.sealedRecordIterator(nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &traceCombiningIterator{
+		iter:         iterator,
+		combiner:     combiner,
+		dataEncoding: a.meta.DataEncoding,
+	}, nil
+}
+
+// traceCombination accumulates the objects for a single id. A lone object is returned as is without
+// unmarshalling it.
+type traceCombination struct {
+	combiner     TraceCombiner
+	dataEncoding string
+
+	obj   []byte
+	trace *tempopb.Trace
+}
+
+func newTraceCombination(combiner TraceCombiner, dataEncoding string) *traceCombination {
+	return &traceCombination{
+		combiner:     combiner,
+		dataEncoding: dataEncoding,
+	}
+}
+
+func (c *traceCombination) add(obj []byte) error {
+	if c.obj == nil && c.trace == nil {
+		c.obj = append([]byte(nil), obj...)
+		return nil
+	}
+
+	if c.trace == nil {
+		trace, err := c.combiner.Unmarshal(c.obj, c.dataEncoding)
+		if err != nil {
+			return err
+		}
+		c.trace = trace
+		c.obj = nil
+	}
+
+	trace, err := c.combiner.Unmarshal(obj, c.dataEncoding)
+	if err != nil {
+		return err
+	}
+	c.trace = c.combiner.Combine(c.trace, trace)
+	return nil
+}
+
+func (c *traceCombination) result() ([]byte, error) {
+	if c.trace == nil {
+		return c.obj, nil
+	}
+
+	return c.combiner.Marshal(c.trace, c.dataEncoding)
+}
+
+// traceCombiningIterator combines consecutive objects with the same id using a TraceCombiner
+type traceCombiningIterator struct {
+	iter         encoding.Iterator
+	combiner     TraceCombiner
+	dataEncoding string
+
+	nextID  common.ID
+	nextObj []byte
+}
+
+func (i *traceCombiningIterator) Next(ctx context.Context) (common.ID, []byte, error) {
+	id, obj := i.nextID, i.nextObj
+	i.nextID, i.nextObj = nil, nil
+	if id == nil {
+		var err error
+		id, obj, err = i.iter.Next(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if id == nil {
+			return nil, nil, io.EOF
+		}
+	}
+
+	id = append([]byte(nil), id...)
+	c := newTraceCombination(i.combiner, i.dataEncoding)
+	err := c.add(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		nextID, nextObj, err := i.iter.Next(ctx)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if nextID == nil || !bytes.Equal(id, nextID) {
+			i.nextID, i.nextObj = nextID, nextObj
+			break
+		}
+
+		err = c.add(nextObj)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	combined, err := c.result()
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, combined, nil
+}
+
+func (i *traceCombiningIterator) Close() {
+	i.iter.Close()
+}
@@ -0,0 +1,163 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/tempo/pkg/model"
+	"github.com/grafana/tempo/pkg/tempopb"
+	"github.com/grafana/tempo/pkg/util/test"
+	"github.com/grafana/tempo/tempodb/backend"
+	"github.com/grafana/tempo/tempodb/encoding/common"
+)
+
+type countingTraceCombiner struct {
+	TraceCombiner
+	marshals int
+}
+
+func (c *countingTraceCombiner) Marshal(trace *tempopb.Trace, dataEncoding string) ([]byte, error) {
+	c.marshals++
+	return c.TraceCombiner.Marshal(trace, dataEncoding)
+}
+
+// countingObjectCombiner counts combines. model.ObjectCombiner marshals once per combine.
+type countingObjectCombiner struct {
+	common.ObjectCombiner
+	combines int
+}
+
+func (c *countingObjectCombiner) Combine(dataEncoding string, objs ...[]byte) ([]byte, bool) {
+	c.combines++
+	return c.ObjectCombiner.Combine(dataEncoding, objs...)
+}
+
+// writeTracePieces writes the trace with id in pieces and returns the number of spans written
+func writeTracePieces(t testing.TB, block *AppendBlock, id []byte, pieces int) int {
+	spans := 0
+	for i := 0; i < pieces; i++ {
+		trace := test.MakeTraceWithSpanCount(1, 5, id)
+		spans += 5
+
+		obj, err := model.TraceCombiner.Marshal(trace, block.Meta().DataEncoding)
+		require.NoError(t, err)
+		err = block.Write(id, obj)
+		require.NoError(t, err)
+	}
+
+	return spans
+}
+
+func spanCount(t testing.TB, obj []byte, dataEncoding string) int {
+	trace, err := model.Unmarshal(obj, dataEncoding)
+	require.NoError(t, err)
+
+	spans := 0
+	for _, b := range trace.Batches {
+		for _, ils := range b.InstrumentationLibrarySpans {
+			spans += len(ils.Spans)
+		}
+	}
+	return spans
+}
+
+func TestTraceCombiner(t *testing.T) {
+	for _, dataEncoding := range []string{model.TracePBEncoding, model.CurrentEncoding} {
+		t.Run(dataEncoding, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("/tmp", "")
+			defer os.RemoveAll(tempDir)
+			require.NoError(t, err, "unexpected error creating temp dir")
+
+			block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, dataEncoding)
+			require.NoError(t, err)
+
+			// one id with many pieces and one with a single piece
+			pieces := 20
+			hotID := make([]byte, 16)
+			rand.Read(hotID)
+			hotSpans := writeTracePieces(t, block, hotID, pieces)
+			coldID := make([]byte, 16)
+			rand.Read(coldID)
+			coldSpans := writeTracePieces(t, block, coldID, 1)
+
+			byteCombiner := &countingObjectCombiner{ObjectCombiner: model.ObjectCombiner}
+			expected, err := block.Find(context.Background(), hotID, byteCombiner)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, byteCombiner.combines, pieces-1)
+
+			traceCombiner := &countingTraceCombiner{TraceCombiner: model.TraceCombiner}
+			actual, err := block.FindTrace(hotID, traceCombiner)
+			require.NoError(t, err)
+			assert.Equal(t, 1, traceCombiner.marshals)
+			assert.Equal(t, hotSpans, spanCount(t, actual, dataEncoding))
+			assert.Equal(t, spanCount(t, expected, dataEncoding), spanCount(t, actual, dataEncoding))
+
+			// a single object is returned without marshalling
+			traceCombiner = &countingTraceCombiner{TraceCombiner: model.TraceCombiner}
+			actual, err = block.FindTrace(coldID, traceCombiner)
+			require.NoError(t, err)
+			assert.Equal(t, 0, traceCombiner.marshals)
+			assert.Equal(t, coldSpans, spanCount(t, actual, dataEncoding))
+
+			actual, err = block.FindTrace([]byte{0x01}, traceCombiner)
+			require.NoError(t, err)
+			assert.Nil(t, actual)
+
+			traceCombiner = &countingTraceCombiner{TraceCombiner: model.TraceCombiner}
+			iter, err := block.GetTraceIterator(traceCombiner)
+			require.NoError(t, err)
+			defer iter.Close()
+
+			spans := map[string]int{}
+			for {
+				id, obj, err := iter.Next(context.Background())
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				spans[string(id)] = spanCount(t, obj, dataEncoding)
+			}
+			assert.Equal(t, map[string]int{string(hotID): hotSpans, string(coldID): coldSpans}, spans)
+			assert.Equal(t, 1, traceCombiner.marshals)
+		})
+	}
+}
+
+func BenchmarkFindHighDuplicates(b *testing.B) {
+	benchmarkFindHighDuplicates(b, func(block *AppendBlock, id common.ID) ([]byte, error) {
+		return block.Find(context.Background(), id, model.ObjectCombiner)
+	})
+}
+
+func BenchmarkFindTraceHighDuplicates(b *testing.B) {
+	benchmarkFindHighDuplicates(b, func(block *AppendBlock, id common.ID) ([]byte, error) {
+		return block.FindTrace(id, model.TraceCombiner)
+	})
+}
+
+func benchmarkFindHighDuplicates(b *testing.B, find func(*AppendBlock, common.ID) ([]byte, error)) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(b, err, "unexpected error creating temp dir")
+
+	block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, model.CurrentEncoding)
+	require.NoError(b, err)
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	writeTracePieces(b, block, id, 100)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := find(block, id)
+		require.NoError(b, err)
+	}
+}
@@ -1,10 +1,14 @@
 package wal
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -12,11 +16,15 @@ import (
 	"github.com/google/uuid"
 	"github.com/grafana/tempo/tempodb/backend"
 	"github.com/grafana/tempo/tempodb/backend/local"
+	"github.com/grafana/tempo/tempodb/encoding"
 )
 
 const (
 	completedDir = "completed"
 	blocksDir    = "blocks"
+
+	// repairFileMarker is part of the name of the temporary files created by Repair
+	repairFileMarker = ".repair"
 )
 
 type WAL struct {
@@ -28,7 +36,12 @@ type Config struct {
 	Filepath          string `yaml:"path"`
 	CompletedFilepath string
 	BlocksFilepath    string
-	Encoding          backend.Encoding `yaml:"encoding"`
+	// Encoding compresses wal pages. Every backend.SupportedEncoding is supported.
+	Encoding backend.Encoding `yaml:"encoding"`
+	// Version is the encoding version of new blocks. Defaults to v2.
+	Version string `yaml:"version"`
+	// FileMode is the permissions of new wal files. Defaults to 0644.
+	FileMode os.FileMode `yaml:"file_mode"`
 }
 
 func New(c *Config) (*WAL, error) {
@@ -36,6 +49,13 @@ func New(c *Config) (*WAL, error) {
 		return nil, fmt.Errorf("please provide a path for the WAL")
 	}
 
+	if c.Version != "" {
+		_, err := encoding.FromVersion(c.Version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wal version: %w", err)
+		}
+	}
+
 	// make folder
 	err := os.MkdirAll(c.Filepath, os.ModePerm)
 	if err != nil {
@@ -76,48 +96,82 @@ func New(c *Config) (*WAL, error) {
 	}, nil
 }
 
-// RescanBlocks returns a slice of append blocks from the wal folder
-func (w *WAL) RescanBlocks(log log.Logger) ([]*AppendBlock, error) {
+// RescanBlocks returns a slice of append blocks from the wal folder and its tenant folders, see WithTenantDirs. The
+// passed options are applied to every replayed block.
+func (w *WAL) RescanBlocks(log log.Logger, opts ...AppendBlockOption) ([]*AppendBlock, error) {
 	files, err := ioutil.ReadDir(w.c.Filepath)
 	if err != nil {
 		return nil, err
 	}
 
-	blocks := make([]*AppendBlock, 0, len(files))
+	type rescanFile struct {
+		name      string
+		tenantDir string
+		size      int64
+	}
+	rescan := make([]rescanFile, 0, len(files))
 	for _, f := range files {
-		if f.IsDir() {
+		if !f.IsDir() {
+			rescan = append(rescan, rescanFile{name: f.Name(), size: f.Size()})
 			continue
 		}
+		if reservedDir(f.Name()) {
+			continue
+		}
+
+		tenantFiles, err := tenantDirFiles(filepath.Join(w.c.Filepath, f.Name()), f.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range tenantFiles {
+			var size int64
+			if info, err := os.Stat(filepath.Join(w.c.Filepath, f.Name(), name)); err == nil {
+				size = info.Size()
+			}
+			rescan = append(rescan, rescanFile{name: name, tenantDir: f.Name(), size: size})
+		}
+	}
 
+	blocks := make([]*AppendBlock, 0, len(rescan))
+	for _, f := range rescan {
 		start := time.Now()
-		level.Info(log).Log("msg", "beginning replay", "file", f.Name(), "size", f.Size())
-		b, warning, err := newAppendBlockFromFile(f.Name(), w.c.Filepath)
+		level.Info(log).Log("msg", "beginning replay", "file", f.name, "tenantDir", f.tenantDir, "size", f.size)
+		blockOpts := append([]AppendBlockOption{WithLogger(log)}, opts...)
+		blockOpts = append(blockOpts, withTenantDirs(f.tenantDir != ""))
+		b, warning, err := newAppendBlockFromFile(f.name, w.c.Filepath, blockOpts...)
 
 		remove := false
 		if err != nil {
 			// wal replay failed, clear and warn
-			level.Warn(log).Log("msg", "failed to replay block. removing.", "file", f.Name(), "err", err)
+			level.Warn(log).Log("msg", "failed to replay block. removing.", "file", f.name, "err", err)
 			remove = true
 		}
 
 		if b != nil && b.appender.Length() == 0 {
-			level.Warn(log).Log("msg", "empty wal file. ignoring.", "file", f.Name(), "err", err)
+			level.Warn(log).Log("msg", "empty wal file. ignoring.", "file", f.name, "err", err)
 			remove = true
 		}
 
 		if warning != nil {
-			level.Warn(log).Log("msg", "received warning while replaying block. partial replay likely.", "file", f.Name(), "warning", warning, "records", b.appender.Length())
+			level.Warn(log).Log("msg", "received warning while replaying block. partial replay likely.", "file", f.name, "warning", warning, "records", b.appender.Length(),
+				"truncatedAt", b.replayResult.TruncatedAtOffset, "skippedBytes", b.replayResult.SkippedBytes)
 		}
 
 		if remove {
-			err = os.Remove(filepath.Join(w.c.Filepath, f.Name()))
+			err = os.Remove(filepath.Join(w.c.Filepath, f.tenantDir, f.name))
 			if err != nil {
 				return nil, err
 			}
+			for _, name := range []string{f.name, f.name + compactionLevelSuffix} {
+				err = os.Remove(filepath.Join(w.c.Filepath, checkpointDir, name))
+				if err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+			}
 			continue
 		}
 
-		level.Info(log).Log("msg", "replay complete", "file", f.Name(), "duration", time.Since(start))
+		level.Info(log).Log("msg", "replay complete", "file", f.name, "duration", time.Since(start))
 
 		blocks = append(blocks, b)
 	}
@@ -125,8 +179,222 @@ func (w *WAL) RescanBlocks(log log.Logger) ([]*AppendBlock, error) {
 	return blocks, nil
 }
 
-func (w *WAL) NewBlock(id uuid.UUID, tenantID string, dataEncoding string) (*AppendBlock, error) {
-	return newAppendBlock(id, tenantID, w.c.Filepath, w.c.Encoding, dataEncoding)
+// ReplayWALDir replays every wal file in path and in its tenant folders, see WithTenantDirs. Unlike RescanBlocks
+// nothing is removed. Hidden files, directories and temporary files left by Repair are skipped, as are files with no
+// objects. Files in a folder are only replayed if the folder is named after their tenant. The returned errors hold a
+// warning or error for each file that did not replay cleanly, files that failed to replay entirely are not returned as
+// blocks. If several files hold the same block only the one with the most objects is returned, see preferReplayed, and
+// the others are reported. Blocks are ordered by block id. Errors for files that are not wal files wrap the error
+// parsing their name, such as ErrFilenameSegments. The final error is only set if the directory could not be read.
+func ReplayWALDir(path string, opts ...AppendBlockOption) ([]*AppendBlock, []error, error) {
+	return ReplayWALDirParallel(path, 1, opts...)
+}
+
+// ReplayWALDirParallel is ReplayWALDir but replays up to concurrency files at a time. The blocks and errors returned
+// are the same as ReplayWALDir's, in the same order. opts are applied to every block so callbacks such as
+// WithReplayProgress may be called concurrently.
+func ReplayWALDirParallel(path string, concurrency int, opts ...AppendBlockOption) ([]*AppendBlock, []error, error) {
+	files, err := listWALDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type replayedFile struct {
+		walDirFile
+		block   *AppendBlock
+		warning error
+		err     error
+	}
+
+	replayed := make([]replayedFile, 0, len(files))
+	for _, f := range files {
+		replayed = append(replayed, replayedFile{walDirFile: f})
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan *replayedFile)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency && i < len(replayed); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				blockOpts := append(append([]AppendBlockOption{}, opts...), withTenantDirs(r.tenantDir != ""))
+				r.block, r.warning, r.err = newAppendBlockFromFile(r.name, path, blockOpts...)
+			}
+		}()
+	}
+	for i := range replayed {
+		if replayed[i].nameErr == nil {
+			jobs <- &replayed[i]
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	var blocks []*AppendBlock
+	var errs []error
+	byID := map[uuid.UUID]int{}
+	for _, r := range replayed {
+		name, b := r.name, r.block
+		if r.tenantDir != "" {
+			name = filepath.Join(r.tenantDir, name)
+		}
+		if r.nameErr != nil {
+			errs = append(errs, fmt.Errorf("skipping %s. not a wal file: %w", name, r.nameErr))
+			continue
+		}
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("error replaying %s: %w", name, r.err))
+			continue
+		}
+		if r.warning != nil {
+			errs = append(errs, fmt.Errorf("warning replaying %s: %w", name, r.warning))
+		}
+		if b.appender.Length() == 0 {
+			b.closeReadFile()
+			continue
+		}
+
+		if i, ok := byID[b.meta.BlockID]; ok {
+			kept, discarded := blocks[i], b
+			if preferReplayed(b, blocks[i]) {
+				kept, discarded = b, blocks[i]
+				blocks[i] = b
+			}
+			discarded.closeReadFile()
+			errs = append(errs, fmt.Errorf("skipping %s. duplicate of block %v in %s", replayedName(discarded), b.meta.BlockID, replayedName(kept)))
+			continue
+		}
+
+		byID[b.meta.BlockID] = len(blocks)
+		blocks = append(blocks, b)
+	}
+
+	// file names start with the block id so this only matters for ids the directory listing sorts differently
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return bytes.Compare(blocks[i].meta.BlockID[:], blocks[j].meta.BlockID[:]) < 0
+	})
+
+	return blocks, errs, nil
+}
+
+// walDirFile is a file of a wal path returned by listWALDir
+type walDirFile struct {
+	name string
+	// tenantDir is the tenant folder of path holding the file, if any
+	tenantDir string
+	// nameErr is the error parsing the name of a file that is not a wal file
+	nameErr error
+}
+
+// listWALDir returns the files in path and its tenant folders that ReplayWALDir replays or reports, in directory order.
+// Files in tenant folders are always wal files.
+func listWALDir(path string) ([]walDirFile, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []walDirFile
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".") || strings.Contains(name, repairFileMarker) {
+			continue
+		}
+		if f.IsDir() {
+			if reservedDir(name) {
+				continue
+			}
+			tenantFiles, err := tenantDirFiles(filepath.Join(path, name), name)
+			if err != nil {
+				return nil, err
+			}
+			for _, tenantFile := range tenantFiles {
+				listed = append(listed, walDirFile{name: tenantFile, tenantDir: name})
+			}
+			continue
+		}
+
+		_, _, _, _, _, nameErr := parseFilename(name)
+		listed = append(listed, walDirFile{name: name, nameErr: nameErr})
+	}
+
+	return listed, nil
+}
+
+// tenantDirFiles returns the names of the wal files of tenantID in dir, a tenant folder of the wal path. Other files are
+// not wal files of the layout and are ignored.
+func tenantDirFiles(dir string, tenantID string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || strings.Contains(name, repairFileMarker) {
+			continue
+		}
+		_, fileTenantID, _, _, _, err := parseFilename(name)
+		if err != nil || fileTenantID != tenantID {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// reservedDir returns true for the folders of the wal path that are not tenant folders
+func reservedDir(name string) bool {
+	return name == checkpointDir || name == blocksDir || name == completedDir
+}
+
+// replayedName returns the name of a replayed block's file relative to the wal path
+func replayedName(b *AppendBlock) string {
+	name := filepath.Base(b.fullFilename())
+	if b.tenantDirs {
+		return filepath.Join(b.meta.TenantID, name)
+	}
+	return name
+}
+
+// preferReplayed returns true if a should be kept over b, two replayed files of the same block. The file with more
+// objects is kept, then the one with more data and finally the one whose name sorts last so the choice does not
+// depend on the order the files are read.
+func preferReplayed(a *AppendBlock, b *AppendBlock) bool {
+	if a.appender.Length() != b.appender.Length() {
+		return a.appender.Length() > b.appender.Length()
+	}
+	if aLength, bLength := replayedLength(a), replayedLength(b); aLength != bLength {
+		return aLength > bLength
+	}
+	return a.fullFilename() > b.fullFilename()
+}
+
+// replayedLength returns the number of bytes of the file that were replayed into b
+func replayedLength(b *AppendBlock) uint64 {
+	var length uint64
+	for _, r := range b.appender.Records() {
+		if end := r.Start + uint64(r.Length); end > length {
+			length = end
+		}
+	}
+	return length
+}
+
+func (w *WAL) NewBlock(id uuid.UUID, tenantID string, dataEncoding string, opts ...AppendBlockOption) (*AppendBlock, error) {
+	if w.c.Version != "" {
+		opts = append([]AppendBlockOption{WithVersion(w.c.Version)}, opts...)
+	}
+	if w.c.FileMode != 0 {
+		opts = append([]AppendBlockOption{WithFileMode(w.c.FileMode)}, opts...)
+	}
+	return newAppendBlock(id, tenantID, w.c.Filepath, w.c.Encoding, dataEncoding, opts...)
 }
 
 func (w *WAL) NewFile(blockid uuid.UUID, tenantid string, dir string, name string) (*os.File, error) {
@@ -135,7 +403,11 @@ func (w *WAL) NewFile(blockid uuid.UUID, tenantid string, dir string, name strin
 	if err != nil {
 		return nil, err
 	}
-	return os.OpenFile(filepath.Join(p, fmt.Sprintf("%v:%v:%v", blockid, tenantid, name)), os.O_CREATE|os.O_RDWR, 0644)
+	mode := defaultFileMode
+	if w.c.FileMode != 0 {
+		mode = w.c.FileMode
+	}
+	return os.OpenFile(filepath.Join(p, fmt.Sprintf("%v:%v:%v", blockid, tenantid, name)), os.O_CREATE|os.O_RDWR, mode)
 }
 
 func (w *WAL) ClearFolder(dir string) error {
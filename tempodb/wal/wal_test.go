@@ -21,6 +21,7 @@ import (
 	"github.com/grafana/tempo/pkg/util/test"
 	"github.com/grafana/tempo/tempodb/backend"
 	"github.com/grafana/tempo/tempodb/encoding"
+	"github.com/grafana/tempo/tempodb/encoding/common"
 )
 
 const (
@@ -171,10 +172,54 @@ func TestErrorConditions(t *testing.T) {
 	assert.NoFileExists(t, filepath.Join(tempDir, "fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:blerg:v2:gzip"))
 }
 
+func TestUnsupportedEncoding(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	_, err = newAppendBlock(uuid.New(), testTenantID, tempDir, backend.Encoding(255), "")
+	assert.EqualError(t, err, "unsupported wal encoding unsupported. supported: "+backend.SupportedEncodingString())
+
+	files, err := ioutil.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFileMode(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	wal, err := New(&Config{
+		Filepath: tempDir,
+		Encoding: backend.EncNone,
+		FileMode: 0600,
+	})
+	require.NoError(t, err)
+
+	block, err := wal.NewBlock(uuid.New(), testTenantID, "", WithIndexCheckpoints(1))
+	require.NoError(t, err)
+	writeTestObjects(t, block, 2)
+
+	for _, name := range []string{block.fullFilename(), block.checkpointFilename()} {
+		info, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), name)
+	}
+
+	f, err := wal.NewFile(block.BlockID(), testTenantID, "search", "data")
+	require.NoError(t, err)
+	defer f.Close()
+	info, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+}
+
 func TestAppendReplayFind(t *testing.T) {
 	for _, e := range backend.SupportedEncoding {
 		t.Run(e.String(), func(t *testing.T) {
-			testAppendReplayFind(t, backend.EncZstd)
+			testAppendReplayFind(t, e)
 		})
 	}
 }
@@ -212,7 +257,7 @@ func testAppendReplayFind(t *testing.T, e backend.Encoding) {
 	}
 
 	for i, id := range ids {
-		obj, err := block.Find(id, &mockCombiner{})
+		obj, err := block.Find(context.Background(), id, &mockCombiner{})
 		require.NoError(t, err)
 		assert.Equal(t, objs[i], obj)
 	}
@@ -228,14 +273,15 @@ func testAppendReplayFind(t *testing.T, e backend.Encoding) {
 	blocks, err := wal.RescanBlocks(log.NewNopLogger())
 	require.NoError(t, err, "unexpected error getting blocks")
 	require.Len(t, blocks, 1)
+	assert.Equal(t, e, blocks[0].Meta().Encoding)
 
-	iterator, err := blocks[0].GetIterator(&mockCombiner{})
+	iterator, err := blocks[0].GetIterator(context.Background(), &mockCombiner{})
 	require.NoError(t, err)
 	defer iterator.Close()
 
 	// append block find
 	for i, id := range ids {
-		obj, err := blocks[0].Find(id, &mockCombiner{})
+		obj, err := blocks[0].Find(context.Background(), id, &mockCombiner{})
 		require.NoError(t, err)
 		assert.Equal(t, objs[i], obj)
 	}
@@ -321,7 +367,7 @@ func benchmarkWriteFindReplay(b *testing.B, encoding backend.Encoding) {
 
 		// find
 		for _, id := range ids {
-			_, err := block.Find(id, mockCombiner)
+			_, err := block.Find(context.Background(), id, mockCombiner)
 			require.NoError(b, err)
 		}
 
@@ -332,3 +378,284 @@ func benchmarkWriteFindReplay(b *testing.B, encoding backend.Encoding) {
 		os.RemoveAll(tempDir)
 	}
 }
+
+func TestReplayWALDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	clean, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	writeTestObjects(t, clean, 5)
+
+	torn, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, torn, 3)
+	appendGarbage(t, torn.fullFilename())
+
+	// files that are skipped
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, ".hidden"), []byte{0x01}, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, clean.meta.BlockID.String()+repairFileMarker+"123"), []byte{0x01}, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:blerg:v2:gzip"), []byte{}, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(tempDir, "subdir"), 0755))
+
+	// files that are reported
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:tenant:v2:notanencoding"), []byte{}, 0644))
+
+	blocks, errs, err := ReplayWALDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	require.Len(t, errs, 2)
+
+	lengths := map[uuid.UUID]int{}
+	for _, b := range blocks {
+		lengths[b.meta.BlockID] = b.appender.Length()
+	}
+	assert.Equal(t, map[uuid.UUID]int{clean.meta.BlockID: 5, torn.meta.BlockID: 3}, lengths)
+	assert.Contains(t, errs[0].Error()+errs[1].Error(), "notanencoding")
+	assert.Contains(t, errs[0].Error()+errs[1].Error(), filepath.Base(torn.fullFilename()))
+
+	// nothing is removed
+	assert.FileExists(t, filepath.Join(tempDir, "fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:blerg:v2:gzip"))
+
+	_, _, err = ReplayWALDir(filepath.Join(tempDir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestReplayWALDirParallel(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	encodings := []backend.Encoding{backend.EncNone, backend.EncSnappy, backend.EncZstd}
+	for i := 0; i < 20; i++ {
+		block, err := newAppendBlock(uuid.New(), testTenantID, tempDir, encodings[i%len(encodings)], "")
+		require.NoError(t, err)
+		ids, objs := writeTestObjects(t, block, i+1)
+
+		switch i % 5 {
+		case 1:
+			appendGarbage(t, block.fullFilename())
+		case 2:
+			// a duplicate with fewer objects
+			duplicate, err := newAppendBlock(block.meta.BlockID, testTenantID, tempDir, encodings[(i+1)%len(encodings)], "")
+			require.NoError(t, err)
+			require.NoError(t, duplicate.Write(ids[0], objs[0]))
+		}
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "fe0b83eb-a86b-4b6c-9a74-dc272cd5700e:tenant:v2:notanencoding"), []byte{}, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "notawalfile"), []byte{0x01}, 0644))
+
+	summarize := func(blocks []*AppendBlock, errs []error) ([]string, []common.Records, []string) {
+		var names []string
+		var records []common.Records
+		for _, b := range blocks {
+			names = append(names, filepath.Base(b.fullFilename()))
+			records = append(records, b.appender.Records())
+		}
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		return names, records, messages
+	}
+
+	blocks, errs, err := ReplayWALDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, blocks, 20)
+	expectedNames, expectedRecords, expectedErrs := summarize(blocks, errs)
+	require.Len(t, expectedErrs, 2+4+4)
+	for i := 1; i < len(blocks); i++ {
+		assert.True(t, bytes.Compare(blocks[i-1].meta.BlockID[:], blocks[i].meta.BlockID[:]) < 0, "blocks are ordered by id")
+	}
+
+	for _, concurrency := range []int{0, 1, 4, 64} {
+		blocks, errs, err := ReplayWALDirParallel(tempDir, concurrency)
+		require.NoError(t, err)
+		names, records, messages := summarize(blocks, errs)
+		assert.Equal(t, expectedNames, names)
+		assert.Equal(t, expectedRecords, records)
+		assert.Equal(t, expectedErrs, messages)
+	}
+
+	_, _, err = ReplayWALDirParallel(filepath.Join(tempDir, "missing"), 4)
+	assert.Error(t, err)
+}
+
+func TestReplayWALDirTenantDirs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	flat, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	writeTestObjects(t, flat, 2)
+
+	nested, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncSnappy, "", WithTenantDirs())
+	require.NoError(t, err)
+	writeTestObjects(t, nested, 3)
+	assert.Equal(t, filepath.Join(tempDir, testTenantID, filepath.Base(nested.fullFilename())), nested.fullFilename())
+
+	other, err := newAppendBlock(uuid.New(), "other", tempDir, backend.EncNone, "", WithTenantDirs(), WithIndexCheckpoints(1))
+	require.NoError(t, err)
+	writeTestObjects(t, other, 4)
+
+	// a duplicate of the nested block in the flat layout with fewer objects
+	duplicate, err := newAppendBlock(nested.meta.BlockID, testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, duplicate, 1)
+
+	// files in tenant folders that are not of that tenant are ignored
+	misplaced, err := newAppendBlock(uuid.New(), "other", tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, misplaced, 1)
+	require.NoError(t, os.Rename(misplaced.fullFilename(), filepath.Join(tempDir, testTenantID, filepath.Base(misplaced.fullFilename()))))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "other", "notawalfile"), []byte{0x01}, 0644))
+
+	_, err = newAppendBlock(uuid.New(), "..", tempDir, backend.EncNone, "", WithTenantDirs())
+	assert.Error(t, err)
+	for _, reserved := range []string{checkpointDir, blocksDir, completedDir} {
+		_, err = newAppendBlock(uuid.New(), reserved, tempDir, backend.EncNone, "", WithTenantDirs())
+		assert.Error(t, err, reserved)
+	}
+
+	// blocks replayed from either layout work with the option passed or not
+	for _, opts := range [][]AppendBlockOption{nil, {WithTenantDirs()}} {
+		blocks, errs, err := ReplayWALDir(tempDir, opts...)
+		require.NoError(t, err)
+		require.Len(t, errs, 1)
+		assert.Contains(t, errs[0].Error(), filepath.Base(duplicate.fullFilename()))
+		assert.Contains(t, errs[0].Error(), filepath.Join(testTenantID, filepath.Base(nested.fullFilename())))
+
+		byID := map[uuid.UUID]*AppendBlock{}
+		for _, b := range blocks {
+			byID[b.meta.BlockID] = b
+		}
+		require.Len(t, byID, 3)
+		for _, expected := range []*AppendBlock{flat, nested, other} {
+			b := byID[expected.meta.BlockID]
+			require.NotNil(t, b)
+			assert.Equal(t, expected.fullFilename(), b.fullFilename())
+			assert.Equal(t, expected.appender.Length(), b.appender.Length())
+
+			iter, err := b.GetIterator(context.Background(), &mockCombiner{})
+			require.NoError(t, err)
+			count := 0
+			for {
+				id, _, err := iter.Next(context.Background())
+				if err == io.EOF || id == nil {
+					break
+				}
+				require.NoError(t, err)
+				count++
+			}
+			iter.Close()
+			assert.Equal(t, expected.appender.Length(), count)
+			require.NoError(t, b.CloseRead())
+		}
+	}
+}
+
+func TestRescanBlocksTenantDirs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	wal, err := New(&Config{
+		Filepath: tempDir,
+		Encoding: backend.EncNone,
+	})
+	require.NoError(t, err, "unexpected error creating temp wal")
+
+	flat, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, flat, 2)
+
+	nested, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "", WithTenantDirs(), WithIndexCheckpoints(1))
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, nested, 3)
+
+	empty, err := newAppendBlock(uuid.New(), "other", tempDir, backend.EncNone, "", WithTenantDirs(), WithIndexCheckpoints(1))
+	require.NoError(t, err)
+
+	blocks, err := wal.RescanBlocks(log.NewNopLogger())
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+
+	byID := map[uuid.UUID]*AppendBlock{}
+	for _, b := range blocks {
+		byID[b.meta.BlockID] = b
+	}
+	require.NotNil(t, byID[flat.meta.BlockID])
+	b := byID[nested.meta.BlockID]
+	require.NotNil(t, b)
+	assert.Equal(t, nested.fullFilename(), b.fullFilename())
+	for i, id := range ids {
+		obj, err := b.Find(context.Background(), id, &mockCombiner{})
+		require.NoError(t, err)
+		assert.Equal(t, objs[i], obj)
+	}
+
+	// empty files in tenant folders are removed like any other
+	assert.NoFileExists(t, empty.fullFilename())
+	assert.NoFileExists(t, empty.checkpointFilename())
+}
+
+func TestReplayWALDirDuplicates(t *testing.T) {
+	tempDir, err := ioutil.TempDir("/tmp", "")
+	defer os.RemoveAll(tempDir)
+	require.NoError(t, err, "unexpected error creating temp dir")
+
+	id := uuid.New()
+	complete, err := newAppendBlock(id, testTenantID, tempDir, backend.EncSnappy, "")
+	require.NoError(t, err)
+	writeTestObjects(t, complete, 5)
+
+	partial, err := newAppendBlock(id, testTenantID, tempDir, backend.EncZstd, "")
+	require.NoError(t, err)
+	writeTestObjects(t, partial, 3)
+
+	other, err := newAppendBlock(uuid.New(), testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	writeTestObjects(t, other, 2)
+
+	blocks, errs, err := ReplayWALDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), filepath.Base(partial.fullFilename()))
+
+	for _, b := range blocks {
+		if b.meta.BlockID == id {
+			assert.Equal(t, backend.EncSnappy, b.meta.Encoding)
+			assert.Equal(t, 5, b.appender.Length())
+		}
+	}
+
+	// with the same number of objects the file with more data is kept
+	require.NoError(t, complete.Clear())
+	require.NoError(t, partial.Clear())
+
+	none, err := newAppendBlock(id, testTenantID, tempDir, backend.EncNone, "")
+	require.NoError(t, err)
+	gzip, err := newAppendBlock(id, testTenantID, tempDir, backend.EncGZIP, "")
+	require.NoError(t, err)
+	ids, objs := writeTestObjects(t, none, 3)
+	for i := range ids {
+		require.NoError(t, gzip.Write(ids[i], objs[i]))
+	}
+	expected := none.meta.Encoding
+	if gzip.DataLength() > none.DataLength() {
+		expected = gzip.meta.Encoding
+	}
+
+	blocks, errs, err = ReplayWALDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	require.Len(t, errs, 1)
+	for _, b := range blocks {
+		if b.meta.BlockID == id {
+			assert.Equal(t, expected, b.meta.Encoding)
+		}
+	}
+}